@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"kubevirt-nvidia-device-plugin/pkg/device_plugin"
+)
+
+// runAllocate talks to a running device plugin the way kubelet does: it prints the plugin options
+// and devices, then the preferred allocation and the allocation of the requested devices.
+// The plugin audits the allocation as a debug-allocate event.
+func runAllocate(args []string) error {
+	fs := flag.NewFlagSet("allocate", flag.ContinueOnError)
+	resource := fs.String("resource", "", "Resource name of the device plugin, e.g. nvidia.com/GH100_H100_SXM5_80GB")
+	socket := fs.String("socket", "", "Socket of the device plugin, instead of the socket of --resource")
+	devices := fs.StringSlice("devices", nil, "Device IDs or PCI addresses to allocate, only the devices are listed if empty")
+	size := fs.Int("size", 0, "Number of devices of the preferred allocation, the number of --devices if 0")
+	watch := fs.Duration("watch", 0, "Keep printing the device list updates for this long before allocating")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout of the connection and of each call")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	socketPath := *socket
+	if socketPath == "" {
+		if *resource == "" {
+			return errors.New("either --resource or --socket is required")
+		}
+		var err error
+		if socketPath, err = device_plugin.ResourceSocketPath(*resource); err != nil {
+			return err
+		}
+	}
+	client, conn, err := device_plugin.DialDevicePlugin(socketPath, *timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	out := os.Stdout
+	fmt.Fprintf(out, "Device plugin %s\n", socketPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	options, err := client.GetDevicePluginOptions(ctx, &pluginapi.Empty{})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("GetDevicePluginOptions: %w", err)
+	}
+	fmt.Fprintf(out, "\nOptions:\n  PreStartRequired: %t\n  GetPreferredAllocationAvailable: %t\n", options.PreStartRequired, options.GetPreferredAllocationAvailable)
+
+	listed, err := listDevices(client, *timeout, *watch, out)
+	if err != nil {
+		return err
+	}
+	if len(*devices) == 0 {
+		return nil
+	}
+	ids, err := resolveDeviceIDs(*devices, listed)
+	if err != nil {
+		return err
+	}
+
+	if options.GetPreferredAllocationAvailable {
+		available := make([]string, 0, len(listed))
+		for _, d := range listed {
+			available = append(available, d.ID)
+		}
+		allocationSize := *size
+		if allocationSize == 0 {
+			allocationSize = len(ids)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		resp, err := client.GetPreferredAllocation(ctx, &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+				AvailableDeviceIDs:   available,
+				MustIncludeDeviceIDs: ids,
+				AllocationSize:       int32(allocationSize),
+			}},
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("GetPreferredAllocation: %w", err)
+		}
+		fmt.Fprintf(out, "\nPreferred allocation of %d devices including %s:\n", allocationSize, strings.Join(ids, ", "))
+		for i, container := range resp.ContainerResponses {
+			fmt.Fprintf(out, "  Container %d: %s\n", i, strings.Join(container.DeviceIDs, ", "))
+		}
+	} else {
+		fmt.Fprintf(out, "\nPreferred allocation: not supported by the plugin\n")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), *timeout)
+	resp, err := client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+	})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("Allocate: %w", err)
+	}
+	fmt.Fprintf(out, "\nAllocation of %s:\n", strings.Join(ids, ", "))
+	printAllocateResponse(out, resp)
+	return nil
+}
+
+// listDevices prints the devices of the first ListAndWatch response, and the updates received
+// during watch. It returns the last device list.
+func listDevices(client pluginapi.DevicePluginClient, timeout time.Duration, watch time.Duration, out io.Writer) ([]*pluginapi.Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+watch)
+	defer cancel()
+	stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		return nil, fmt.Errorf("ListAndWatch: %w", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("ListAndWatch: %w", err)
+	}
+	devices := resp.Devices
+	printDeviceList(out, devices)
+	if watch == 0 {
+		return devices, nil
+	}
+
+	deadline := time.Now().Add(watch)
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if time.Now().After(deadline) {
+				return devices, nil
+			}
+			return nil, fmt.Errorf("ListAndWatch: %w", err)
+		}
+		devices = resp.Devices
+		fmt.Fprintf(out, "\nUpdate at %s:", time.Now().Format(time.RFC3339))
+		printDeviceList(out, devices)
+	}
+}
+
+func printDeviceList(out io.Writer, devices []*pluginapi.Device) {
+	fmt.Fprintf(out, "\nDevices (%d):\n", len(devices))
+	for _, d := range devices {
+		var numaNodes []string
+		for _, node := range d.GetTopology().GetNodes() {
+			numaNodes = append(numaNodes, fmt.Sprint(node.ID))
+		}
+		topology := "no topology"
+		if len(numaNodes) > 0 {
+			topology = "NUMA " + strings.Join(numaNodes, ",")
+		}
+		fmt.Fprintf(out, "  %s  %s  %s\n", d.ID, d.Health, topology)
+	}
+}
+
+// resolveDeviceIDs maps the requested PCI addresses to the IDs of the listed devices,
+// device IDs are passed as they are
+func resolveDeviceIDs(requested []string, listed []*pluginapi.Device) ([]string, error) {
+	ids := make([]string, 0, len(requested))
+	for _, r := range requested {
+		id := ""
+		for _, d := range listed {
+			if d.ID == r || strings.HasSuffix(d.ID, "|"+r) {
+				id = d.ID
+				break
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("device %s is not listed by the plugin", r)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func printAllocateResponse(out io.Writer, resp *pluginapi.AllocateResponse) {
+	for i, container := range resp.ContainerResponses {
+		fmt.Fprintf(out, "  Container %d:\n", i)
+		if len(container.Devices) > 0 {
+			fmt.Fprintf(out, "    Device specs:\n")
+			for _, spec := range container.Devices {
+				fmt.Fprintf(out, "      %s -> %s (%s)\n", spec.HostPath, spec.ContainerPath, spec.Permissions)
+			}
+		}
+		if len(container.CDIDevices) > 0 {
+			fmt.Fprintf(out, "    CDI devices:\n")
+			for _, device := range container.CDIDevices {
+				fmt.Fprintf(out, "      %s\n", device.Name)
+			}
+		}
+		if len(container.Mounts) > 0 {
+			fmt.Fprintf(out, "    Mounts:\n")
+			for _, mount := range container.Mounts {
+				fmt.Fprintf(out, "      %s -> %s (read-only: %t)\n", mount.HostPath, mount.ContainerPath, mount.ReadOnly)
+			}
+		}
+		printMap(out, "Env", container.Envs)
+		printMap(out, "Annotations", container.Annotations)
+	}
+}
+
+func printMap(out io.Writer, title string, values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(out, "    %s:\n", title)
+	for _, key := range keys {
+		fmt.Fprintf(out, "      %s=%s\n", key, values[key])
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"kubevirt-nvidia-device-plugin/pkg/audit"
+)
+
+// runAudit prints the records of the allocation audit log, oldest first
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	path := fs.String("log", audit.DefaultPath, "Audit log file, its rotated files are read too")
+	output := fs.StringP("output", "o", "table", "Output format: table or json")
+	resource := fs.String("resource", "", "Only print the records of this resource, e.g. nvidia.com/GH100_H100_SXM5_80GB")
+	pod := fs.String("pod", "", "Only print the records of this pod, as namespace/name")
+	vmi := fs.String("vmi", "", "Only print the records of this VirtualMachineInstance")
+	pciAddress := fs.String("pci-address", "", "Only print the records of this device")
+	since := fs.Duration("since", 0, "Only print the records of this last period, e.g. 24h")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q, expected table or json", *output)
+	}
+
+	records, err := audit.Read(*path)
+	if err != nil {
+		return err
+	}
+	var selected []audit.Record
+	for _, r := range records {
+		if *resource != "" && r.Resource != *resource {
+			continue
+		}
+		if *pod != "" && (r.Pod == nil || r.Pod.Namespace+"/"+r.Pod.Name != *pod) {
+			continue
+		}
+		if *vmi != "" && (r.Pod == nil || r.Pod.VMI != *vmi) {
+			continue
+		}
+		if *pciAddress != "" && !slices.Contains(r.PCIAddresses, *pciAddress) && !slices.Contains(r.Companions, *pciAddress) {
+			continue
+		}
+		if *since > 0 && r.Time.Before(time.Now().Add(-*since)) {
+			continue
+		}
+		selected = append(selected, r)
+	}
+	return printRecords(os.Stdout, *output, selected)
+}
+
+func printRecords(w io.Writer, output string, records []audit.Record) error {
+	if output == "json" {
+		if records == nil {
+			records = []audit.Record{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tRESOURCE\tPCI ADDRESSES\tPOD\tCONTAINER\tVMI\tERROR")
+	for _, r := range records {
+		pod, container, vmi := "-", "-", "-"
+		if r.Pod != nil {
+			pod, container = r.Pod.Namespace+"/"+r.Pod.Name, r.Pod.Container
+			if r.Pod.VMI != "" {
+				vmi = r.Pod.VMI
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339), r.Event, r.Resource, strings.Join(r.PCIAddresses, ","), pod, container, vmi, r.Error)
+	}
+	return tw.Flush()
+}
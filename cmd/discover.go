@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	flag "github.com/spf13/pflag"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sigs.k8s.io/yaml"
+
+	"kubevirt-nvidia-device-plugin/pkg/device_plugin"
+	"kubevirt-nvidia-device-plugin/pkg/devicesource"
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+)
+
+// runDiscover prints the devices the device plugin would advertise without serving them.
+// It fails if any of the devices is unhealthy.
+func runDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	output := fs.StringP("output", "o", "table", "Output format: table, json or yaml")
+	selectorsConfig := fs.String("selectors-config", "", "YAML file of the selectors choosing the discovered PCI functions, the NVIDIA GPUs and NVSwitches if empty")
+	hostDescription := fs.String("host-description", "", "YAML description of a simulated host whose devices are discovered instead of the host devices")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "table" && *output != "json" && *output != "yaml" {
+		return fmt.Errorf("unknown output format %q, expected table, json or yaml", *output)
+	}
+	selectors, err := loadSelectors(*selectorsConfig)
+	if err != nil {
+		return err
+	}
+
+	var source devicesource.Source = devicesource.NewSysfs(devicesource.DefaultSysfsPath, devicesource.DefaultPollInterval)
+	if *hostDescription != "" {
+		source = devicesource.NewStatic(*hostDescription, devicesource.DefaultPollInterval)
+	}
+	devices, err := device_plugin.DiscoverDevices(source, selectors)
+	if err != nil {
+		return err
+	}
+	if err := printDevices(os.Stdout, *output, devices); err != nil {
+		return err
+	}
+
+	unhealthy := 0
+	for _, device := range devices {
+		if device.Health != pluginapi.Healthy {
+			unhealthy++
+		}
+	}
+	if unhealthy > 0 {
+		return fmt.Errorf("%d of %d devices are unhealthy", unhealthy, len(devices))
+	}
+	return nil
+}
+
+func printDevices(w io.Writer, output string, devices []inventory.Device) error {
+	if devices == nil {
+		devices = []inventory.Device{}
+	}
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(devices)
+	case "yaml":
+		out, err := yaml.Marshal(devices)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PCI ADDRESS\tDEVICE ID\tKIND\tNAME\tRESOURCE\tIOMMU GROUP\tDRIVER\tNUMA NODE\tCOMPANIONS\tHEALTH\tREASON")
+	for _, d := range devices {
+		numaNode := "-"
+		if d.NUMANode >= 0 {
+			numaNode = strconv.Itoa(d.NUMANode)
+		}
+		driver := d.Driver
+		if driver == "" {
+			driver = "<none>"
+		}
+		companions := "-"
+		if len(d.Companions) > 0 {
+			companions = strings.Join(d.Companions, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.PCIAddress, d.DeviceID, d.Kind, d.Name, d.ResourceName, d.IOMMUGroup, driver, numaNode, companions, d.Health, d.LastError)
+	}
+	return tw.Flush()
+}
+
+// loadSelectors reads the selector configuration file, no selectors are returned if path is empty
+func loadSelectors(path string) ([]selector.Selector, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return selector.Load(path)
+}
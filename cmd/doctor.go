@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	flag "github.com/spf13/pflag"
+
+	"kubevirt-nvidia-device-plugin/pkg/doctor"
+)
+
+// runDoctor checks the host prerequisites of device passthrough and prints what to fix
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	hostRoot := fs.String("host-root", "/", "Directory the host filesystem is mounted at")
+	output := fs.StringP("output", "o", "text", "Output format: text or json")
+	selectorsConfig := fs.String("selectors-config", "", "YAML file of the selectors choosing the devices whose IOMMU groups are checked, the NVIDIA GPUs and NVSwitches if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format %q, expected text or json", *output)
+	}
+	selectors, err := loadSelectors(*selectorsConfig)
+	if err != nil {
+		return err
+	}
+
+	results := doctor.New(*hostRoot, selectors).Run()
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		printReport(os.Stdout, results)
+	}
+	if doctor.Failed(results) {
+		return errors.New("the host is not ready for passthrough")
+	}
+	return nil
+}
+
+func printReport(w io.Writer, results []doctor.Result) {
+	for _, r := range results {
+		fmt.Fprintf(w, "%-9s %s: %s\n", "["+r.Status+"]", r.Name, r.Message)
+		if r.Remedy != "" {
+			fmt.Fprintf(w, "%-9s fix: %s\n", "", r.Remedy)
+		}
+	}
+}
@@ -1,11 +1,183 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"kubevirt-nvidia-device-plugin/pkg/audit"
+	"kubevirt-nvidia-device-plugin/pkg/cdi"
 	"kubevirt-nvidia-device-plugin/pkg/device_plugin"
-	"log"
+	"kubevirt-nvidia-device-plugin/pkg/logging"
+	"kubevirt-nvidia-device-plugin/pkg/pcireset"
+	"kubevirt-nvidia-device-plugin/pkg/podresources"
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+	"kubevirt-nvidia-device-plugin/pkg/simulation"
+	"os"
+	"os/signal"
+	"syscall"
+
+	flag "github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	klog "k8s.io/klog/v2"
 )
 
+// subcommands run instead of the device plugin when named by the first argument
+var subcommands = map[string]func(args []string) error{
+	"allocate":               runAllocate,
+	"audit":                  runAudit,
+	"discover":               runDiscover,
+	"doctor":                 runDoctor,
+	"permitted-host-devices": runPermittedHostDevices,
+}
+
 func main() {
-	log.Printf("Statring device plugin")
-	device_plugin.InitiateDevicePlugin()
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	var config device_plugin.Config
+	var logOptions logging.Options
+	var kubeconfig string
+	var selectorsConfig string
+	var simulate string
+	flag.StringVar(&selectorsConfig, "selectors-config", "", "YAML file of the selectors choosing the advertised PCI functions and their resource names. The NVIDIA GPUs and NVSwitches are advertised in the nvidia.com namespace if empty")
+	flag.StringVar(&config.HostRoot, "host-root", "", "Directory the host /sys and /dev are mounted at, / if empty")
+	flag.StringVar(&simulate, "simulate", "", "YAML description of a simulated host whose devices are advertised instead of the host devices. Containers requesting them are scheduled but cannot start")
+	flag.BoolVar(&config.RequireDeviceNames, "require-device-names", false, "Exit if a discovered device is not in the pci.ids database instead of naming its resource after the device ID")
+	flag.StringVar(&config.Mode, "mode", device_plugin.ModeDevicePlugin, "How the devices are handed out to kubelet: device-plugin or dra")
+	flag.BoolVar(&config.CDI, "cdi", false, "Write a CDI spec file per resource and hand out the devices as CDI devices")
+	flag.StringVar(&config.CDIRoot, "cdi-root", cdi.DefaultRoot, "Directory the CDI spec files are written to")
+	flag.StringVar(&config.ResetMethod, "reset-method", "", "Reset the devices before a container starts: auto, flr, pm or bus. Disabled if empty")
+	flag.StringVar(&config.AuditLog, "audit-log", "", "File on the host the device allocations are recorded in as JSON lines, e.g. "+audit.DefaultPath+". Disabled if empty, not supported in dra mode")
+	flag.Int64Var(&config.AuditLogMaxSize, "audit-log-max-size", audit.DefaultMaxSize, "Size in bytes the audit log is rotated at")
+	flag.IntVar(&config.AuditLogMaxBackups, "audit-log-max-backups", audit.DefaultMaxBackups, "Number of rotated audit logs kept")
+	flag.StringVar(&config.AuditWebhook, "audit-webhook", "", "URL receiving every audit record as a JSON POST request. Disabled if empty")
+	flag.StringVar(&config.PodResourcesSocket, "pod-resources-socket", podresources.DefaultSocket, "Socket of the kubelet PodResources API used to track the device allocations. Disabled if empty")
+	flag.StringVar(&config.DebugAddress, "debug-address", "127.0.0.1:8081", "Local address serving the /debug/allocations endpoint mapping the allocated devices to their VMIs. Disabled if empty")
+	flag.StringVar(&config.HTTPAddress, "http-address", ":8080", "Address serving the /healthz and /readyz probes and the /metrics endpoint")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig file, the in-cluster configuration is used if empty")
+	flag.StringVar(&config.NodeName, "node-name", os.Getenv("NODE_NAME"), "Name of the node the plugin runs on")
+	flag.BoolVar(&config.NodeLabels, "node-labels", false, "Label the node with the discovered passthrough devices")
+	flag.BoolVar(&config.NodeLabelsDryRun, "node-labels-dry-run", false, "Log the node label changes instead of applying them")
+	flag.BoolVar(&config.NodeEvents, "node-events", false, "Record device health, driver and registration events on the node")
+	flag.BoolVar(&config.Inventory, "inventory", false, "Publish the NvidiaPassthroughNode device inventory of the node")
+	logOptions.AddFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := logOptions.Setup(); err != nil {
+		klog.ErrorS(err, "Invalid logging configuration")
+		os.Exit(1)
+	}
+	defer klog.Flush()
+
+	if config.Mode != device_plugin.ModeDevicePlugin && config.Mode != device_plugin.ModeDRA {
+		klog.ErrorS(nil, "Invalid mode", "mode", config.Mode)
+		klog.Flush()
+		os.Exit(1)
+	}
+
+	if selectorsConfig != "" {
+		selectors, err := selector.Load(selectorsConfig)
+		if err != nil {
+			klog.ErrorS(err, "Invalid selector configuration")
+			klog.Flush()
+			os.Exit(1)
+		}
+		config.Selectors = selectors
+	}
+
+	if simulate != "" {
+		root, err := simulateHost(simulate)
+		if err != nil {
+			klog.ErrorS(err, "Could not simulate host", "description", simulate)
+			klog.Flush()
+			os.Exit(1)
+		}
+		defer os.RemoveAll(root)
+		config.HostRoot = root
+	}
+
+	if config.AuditWebhook != "" && config.AuditLog == "" {
+		klog.ErrorS(nil, "The audit webhook requires the audit log")
+		klog.Flush()
+		os.Exit(1)
+	}
+
+	if config.ResetMethod != "" {
+		if _, err := pcireset.ParseMethod(config.ResetMethod); err != nil {
+			klog.ErrorS(err, "Invalid reset method")
+			klog.Flush()
+			os.Exit(1)
+		}
+	}
+
+	if config.NodeLabels || config.NodeEvents || config.Inventory || config.Mode == device_plugin.ModeDRA {
+		if err := setupClients(&config, kubeconfig); err != nil {
+			klog.ErrorS(err, "Failed to create Kubernetes client")
+			klog.Flush()
+			os.Exit(1)
+		}
+	}
+
+	// The owners of the pods holding devices are looked up when API access is available
+	if config.KubeClient == nil && config.PodResourcesSocket != "" {
+		if err := setupClients(&config, kubeconfig); err != nil {
+			klog.InfoS("No API access, the VMIs holding devices are guessed from the pod names", "err", err)
+		}
+	}
+
+	// Stop the device plugins when the pod is terminated
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	klog.InfoS("Starting device plugin")
+	if err := device_plugin.NewController(config).Run(ctx); err != nil {
+		klog.ErrorS(err, "Device plugin stopped with error")
+		cancel()
+		klog.Flush()
+		os.Exit(1)
+	}
+	klog.InfoS("Device plugin stopped")
+}
+
+// simulateHost materializes the devices of a host description in a temporary directory and returns it
+func simulateHost(description string) (string, error) {
+	host, err := simulation.Load(description)
+	if err != nil {
+		return "", err
+	}
+	root, err := os.MkdirTemp("", "passthrough-simulation-")
+	if err != nil {
+		return "", err
+	}
+	if err := host.Materialize(root); err != nil {
+		os.RemoveAll(root)
+		return "", err
+	}
+	klog.InfoS("Simulating host", "description", description, "devices", len(host.Devices), "root", root)
+	return root, nil
+}
+
+// setupClients creates the clients for the cluster of the kubeconfig file,
+// or for the cluster the pod runs in if no file is given
+func setupClients(config *device_plugin.Config, kubeconfig string) error {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return err
+	}
+	if config.KubeClient, err = kubernetes.NewForConfig(restConfig); err != nil {
+		return err
+	}
+	if config.DynamicClient, err = dynamic.NewForConfig(restConfig); err != nil {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	flag "github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/client-go/kubevirt"
+	"sigs.k8s.io/yaml"
+
+	"kubevirt-nvidia-device-plugin/pkg/device_plugin"
+	"kubevirt-nvidia-device-plugin/pkg/devicesource"
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+	"kubevirt-nvidia-device-plugin/pkg/kubevirtconfig"
+)
+
+// runPermittedHostDevices prints the permittedHostDevices stanza of the KubeVirt CR matching the
+// resources advertised by the device plugin, or adds it to the KubeVirt CR with --apply
+func runPermittedHostDevices(args []string) error {
+	fs := flag.NewFlagSet("permitted-host-devices", flag.ContinueOnError)
+	kubeconfig := fs.String("kubeconfig", "", "Path to a kubeconfig file, the in-cluster configuration is used if empty")
+	fromInventory := fs.Bool("from-inventory", false, "Read the devices from the NvidiaPassthroughNode inventories of all nodes instead of discovering the host devices")
+	apply := fs.Bool("apply", false, "Add the devices to the permitted host devices of the KubeVirt CR instead of printing them")
+	namespace := fs.String("namespace", "kubevirt", "Namespace of the KubeVirt CR")
+	name := fs.String("name", "", "Name of the KubeVirt CR, the only KubeVirt CR of the namespace is used if empty")
+	selectorsConfig := fs.String("selectors-config", "", "YAML file of the selectors choosing the discovered PCI functions, the NVIDIA GPUs and NVSwitches if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	var devices []inventory.Device
+	if *fromInventory {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+		if err != nil {
+			return err
+		}
+		client, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return err
+		}
+		nodes, err := inventory.List(ctx, client)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			devices = append(devices, node.Status.Devices...)
+		}
+	} else {
+		selectors, err := loadSelectors(*selectorsConfig)
+		if err != nil {
+			return err
+		}
+		source := devicesource.NewSysfs(devicesource.DefaultSysfsPath, devicesource.DefaultPollInterval)
+		if devices, err = device_plugin.DiscoverDevices(source, selectors); err != nil {
+			return err
+		}
+	}
+	hostDevices := kubevirtconfig.PCIHostDevices(devices)
+
+	if !*apply {
+		out, err := yaml.Marshal(map[string]*kubevirtv1.PermittedHostDevices{
+			"permittedHostDevices": {PciHostDevices: hostDevices},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		return err
+	}
+	client, err := kubevirt.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	changed, err := kubevirtconfig.Reconcile(ctx, client, *namespace, *name, hostDevices)
+	if err != nil {
+		return err
+	}
+	if changed {
+		fmt.Printf("Updated the permitted host devices with %d PCI host devices\n", len(hostDevices))
+	} else {
+		fmt.Println("The permitted host devices are up to date")
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// DefaultPath is the audit log file on the host
+	DefaultPath = "/var/log/kubevirt-nvidia-device-plugin/audit.log"
+	// DefaultMaxSize is the size in bytes the log file is rotated at
+	DefaultMaxSize = 100 << 20
+	// DefaultMaxBackups is the number of rotated files kept
+	DefaultMaxBackups = 5
+)
+
+const (
+	// EventAllocate records the devices kubelet allocated to a container
+	EventAllocate = "allocate"
+	// EventPreStart records the devices of a starting container, with its pod when kubelet reports it
+	EventPreStart = "prestart"
+	// EventDebugAllocate records an Allocate call of a debugging client such as the allocate command,
+	// the devices are not handed out to a container
+	EventDebugAllocate = "debug-allocate"
+)
+
+// Record is an audit record of the devices handed out to a container
+type Record struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Node     string    `json:"node,omitempty"`
+	Resource string    `json:"resource"`
+	// DeviceIDs are the device plugin IDs of the devices, <IOMMU group>|<PCI address>
+	DeviceIDs    []string `json:"deviceIDs"`
+	PCIAddresses []string `json:"pciAddresses"`
+	// Companions are the PCI addresses of the functions passed through with the devices
+	Companions []string `json:"companions,omitempty"`
+	// Env holds the environment variables returned to kubelet, e.g. the KubeVirt PCI_RESOURCE variable
+	Env map[string]string `json:"env,omitempty"`
+	// Pod is the container the devices are allocated to, nil if kubelet did not report it yet
+	Pod *Pod `json:"pod,omitempty"`
+	// Error is the reason the devices could not be handed out, empty on success
+	Error string `json:"error,omitempty"`
+}
+
+// Pod identifies the container a device is allocated to
+type Pod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	// VMI is the VirtualMachineInstance run by the pod, empty for other pods
+	VMI string `json:"vmi,omitempty"`
+}
+
+// Config holds the audit log options
+type Config struct {
+	// Path is the log file, JSON records are appended one per line
+	Path string
+	// MaxSize is the size in bytes the file is rotated at, DefaultMaxSize if 0
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept as Path.1 to Path.MaxBackups, DefaultMaxBackups if 0
+	MaxBackups int
+	// WebhookURL receives every record as a JSON POST request, disabled if empty
+	WebhookURL string
+	// Node is set as the node of the records
+	Node string
+}
+
+// Logger appends the audit records to a rotating file and sends them to the webhook.
+// A nil Logger records nothing.
+type Logger struct {
+	config  Config
+	mu      sync.Mutex // guards file, size and closed
+	file    *os.File
+	size    int64
+	closed  bool
+	webhook *webhook // records are queued while holding mu, so none is sent after close
+}
+
+// NewLogger opens the audit log file, creating its directory if needed
+func NewLogger(config Config) (*Logger, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultMaxSize
+	}
+	if config.MaxBackups <= 0 {
+		config.MaxBackups = DefaultMaxBackups
+	}
+	l := &Logger{config: config}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0755); err != nil {
+		return nil, fmt.Errorf("creating audit log directory: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	if config.WebhookURL != "" {
+		l.webhook = newWebhook(config.WebhookURL)
+	}
+	klog.InfoS("Recording device allocations", "path", config.Path, "maxSize", config.MaxSize, "maxBackups", config.MaxBackups, "webhook", config.WebhookURL != "")
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// Record appends the record to the log file and queues it for the webhook. The time and node are set.
+// Failures are logged, a device is never withheld because it could not be audited.
+func (l *Logger) Record(r Record) {
+	if l == nil {
+		return
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	r.Node = l.config.Node
+	data, err := json.Marshal(r)
+	if err != nil {
+		klog.ErrorS(err, "Could not encode audit record", "resource", r.Resource, "event", r.Event)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		klog.ErrorS(nil, "Audit log is closed, dropping record", "resource", r.Resource, "event", r.Event)
+		return
+	}
+	if err := l.write(append(data, '\n')); err != nil {
+		klog.ErrorS(err, "Could not write audit record", "path", l.config.Path, "resource", r.Resource, "event", r.Event)
+	}
+	l.webhook.send(data)
+}
+
+// write appends a line to the log file, rotating it first if the line does not fit
+func (l *Logger) write(line []byte) error {
+	if l.file == nil {
+		// a failed rotation left no open file
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.config.MaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotating audit log: %w", err)
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate renames the log file to Path.1, shifting the older files and removing the oldest
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		klog.ErrorS(err, "Could not close audit log", "path", l.config.Path)
+	}
+	l.file = nil
+	for i := l.config.MaxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(l.config.Path, i), backupPath(l.config.Path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(l.config.Path, backupPath(l.config.Path, 1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the log file and sends the queued records to the webhook
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	l.closed = true
+	var err error
+	if l.file != nil {
+		err = l.file.Close()
+		l.file = nil
+	}
+	l.mu.Unlock()
+	l.webhook.close()
+	return err
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Read returns the records of the log file at path and of its rotated files, oldest first
+func Read(path string) ([]Record, error) {
+	var paths []string
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backupPath(path, i)); err != nil {
+			break
+		}
+		paths = append([]string{backupPath(path, i)}, paths...)
+	}
+	paths = append(paths, path)
+
+	var records []Record
+	for _, p := range paths {
+		fileRecords, err := readFile(p)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, fileRecords...)
+	}
+	return records, nil
+}
+
+func readFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return records, nil
+}
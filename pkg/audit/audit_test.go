@@ -0,0 +1,166 @@
+package audit_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/audit"
+)
+
+var _ = Describe("Logger", func() {
+	var path string
+
+	record := func(pciAddress string) audit.Record {
+		return audit.Record{
+			Time:         time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC),
+			Event:        audit.EventPreStart,
+			Resource:     "nvidia.com/GH100_H100_SXM5_80GB",
+			DeviceIDs:    []string{"42|" + pciAddress},
+			PCIAddresses: []string{pciAddress},
+			Pod:          &audit.Pod{Namespace: "vms", Name: "virt-launcher-vm-0-abcde", Container: "compute", VMI: "vm-0"},
+		}
+	}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "audit", "audit.log")
+	})
+
+	It("appends the records as JSON lines", func() {
+		logger, err := audit.NewLogger(audit.Config{Path: path, Node: "worker-0"})
+		Expect(err).NotTo(HaveOccurred())
+		logger.Record(record("0000:1b:00.0"))
+		logger.Record(audit.Record{Event: audit.EventAllocate, Resource: "nvidia.com/GH100_H100_SXM5_80GB"})
+		Expect(logger.Close()).To(Succeed())
+
+		data, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(HavePrefix(`{"time":"2026-10-19T12:00:00Z","event":"prestart","node":"worker-0","resource":"nvidia.com/GH100_H100_SXM5_80GB","deviceIDs":["42|0000:1b:00.0"],"pciAddresses":["0000:1b:00.0"],"pod":{"namespace":"vms","name":"virt-launcher-vm-0-abcde","container":"compute","vmi":"vm-0"}}` + "\n"))
+
+		records, err := audit.Read(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+		Expect(records[1].Time).NotTo(BeZero())
+		Expect(records[1].Node).To(Equal("worker-0"))
+	})
+
+	It("appends to an existing log", func() {
+		for _, pciAddress := range []string{"0000:1b:00.0", "0000:9a:00.0"} {
+			logger, err := audit.NewLogger(audit.Config{Path: path})
+			Expect(err).NotTo(HaveOccurred())
+			logger.Record(record(pciAddress))
+			Expect(logger.Close()).To(Succeed())
+		}
+		records, err := audit.Read(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+	})
+
+	It("rotates the log and reads the rotated files oldest first", func() {
+		line, err := json.Marshal(record("0000:1b:00.0"))
+		Expect(err).NotTo(HaveOccurred())
+		// two records fit in a file
+		logger, err := audit.NewLogger(audit.Config{Path: path, MaxSize: int64(2*len(line) + 2), MaxBackups: 2})
+		Expect(err).NotTo(HaveOccurred())
+		addresses := []string{"0000:1b:00.0", "0000:1c:00.0", "0000:1d:00.0", "0000:1e:00.0", "0000:1f:00.0", "0000:20:00.0", "0000:21:00.0"}
+		for _, pciAddress := range addresses {
+			logger.Record(record(pciAddress))
+		}
+		Expect(logger.Close()).To(Succeed())
+
+		Expect(path + ".1").To(BeAnExistingFile())
+		Expect(path + ".2").To(BeAnExistingFile())
+		Expect(path + ".3").NotTo(BeAnExistingFile())
+		records, err := audit.Read(path)
+		Expect(err).NotTo(HaveOccurred())
+		var read []string
+		for _, r := range records {
+			read = append(read, r.PCIAddresses[0])
+		}
+		// the oldest file was removed
+		Expect(read).To(Equal(addresses[2:]))
+	})
+
+	It("drops the records after close", func() {
+		logger, err := audit.NewLogger(audit.Config{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logger.Close()).To(Succeed())
+		logger.Record(record("0000:1b:00.0"))
+		records, err := audit.Read(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(BeEmpty())
+	})
+
+	It("records nothing when disabled", func() {
+		var logger *audit.Logger
+		logger.Record(record("0000:1b:00.0"))
+		Expect(logger.Close()).To(Succeed())
+	})
+
+	It("sends the records to the webhook", func() {
+		var mu sync.Mutex
+		var received []audit.Record
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+			body, err := io.ReadAll(r.Body)
+			Expect(err).NotTo(HaveOccurred())
+			var rec audit.Record
+			Expect(json.Unmarshal(body, &rec)).To(Succeed())
+			mu.Lock()
+			received = append(received, rec)
+			mu.Unlock()
+		}))
+		defer server.Close()
+
+		logger, err := audit.NewLogger(audit.Config{Path: path, WebhookURL: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		logger.Record(record("0000:1b:00.0"))
+		logger.Record(record("0000:9a:00.0"))
+		// close waits for the queued records
+		Expect(logger.Close()).To(Succeed())
+
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(received).To(HaveLen(2))
+		Expect(received[1].PCIAddresses).To(Equal([]string{"0000:9a:00.0"}))
+	})
+
+	It("keeps the records in the file when the webhook fails", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		logger, err := audit.NewLogger(audit.Config{Path: path, WebhookURL: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		logger.Record(record("0000:1b:00.0"))
+		Expect(logger.Close()).To(Succeed())
+		records, err := audit.Read(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Read", func() {
+	It("fails on a malformed record", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "audit.log")
+		Expect(os.WriteFile(path, []byte("{\"event\":\"allocate\"}\nnot json\n"), 0644)).To(Succeed())
+		_, err := audit.Read(path)
+		Expect(err).To(MatchError(ContainSubstring("audit.log:2")))
+	})
+
+	It("fails if the log does not exist", func() {
+		_, err := audit.Read(filepath.Join(GinkgoT().TempDir(), "audit.log"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	webhookTimeout = 5 * time.Second
+	// webhookQueueSize records are queued while the webhook is slow, newer records are dropped
+	webhookQueueSize = 1000
+)
+
+// webhook posts the records to a URL in the background, in order. A nil webhook sends nothing.
+type webhook struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+}
+
+func newWebhook(url string) *webhook {
+	w := &webhook{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan []byte, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *webhook) send(record []byte) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.queue <- record:
+	default:
+		klog.ErrorS(nil, "Audit webhook queue is full, dropping record", "url", w.url)
+	}
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	for record := range w.queue {
+		if err := w.post(record); err != nil {
+			// the record is kept in the log file
+			klog.ErrorS(err, "Could not send audit record to webhook", "url", w.url)
+		}
+	}
+}
+
+func (w *webhook) post(record []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// close stops the webhook once the queued records are sent
+func (w *webhook) close() {
+	if w == nil {
+		return
+	}
+	close(w.queue)
+	<-w.done
+}
@@ -0,0 +1,26 @@
+package backoff
+
+import (
+	"math"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// InitialInterval is the delay before the first retry
+	InitialInterval = 1 * time.Second
+	// MaxInterval caps the delay between two retries
+	MaxInterval = 1 * time.Minute
+)
+
+// New returns an exponential backoff which never runs out of steps
+func New() *wait.Backoff {
+	return &wait.Backoff{
+		Duration: InitialInterval,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      MaxInterval,
+	}
+}
@@ -0,0 +1,20 @@
+package backoff_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/backoff"
+)
+
+var _ = Describe("New", func() {
+	It("doubles the delay up to the maximum, with jitter", func() {
+		b := backoff.New()
+		Expect(b.Step()).To(BeNumerically("~", backoff.InitialInterval, backoff.InitialInterval/10))
+		Expect(b.Step()).To(BeNumerically("~", 2*backoff.InitialInterval, backoff.InitialInterval/5))
+		for i := 0; i < 100; i++ {
+			b.Step()
+		}
+		Expect(b.Step()).To(BeNumerically("~", backoff.MaxInterval, backoff.MaxInterval/10))
+	})
+})
@@ -0,0 +1,124 @@
+package cdi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"unicode"
+)
+
+const (
+	// DefaultRoot is the directory the container runtimes read the CDI spec files from
+	DefaultRoot = "/var/run/cdi"
+	// Version is the CDI specification version of the generated spec files
+	Version = "0.6.0"
+
+	vfioDevicePath = "/dev/vfio"
+)
+
+// Spec is a Container Device Interface spec file describing the devices of one kind
+type Spec struct {
+	Version        string         `json:"cdiVersion"`
+	Kind           string         `json:"kind"`
+	Devices        []Device       `json:"devices"`
+	ContainerEdits ContainerEdits `json:"containerEdits,omitempty"`
+}
+
+// Device is a device of a CDI spec, referenced by containers as <kind>=<name>
+type Device struct {
+	Name           string         `json:"name"`
+	ContainerEdits ContainerEdits `json:"containerEdits"`
+}
+
+// ContainerEdits are the changes applied to a container the devices are injected into
+type ContainerEdits struct {
+	Env         []string      `json:"env,omitempty"`
+	DeviceNodes []*DeviceNode `json:"deviceNodes,omitempty"`
+}
+
+// DeviceNode is a device node created in the container
+type DeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// VFIODeviceNodes returns the device nodes needed to pass a device of the given IOMMU group
+// through: the VFIO container and the IOMMU group
+func VFIODeviceNodes(iommuGroup string) []*DeviceNode {
+	return []*DeviceNode{
+		{Path: filepath.Join(vfioDevicePath, "vfio"), Permissions: "rw"},
+		VFIOGroupDeviceNode(iommuGroup),
+	}
+}
+
+// VFIOGroupDeviceNode returns the device node of an IOMMU group, e.g. to pass the functions of
+// another group through with a device
+func VFIOGroupDeviceNode(iommuGroup string) *DeviceNode {
+	return &DeviceNode{Path: filepath.Join(vfioDevicePath, iommuGroup), Permissions: "rw"}
+}
+
+// invalidClassChar matches the characters a CDI class cannot contain
+var invalidClassChar = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Class returns a valid CDI class derived from a name, e.g. the name of a resource. Invalid
+// characters are replaced by underscores, and names which do not start with a letter, e.g. a
+// device ID used as resource name, are prefixed with "pci_".
+func Class(name string) string {
+	class := invalidClassChar.ReplaceAllString(name, "_")
+	if class == "" || !unicode.IsLetter(rune(class[0])) {
+		class = "pci_" + class
+	}
+	return class
+}
+
+// QualifiedName returns the fully qualified name referencing a device of the given kind
+func QualifiedName(kind string, device string) string {
+	return fmt.Sprintf("%s=%s", kind, device)
+}
+
+// WriteSpec writes the spec file with the given name to dir. The file is replaced
+// atomically, so the container runtime never reads a partially written spec.
+func WriteSpec(dir string, name string, spec *Spec) error {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding CDI spec %s: %w", name, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating CDI directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "."+name+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating CDI spec %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing CDI spec %s: %w", name, err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing CDI spec %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing CDI spec %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), specPath(dir, name)); err != nil {
+		return fmt.Errorf("writing CDI spec %s: %w", name, err)
+	}
+	return nil
+}
+
+// RemoveSpec removes the spec file with the given name from dir, if it exists
+func RemoveSpec(dir string, name string) error {
+	if err := os.Remove(specPath(dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing CDI spec %s: %w", name, err)
+	}
+	return nil
+}
+
+func specPath(dir string, name string) string {
+	return filepath.Join(dir, name+".json")
+}
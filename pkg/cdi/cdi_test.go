@@ -0,0 +1,76 @@
+package cdi_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/cdi"
+)
+
+var _ = Describe("CDI", func() {
+	var dir string
+
+	spec := &cdi.Spec{
+		Version: cdi.Version,
+		Kind:    "nvidia.com/GH100_H100_SXM5_80GB",
+		Devices: []cdi.Device{{
+			Name:           "0000:1b:00.0",
+			ContainerEdits: cdi.ContainerEdits{DeviceNodes: cdi.VFIODeviceNodes("42")},
+		}},
+	}
+
+	BeforeEach(func() {
+		dir = filepath.Join(GinkgoT().TempDir(), "cdi")
+	})
+
+	It("references devices by kind and name", func() {
+		Expect(cdi.QualifiedName(spec.Kind, "0000:1b:00.0")).To(Equal("nvidia.com/GH100_H100_SXM5_80GB=0000:1b:00.0"))
+	})
+
+	DescribeTable("derives valid classes from resource names",
+		func(name string, expected string) {
+			Expect(cdi.Class(name)).To(Equal(expected))
+		},
+		Entry("pci.ids name", "GH100_H100_SXM5_80GB", "GH100_H100_SXM5_80GB"),
+		Entry("device ID", "2335", "pci_2335"),
+		Entry("device ID starting with a letter", "a2dc", "a2dc"),
+		Entry("dots", "BlueField.3", "BlueField_3"),
+	)
+
+	It("passes the VFIO container and the IOMMU group through", func() {
+		Expect(cdi.VFIODeviceNodes("42")).To(Equal([]*cdi.DeviceNode{
+			{Path: "/dev/vfio/vfio", Permissions: "rw"},
+			{Path: "/dev/vfio/42", Permissions: "rw"},
+		}))
+	})
+
+	It("writes and replaces spec files", func() {
+		Expect(cdi.WriteSpec(dir, "nvidia.com-GH100_H100_SXM5_80GB", spec)).To(Succeed())
+		Expect(cdi.WriteSpec(dir, "nvidia.com-GH100_H100_SXM5_80GB", spec)).To(Succeed())
+
+		entries, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1), "temporary files are cleaned up")
+
+		data, err := os.ReadFile(filepath.Join(dir, "nvidia.com-GH100_H100_SXM5_80GB.json"))
+		Expect(err).ToNot(HaveOccurred())
+		var raw map[string]any
+		Expect(json.Unmarshal(data, &raw)).To(Succeed())
+		Expect(raw).To(HaveKeyWithValue("cdiVersion", cdi.Version))
+		Expect(raw).To(HaveKeyWithValue("kind", spec.Kind))
+		written := &cdi.Spec{}
+		Expect(json.Unmarshal(data, written)).To(Succeed())
+		Expect(written).To(Equal(spec))
+	})
+
+	It("removes spec files", func() {
+		Expect(cdi.WriteSpec(dir, "spec", spec)).To(Succeed())
+		Expect(cdi.RemoveSpec(dir, "spec")).To(Succeed())
+		Expect(filepath.Join(dir, "spec.json")).ToNot(BeAnExistingFile())
+		Expect(cdi.RemoveSpec(dir, "spec")).To(Succeed(), "removing a missing spec is not an error")
+	})
+})
@@ -0,0 +1,33 @@
+package device_plugin
+
+import (
+	"context"
+	"time"
+
+	klog "k8s.io/klog/v2"
+
+	"kubevirt-nvidia-device-plugin/pkg/backoff"
+)
+
+// retryWithBackoff calls fn until it succeeds, waiting exponentially longer between the attempts.
+// It gives up and returns the last error once ctx is cancelled or stop is closed.
+// The key/value pairs are added to the log entry of every failed attempt.
+func retryWithBackoff(ctx context.Context, stop <-chan struct{}, operation string, fn func() error, keysAndValues ...any) error {
+	b := backoff.New()
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		delay := b.Step()
+		klog.ErrorS(err, "Operation failed, retrying", append([]any{"operation", operation, "retryIn", delay.Round(time.Millisecond)}, keysAndValues...)...)
+
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return err
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
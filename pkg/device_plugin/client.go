@@ -0,0 +1,47 @@
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// debugCallKey is the gRPC metadata key marking the calls of debugging clients, whose Allocate
+// calls are audited apart from the allocations of kubelet
+const debugCallKey = "kubevirt-nvidia-device-plugin-debug"
+
+// DialDevicePlugin connects to the device plugin serving the given socket, the same way kubelet does.
+// The calls are marked as calls of a debugging client. The returned closer closes the connection.
+func DialDevicePlugin(socketPath string, timeout time.Duration) (pluginapi.DevicePluginClient, io.Closer, error) {
+	conn, err := connect(socketPath, timeout, grpc.WithUnaryInterceptor(markDebugCall))
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to %s: %w", socketPath, err)
+	}
+	return pluginapi.NewDevicePluginClient(conn), conn, nil
+}
+
+func markDebugCall(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(metadata.AppendToOutgoingContext(ctx, debugCallKey, "true"), method, req, reply, cc, opts...)
+}
+
+// isDebugCall returns whether the call was made by a client dialed by DialDevicePlugin
+func isDebugCall(ctx context.Context) bool {
+	return slices.Contains(metadata.ValueFromIncomingContext(ctx, debugCallKey), "true")
+}
+
+// ResourceSocketPath returns the socket the device plugin of a resource name serves,
+// e.g. nvidia.com/GH100_H100_SXM5_80GB
+func ResourceSocketPath(resourceName string) (string, error) {
+	namespace, deviceName, ok := strings.Cut(resourceName, "/")
+	if !ok || namespace == "" || deviceName == "" {
+		return "", fmt.Errorf("resource name %q is not of the form <namespace>/<name>", resourceName)
+	}
+	return SocketPath(namespace, deviceName), nil
+}
@@ -0,0 +1,617 @@
+package device_plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"kubevirt-nvidia-device-plugin/pkg/audit"
+	"kubevirt-nvidia-device-plugin/pkg/devicesource"
+	"kubevirt-nvidia-device-plugin/pkg/dra"
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+	"kubevirt-nvidia-device-plugin/pkg/nodelabels"
+	"kubevirt-nvidia-device-plugin/pkg/pcireset"
+	"kubevirt-nvidia-device-plugin/pkg/podresources"
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+)
+
+// Controller discovers the host devices and owns the device plugin serving each device type
+type Controller struct {
+	config       Config
+	health       *healthServer
+	plugins      []*devicePlugin // one per device type, in start order
+	wg           sync.WaitGroup
+	cancelLabels context.CancelFunc // stops publishing the node labels of the previous devices
+	events       *nodeEvents
+	inventory    *inventory.Inventory
+	driver       *dra.Driver // set in DRA mode instead of the supervisors
+	allocations  *podresources.Tracker
+	podResConn   io.Closer
+	debug        *debugServer
+	audit        *audit.Logger
+}
+
+// devicePlugin is the device plugin of a device type, run by its supervisor
+type devicePlugin struct {
+	deviceType *deviceType
+	supervisor *supervisor
+	cancel     context.CancelFunc // stops the supervisor
+	done       chan struct{}      // closed once the supervisor returned
+}
+
+// NewController returns a controller for the given configuration
+func NewController(config Config) *Controller {
+	return &Controller{
+		config: config,
+		health: newHealthServer(config.HTTPAddress),
+	}
+}
+
+// selectors returns the configured selectors, or the default NVIDIA selector if none are configured
+func (c *Controller) selectors() []selector.Selector {
+	if len(c.config.Selectors) == 0 {
+		return selector.Default()
+	}
+	return c.config.Selectors
+}
+
+// sysfsDevicesPath returns the sysfs directory of the PCI devices of the host
+func (c *Controller) sysfsDevicesPath() string {
+	if c.config.HostRoot == "" {
+		return devicesource.DefaultSysfsPath
+	}
+	return filepath.Join(c.config.HostRoot, sysfsDevicesDir)
+}
+
+// source returns the configured device source, or the sysfs source of the host
+func (c *Controller) source() devicesource.Source {
+	if c.config.Source != nil {
+		return c.config.Source
+	}
+	return devicesource.NewSysfs(c.sysfsDevicesPath(), devicesource.DefaultPollInterval)
+}
+
+// vfioDevicesPath returns the directory of the VFIO group devices of the host
+func (c *Controller) vfioDevicesPath() string {
+	if c.config.HostRoot == "" {
+		return vfioDevicePath
+	}
+	return filepath.Join(c.config.HostRoot, vfioDevicesDir)
+}
+
+// Run discovers the host devices and starts a device plugin for each device type.
+// It blocks until ctx is cancelled, then stops the plugins in reverse start order
+// and removes their sockets. The returned error reports a failed shutdown.
+func (c *Controller) Run(ctx context.Context) error {
+	c.health.start()
+	c.startNodeEvents()
+
+	//Discover the host PCI devices matched by the selectors
+	source := c.source()
+	functions, err := source.List()
+	if err != nil {
+		c.shutdown()
+		return fmt.Errorf("listing PCI devices: %w", err)
+	}
+	deviceTypes, err := resolveDeviceTypes(selectDevices(functions, c.selectors()), c.config.RequireDeviceNames)
+	if err != nil {
+		c.shutdown()
+		return fmt.Errorf("discovering devices: %w", err)
+	}
+	c.reportDrivers(deviceTypes)
+	c.publishNodeLabels(ctx, deviceTypes)
+	c.publishInventory(ctx, deviceTypes)
+	if c.config.Mode == ModeDRA {
+		if err := c.startDRADriver(ctx, deviceTypes); err != nil {
+			c.shutdown()
+			return err
+		}
+	} else {
+		if err := c.openAuditLog(); err != nil {
+			c.shutdown()
+			return err
+		}
+		c.trackAllocations(ctx, deviceTypes)
+		//Create and start device plugin for each device type
+		c.createDevicePlugins(ctx, deviceTypes)
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.watchDevices(ctx, source, deviceTypes)
+	}()
+
+	<-ctx.Done()
+	klog.InfoS("Shutting down device plugin controller")
+	return c.shutdown()
+}
+
+func (c *Controller) createDevicePlugins(ctx context.Context, deviceTypes []*deviceType) {
+	//Iterate over device types to create device plugin for each type
+	for _, dt := range deviceTypes {
+		c.plugins = append(c.plugins, c.startDevicePlugin(ctx, dt))
+	}
+	c.health.setSupervisors(c.supervisors())
+}
+
+// startDevicePlugin creates the device plugin of a device type and runs it under a supervisor
+// until ctx is cancelled or the plugin is stopped
+func (c *Controller) startDevicePlugin(ctx context.Context, dt *deviceType) *devicePlugin {
+	var devs []*pluginapi.Device
+	idToPCIMap := make(map[string]string)
+	companions := make(map[string][]string)
+	for _, device := range dt.devices {
+		deviceID := formatDeviceID(device.PCIDevice)
+		idToPCIMap[deviceID] = device.PCIAddress
+		for _, companion := range device.companions {
+			companions[deviceID] = append(companions[deviceID], formatDeviceID(companion))
+		}
+		devs = append(devs, &pluginapi.Device{
+			ID:     deviceID,
+			Health: device.health,
+		})
+	}
+	dp := NewGenericDevicePlugin(dt.namespace, dt.deviceName, c.vfioDevicesPath(), devs, idToPCIMap)
+	if c.config.DevicePluginDir != "" {
+		dp.setPluginDir(c.config.DevicePluginDir)
+	}
+	dp.companions = companions
+	dp.events = c.events
+	dp.inventory = c.inventory
+	if c.config.CDI {
+		dp.cdiRoot = c.config.CDIRoot
+	}
+	dp.allocations = c.allocations
+	dp.audit = c.audit
+	if c.config.ResetMethod != "" {
+		dp.resetter = pcireset.New(c.sysfsDevicesPath(), pcireset.Method(c.config.ResetMethod))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	p := &devicePlugin{
+		deviceType: dt,
+		supervisor: newSupervisor(dp),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(p.done)
+		p.supervisor.run(ctx)
+	}()
+	return p
+}
+
+// stopDevicePlugin stops the supervisor of a plugin, then the plugin itself
+func (c *Controller) stopDevicePlugin(p *devicePlugin) {
+	p.cancel()
+	<-p.done
+	dp := p.supervisor.dp
+	klog.InfoS("Stopping device plugin", "resource", dp.resourceName())
+	if err := dp.Stop(); err != nil {
+		klog.ErrorS(err, "Error stopping device plugin", "resource", dp.resourceName())
+	}
+}
+
+// supervisors returns the supervisors of the plugins, in start order
+func (c *Controller) supervisors() []*supervisor {
+	supervisors := make([]*supervisor, 0, len(c.plugins))
+	for _, p := range c.plugins {
+		supervisors = append(supervisors, p.supervisor)
+	}
+	return supervisors
+}
+
+// watchDevices advertises the selected PCI functions added to the host and withdraws the removed
+// ones. In DRA mode the published devices are fixed, the changes are only logged. Health changes
+// of the advertised functions are tracked by the device plugins.
+func (c *Controller) watchDevices(ctx context.Context, source devicesource.Source, deviceTypes []*deviceType) {
+	for functions := range source.Watch(ctx) {
+		changed, err := resolveDeviceTypes(selectDevices(functions, c.selectors()), c.config.RequireDeviceNames)
+		if err != nil {
+			klog.ErrorS(err, "Could not discover the changed devices, keeping the advertised devices")
+			continue
+		}
+		logDeviceChanges(deviceTypes, changed)
+		deviceTypes = changed
+		if c.config.Mode == ModeDRA {
+			klog.InfoS("The devices published by the DRA driver changed, restart the device plugin to publish them")
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		c.reportDrivers(deviceTypes)
+		c.publishNodeLabels(ctx, deviceTypes)
+		c.inventory.SetDevices(inventoryDevices(deviceTypes))
+		c.allocations.SetDevices(trackedDevices(deviceTypes))
+		c.updateDevicePlugins(ctx, deviceTypes)
+	}
+}
+
+// logDeviceChanges logs the selected PCI functions added to or removed from the host
+func logDeviceChanges(previous []*deviceType, current []*deviceType) {
+	devices := func(deviceTypes []*deviceType) map[string]*PCIDevice {
+		m := map[string]*PCIDevice{}
+		for _, dt := range deviceTypes {
+			for _, device := range dt.devices {
+				m[device.PCIAddress] = device
+			}
+		}
+		return m
+	}
+	before, after := devices(previous), devices(current)
+	for pciAddress, device := range after {
+		if before[pciAddress] == nil {
+			klog.InfoS("PCI device added", "pciAddress", pciAddress, "vendorID", device.VendorID, "deviceID", device.DeviceID)
+		}
+	}
+	for pciAddress := range before {
+		if after[pciAddress] == nil {
+			klog.InfoS("PCI device removed", "pciAddress", pciAddress)
+		}
+	}
+}
+
+// updateDevicePlugins restarts the plugins whose devices changed, so kubelet receives the new
+// device list when they re-register, starts the plugins of new device types and stops the
+// plugins of the device types which are gone
+func (c *Controller) updateDevicePlugins(ctx context.Context, deviceTypes []*deviceType) {
+	running := map[string]*devicePlugin{}
+	for _, p := range c.plugins {
+		running[p.deviceType.resourceName()] = p
+	}
+
+	var plugins []*devicePlugin
+	for _, dt := range deviceTypes {
+		p, ok := running[dt.resourceName()]
+		delete(running, dt.resourceName())
+		if ok && slices.Equal(pluginDevices(p.deviceType), pluginDevices(dt)) {
+			p.deviceType = dt
+			plugins = append(plugins, p)
+			continue
+		}
+		if ok {
+			klog.InfoS("Devices of the resource changed, restarting its device plugin", "resource", dt.resourceName(), "devices", len(dt.devices))
+			c.stopDevicePlugin(p)
+		} else {
+			klog.InfoS("Devices of a new resource discovered, starting its device plugin", "resource", dt.resourceName(), "devices", len(dt.devices))
+		}
+		plugins = append(plugins, c.startDevicePlugin(ctx, dt))
+	}
+	for resourceName, p := range running {
+		klog.InfoS("All devices of the resource were removed, withdrawing it", "resource", resourceName)
+		c.stopDevicePlugin(p)
+	}
+
+	c.plugins = plugins
+	c.health.setSupervisors(c.supervisors())
+}
+
+// pluginDevices describes the devices a plugin advertises: their IDs, health and companions
+func pluginDevices(dt *deviceType) []string {
+	var devices []string
+	for _, device := range dt.devices {
+		description := formatDeviceID(device.PCIDevice) + " " + device.health
+		for _, companion := range device.companions {
+			description += " " + formatDeviceID(companion)
+		}
+		devices = append(devices, description)
+	}
+	return devices
+}
+
+// startDRADriver starts the DRA kubelet plugin handing out the devices bound to vfio-pci
+// and publishes them as a resource slice in the background
+func (c *Controller) startDRADriver(ctx context.Context, deviceTypes []*deviceType) error {
+	if c.config.KubeClient == nil || c.config.NodeName == "" {
+		return errors.New("DRA mode requires API access and the node name")
+	}
+
+	c.driver = dra.NewDriver(c.config.KubeClient, dra.Config{
+		NodeName:     c.config.NodeName,
+		PluginDir:    dra.DefaultPluginDir,
+		RegistrarDir: dra.DefaultRegistrarDir,
+		CDIRoot:      c.config.CDIRoot,
+	}, draDevices(deviceTypes))
+	if err := c.driver.Start(); err != nil {
+		return fmt.Errorf("starting DRA driver: %w", err)
+	}
+	c.health.setDriver(c.driver)
+
+	go retryWithBackoff(ctx, nil, "publish resource slice", func() error {
+		return c.driver.PublishResources(ctx)
+	}, "node", c.config.NodeName)
+	return nil
+}
+
+// draDevices returns the devices which can be passed through, unhealthy devices are not published
+func draDevices(deviceTypes []*deviceType) []dra.Device {
+	var devices []dra.Device
+	for _, dt := range deviceTypes {
+		for _, device := range dt.devices {
+			if device.health != pluginapi.Healthy {
+				continue
+			}
+			d := dra.Device{
+				Name:             dra.DeviceName(device.PCIAddress),
+				PCIAddress:       device.PCIAddress,
+				DeviceID:         device.DeviceID,
+				Model:            dt.deviceName,
+				IOMMUGroup:       device.IOMMUGroup,
+				NUMANode:         device.NUMANode,
+				PCIeRoot:         device.PCIeRoot,
+				EnvVar:           resourceEnvVar(dt.resourceName()),
+				CompanionsEnvVar: companionsEnvVar(dt.resourceName()),
+			}
+			for _, companion := range device.companions {
+				d.Companions = append(d.Companions, dra.Companion{PCIAddress: companion.PCIAddress, IOMMUGroup: companion.IOMMUGroup})
+			}
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// openAuditLog opens the audit log the device plugins record the allocations in, if enabled
+func (c *Controller) openAuditLog() error {
+	if c.config.AuditLog == "" {
+		return nil
+	}
+	logger, err := audit.NewLogger(audit.Config{
+		Path:       c.config.AuditLog,
+		MaxSize:    c.config.AuditLogMaxSize,
+		MaxBackups: c.config.AuditLogMaxBackups,
+		WebhookURL: c.config.AuditWebhook,
+		Node:       c.config.NodeName,
+	})
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	c.audit = logger
+	return nil
+}
+
+// trackAllocations keeps track of the devices kubelet allocated to containers in the background
+func (c *Controller) trackAllocations(ctx context.Context, deviceTypes []*deviceType) {
+	if c.config.PodResourcesSocket == "" {
+		return
+	}
+	client, conn, err := podresources.Connect(c.config.PodResourcesSocket)
+	if err != nil {
+		klog.ErrorS(err, "Device allocations are not tracked")
+		return
+	}
+	c.podResConn = conn
+
+	c.allocations = podresources.NewTracker(client, trackedDevices(deviceTypes))
+	if c.config.KubeClient != nil {
+		c.allocations.SetPodClient(c.config.KubeClient)
+	}
+	c.allocations.OnChange(func(pciAddress string, allocation *podresources.Allocation) {
+		if allocation == nil {
+			c.inventory.SetAllocation(pciAddress, nil)
+			return
+		}
+		c.inventory.SetAllocation(pciAddress, &inventory.Allocation{
+			Namespace: allocation.Namespace,
+			Pod:       allocation.Pod,
+			Container: allocation.Container,
+			VMI:       allocation.VMI,
+		})
+	})
+	go c.allocations.Run(ctx, podresources.DefaultRefreshInterval)
+
+	if c.config.DebugAddress != "" {
+		c.debug = newDebugServer(c.config.DebugAddress, c.allocations)
+		c.debug.start()
+	}
+}
+
+// trackedDevices maps the device IDs of the devices to their PCI addresses
+func trackedDevices(deviceTypes []*deviceType) map[string]string {
+	devices := map[string]string{}
+	for _, dt := range deviceTypes {
+		for _, device := range dt.devices {
+			devices[formatDeviceID(device.PCIDevice)] = device.PCIAddress
+		}
+	}
+	return devices
+}
+
+// startNodeEvents enables recording device events on the node
+func (c *Controller) startNodeEvents() {
+	if !c.config.NodeEvents {
+		return
+	}
+	if c.config.KubeClient == nil || c.config.NodeName == "" {
+		klog.ErrorS(nil, "Node events require API access and the node name, skipping")
+		return
+	}
+	c.events = newNodeEvents(c.config.KubeClient, c.config.NodeName)
+}
+
+// reportDrivers records an event for every discovered device which is not bound to vfio-pci
+func (c *Controller) reportDrivers(deviceTypes []*deviceType) {
+	for _, dt := range deviceTypes {
+		for _, device := range dt.devices {
+			if device.Driver != vfioDriver {
+				c.events.driverNotVFIO(dt.resourceName(), device.PCIAddress, device.Driver)
+			}
+		}
+	}
+}
+
+// publishNodeLabels labels the node with the discovered device types in the background,
+// retrying until the labels are applied
+func (c *Controller) publishNodeLabels(ctx context.Context, deviceTypes []*deviceType) {
+	if !c.config.NodeLabels {
+		return
+	}
+	if c.config.KubeClient == nil || c.config.NodeName == "" {
+		klog.ErrorS(nil, "Node labels require API access and the node name, skipping")
+		return
+	}
+
+	labeler := nodelabels.NewLabeler(c.config.KubeClient, c.config.NodeName, c.config.NodeLabelsDryRun)
+	resources := nodeLabelResources(deviceTypes)
+	// the labels of the previous devices must not be applied after these
+	if c.cancelLabels != nil {
+		c.cancelLabels()
+	}
+	ctx, c.cancelLabels = context.WithCancel(ctx)
+	go retryWithBackoff(ctx, nil, "update node labels", func() error {
+		return labeler.Update(ctx, resources)
+	}, "node", c.config.NodeName)
+}
+
+func nodeLabelResources(deviceTypes []*deviceType) []nodelabels.Resource {
+	resources := make([]nodelabels.Resource, 0, len(deviceTypes))
+	for _, dt := range deviceTypes {
+		r := nodelabels.Resource{
+			Namespace: dt.namespace,
+			Name:      dt.deviceName,
+			DeviceID:  dt.deviceID,
+			Count:     len(dt.devices),
+		}
+		numaNodes := map[int]bool{}
+		for _, device := range dt.devices {
+			if device.Driver == vfioDriver {
+				r.VFIOCount++
+			}
+			if device.NUMANode >= 0 && !numaNodes[device.NUMANode] {
+				numaNodes[device.NUMANode] = true
+				r.NUMANodes = append(r.NUMANodes, device.NUMANode)
+			}
+		}
+		sort.Ints(r.NUMANodes)
+		resources = append(resources, r)
+	}
+	return resources
+}
+
+// publishInventory keeps the NvidiaPassthroughNode of the node up to date in the background
+func (c *Controller) publishInventory(ctx context.Context, deviceTypes []*deviceType) {
+	if !c.config.Inventory {
+		return
+	}
+	if c.config.DynamicClient == nil || c.config.NodeName == "" {
+		klog.ErrorS(nil, "Device inventory requires API access and the node name, skipping")
+		return
+	}
+
+	c.inventory = inventory.New(c.config.DynamicClient, c.config.NodeName)
+	if c.config.KubeClient != nil {
+		node, err := c.config.KubeClient.CoreV1().Nodes().Get(ctx, c.config.NodeName, metav1.GetOptions{})
+		if err != nil {
+			klog.ErrorS(err, "Could not get node, the device inventory is not owned by the node", "node", c.config.NodeName)
+		} else {
+			c.inventory.SetNodeOwner(node.UID)
+		}
+	}
+	c.inventory.SetDevices(inventoryDevices(deviceTypes))
+	go c.inventory.Run(ctx)
+}
+
+// DiscoverDevices returns the PCI functions of the source matched by the selectors, described as
+// in the device inventory. selector.Default() is used if no selector is given.
+func DiscoverDevices(source devicesource.Source, selectors []selector.Selector) ([]inventory.Device, error) {
+	if len(selectors) == 0 {
+		selectors = selector.Default()
+	}
+	functions, err := source.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing PCI devices: %w", err)
+	}
+	// devices missing from pci.ids are listed under their device ID
+	deviceTypes, err := resolveDeviceTypes(selectDevices(functions, selectors), false)
+	if err != nil {
+		return nil, err
+	}
+	return inventoryDevices(deviceTypes), nil
+}
+
+func inventoryDevices(deviceTypes []*deviceType) []inventory.Device {
+	var devices []inventory.Device
+	for _, dt := range deviceTypes {
+		for _, device := range dt.devices {
+			d := inventory.Device{
+				PCIAddress:   device.PCIAddress,
+				VendorID:     device.VendorID,
+				DeviceID:     device.DeviceID,
+				Class:        device.Class,
+				Kind:         string(device.Kind()),
+				Name:         dt.deviceName,
+				ResourceName: dt.resourceName(),
+				IOMMUGroup:   device.IOMMUGroup,
+				NUMANode:     device.NUMANode,
+				Driver:       device.Driver,
+				Health:       device.health,
+			}
+			d.Vendor, d.Subsystem = lookupNames(device)
+			for _, companion := range device.companions {
+				d.Companions = append(d.Companions, companion.PCIAddress)
+				if companion.Driver != vfioDriver {
+					d.LastError = fmt.Sprintf("companion %s is bound to %q instead of %s", companion.PCIAddress, companion.Driver, vfioDriver)
+				}
+			}
+			if device.Driver != vfioDriver {
+				d.LastError = fmt.Sprintf("device is bound to %q instead of %s", device.Driver, vfioDriver)
+			}
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// shutdown stops the plugins in reverse start order and the probe server
+func (c *Controller) shutdown() error {
+	// Wait for the supervisors so no plugin is restarted while stopping
+	c.wg.Wait()
+
+	var errs []error
+	for i := len(c.plugins) - 1; i >= 0; i-- {
+		dp := c.plugins[i].supervisor.dp
+		klog.InfoS("Stopping device plugin", "resource", dp.resourceName())
+		if err := dp.Stop(); err != nil {
+			errs = append(errs, fmt.Errorf("stopping %s device plugin: %w", dp.deviceName, err))
+		}
+	}
+
+	if c.driver != nil {
+		klog.InfoS("Stopping DRA driver", "driver", dra.DriverName)
+		if err := c.driver.Stop(); err != nil {
+			errs = append(errs, fmt.Errorf("stopping DRA driver: %w", err))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := c.health.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("stopping health probe server: %w", err))
+	}
+	if c.debug != nil {
+		if err := c.debug.stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping debug server: %w", err))
+		}
+	}
+	// the plugins are stopped, no allocation is recorded anymore
+	if err := c.audit.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing audit log: %w", err))
+	}
+	c.events.shutdown()
+	if c.podResConn != nil {
+		c.podResConn.Close()
+	}
+	return errors.Join(errs...)
+}
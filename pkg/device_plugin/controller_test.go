@@ -0,0 +1,223 @@
+package device_plugin_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"kubevirt-nvidia-device-plugin/pkg/device_plugin"
+	"kubevirt-nvidia-device-plugin/pkg/devicesource"
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+)
+
+// gpu returns a GPU function bound to vfio-pci
+func gpu(pciAddress string, deviceID string, iommuGroup string) devicesource.PCIDevice {
+	return devicesource.PCIDevice{
+		PCIAddress: pciAddress,
+		VendorID:   "10de",
+		DeviceID:   deviceID,
+		Class:      "030000",
+		IOMMUGroup: iommuGroup,
+		Driver:     "vfio-pci",
+		NUMANode:   -1,
+	}
+}
+
+// audio returns the HDMI audio function of the GPU at pciAddress
+func audio(pciAddress string, driver string) devicesource.PCIDevice {
+	return devicesource.PCIDevice{
+		PCIAddress: pciAddress,
+		VendorID:   "10de",
+		DeviceID:   "1aef",
+		Class:      "040300",
+		IOMMUGroup: "42",
+		Driver:     driver,
+		NUMANode:   -1,
+	}
+}
+
+func resourceNames(devices []inventory.Device) map[string]string {
+	names := map[string]string{}
+	for _, d := range devices {
+		names[d.PCIAddress] = d.ResourceName
+	}
+	return names
+}
+
+// advertisedDevices returns the IDs of the devices the plugin serving socketPath sends on a new
+// ListAndWatch stream
+func advertisedDevices(socketPath string) ([]string, error) {
+	client, conn, err := device_plugin.DialDevicePlugin(socketPath, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	response, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, device := range response.Devices {
+		ids = append(ids, device.ID)
+	}
+	return ids, nil
+}
+
+var _ = Describe("DiscoverDevices", func() {
+	It("skips the devices which are not in an IOMMU group", func() {
+		devices, err := device_plugin.DiscoverDevices(devicesource.NewMemory(gpu("0000:1b:00.0", "2330", "42"), gpu("0000:9a:00.0", "2330", "")), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resourceNames(devices)).To(Equal(map[string]string{
+			"0000:1b:00.0": "nvidia.com/GH100_H100_SXM5_80GB",
+		}))
+	})
+
+	It("reports the devices which are not bound to vfio-pci unhealthy", func() {
+		nouveau := gpu("0000:9a:00.0", "2330", "84")
+		nouveau.Driver = "nouveau"
+		devices, err := device_plugin.DiscoverDevices(devicesource.NewMemory(gpu("0000:1b:00.0", "2330", "42"), nouveau), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices).To(HaveLen(2))
+		Expect(devices[0].Health).To(Equal(pluginapi.Healthy))
+		Expect(devices[1].Health).To(Equal(pluginapi.Unhealthy))
+		Expect(devices[1].LastError).To(ContainSubstring("nouveau"))
+	})
+
+	It("attaches the other functions of the slot when the selector asks for it", func() {
+		selectors := selector.Default()
+		selectors[0].AttachCompanions = true
+		source := devicesource.NewMemory(gpu("0000:1b:00.0", "2330", "42"), audio("0000:1b:00.1", "vfio-pci"))
+
+		devices, err := device_plugin.DiscoverDevices(source, selectors)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices).To(HaveLen(1))
+		Expect(devices[0].Companions).To(Equal([]string{"0000:1b:00.1"}))
+		Expect(devices[0].Health).To(Equal(pluginapi.Healthy))
+
+		source.Set(gpu("0000:1b:00.0", "2330", "42"), audio("0000:1b:00.1", "snd_hda_intel"))
+		devices, err = device_plugin.DiscoverDevices(source, selectors)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices[0].Health).To(Equal(pluginapi.Unhealthy))
+
+		devices, err = device_plugin.DiscoverDevices(source, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices).To(HaveLen(1))
+		Expect(devices[0].Companions).To(BeEmpty())
+	})
+
+	It("names a device missing from pci.ids after its device ID", func() {
+		devices, err := device_plugin.DiscoverDevices(devicesource.NewMemory(gpu("0000:1b:00.0", "2fff", "42")), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resourceNames(devices)).To(Equal(map[string]string{
+			"0000:1b:00.0": "nvidia.com/2fff",
+		}))
+	})
+
+	It("suffixes a pci.ids name only when another device ID of the node shares it", func() {
+		// 10de:0044 and 10de:0048 are both named "NV40 [GeForce 6800 XT]"
+		devices, err := device_plugin.DiscoverDevices(devicesource.NewMemory(gpu("0000:1b:00.0", "0048", "42")), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resourceNames(devices)).To(Equal(map[string]string{
+			"0000:1b:00.0": "nvidia.com/NV40_GeForce_6800_XT",
+		}))
+
+		// 10de:20f1 "GA100 [A100 PCIe 40GB]" shares its name with 20b1
+		devices, err = device_plugin.DiscoverDevices(devicesource.NewMemory(gpu("0000:1b:00.0", "20f1", "42")), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resourceNames(devices)).To(Equal(map[string]string{
+			"0000:1b:00.0": "nvidia.com/GA100_A100_PCIe_40GB",
+		}))
+
+		devices, err = device_plugin.DiscoverDevices(devicesource.NewMemory(gpu("0000:1b:00.0", "0048", "42"), gpu("0000:9a:00.0", "0044", "84")), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resourceNames(devices)).To(Equal(map[string]string{
+			"0000:1b:00.0": "nvidia.com/NV40_GeForce_6800_XT_0048",
+			"0000:9a:00.0": "nvidia.com/NV40_GeForce_6800_XT",
+		}))
+	})
+})
+
+var _ = Describe("Controller", func() {
+	const (
+		h100Resource = "nvidia.com/GH100_H100_SXM5_80GB"
+		a100Resource = "nvidia.com/GA100_A100_SXM4_40GB"
+	)
+
+	var (
+		dir     string
+		kubelet *fakeKubelet
+		source  *devicesource.Memory
+	)
+
+	socketPath := func(deviceName string) string {
+		return filepath.Join(dir, filepath.Base(device_plugin.SocketPath("nvidia.com", deviceName)))
+	}
+
+	BeforeEach(func() {
+		dir = shortTempDir()
+		kubelet = startFakeKubelet(dir)
+		DeferCleanup(kubelet.stop)
+
+		hostRoot := filepath.Join(dir, "host")
+		vfioDir := filepath.Join(hostRoot, "dev", "vfio")
+		Expect(os.MkdirAll(vfioDir, 0755)).To(Succeed())
+		for _, group := range []string{"42", "84"} {
+			Expect(os.WriteFile(filepath.Join(vfioDir, group), nil, 0644)).To(Succeed())
+		}
+
+		source = devicesource.NewMemory(gpu("0000:1b:00.0", "2330", "42"))
+		c := device_plugin.NewController(device_plugin.Config{
+			HTTPAddress:     "127.0.0.1:0",
+			HostRoot:        hostRoot,
+			Source:          source,
+			DevicePluginDir: dir,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- c.Run(ctx)
+		}()
+		DeferCleanup(func() {
+			cancel()
+			Eventually(done, 10*time.Second).Should(Receive(BeNil()))
+		})
+
+		Eventually(kubelet.Registrations).Should(ConsistOf(h100Resource))
+	})
+
+	It("advertises the devices plugged in after the start", func() {
+		source.Set(gpu("0000:1b:00.0", "2330", "42"), gpu("0000:9a:00.0", "2330", "84"))
+
+		Eventually(func() ([]string, error) {
+			return advertisedDevices(socketPath("GH100_H100_SXM5_80GB"))
+		}, 10*time.Second).Should(ConsistOf("42|0000:1b:00.0", "84|0000:9a:00.0"))
+		Eventually(kubelet.Registrations).Should(ConsistOf(h100Resource, h100Resource))
+	})
+
+	It("withdraws the resource whose devices were all removed", func() {
+		source.Set(gpu("0000:9a:00.0", "20b0", "84"))
+
+		Eventually(socketPath("GH100_H100_SXM5_80GB"), 10*time.Second).ShouldNot(BeAnExistingFile())
+		Eventually(kubelet.Registrations, 10*time.Second).Should(ConsistOf(h100Resource, a100Resource))
+		Expect(advertisedDevices(socketPath("GA100_A100_SXM4_40GB"))).To(ConsistOf("84|0000:9a:00.0"))
+	})
+
+	It("keeps the plugin of the resource whose devices did not change", func() {
+		source.Set(gpu("0000:1b:00.0", "2330", "42"), gpu("0000:9a:00.0", "20b0", "84"))
+
+		Eventually(kubelet.Registrations, 10*time.Second).Should(ConsistOf(h100Resource, a100Resource))
+		Consistently(kubelet.Registrations).Should(ConsistOf(h100Resource, a100Resource))
+	})
+})
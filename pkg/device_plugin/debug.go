@@ -0,0 +1,69 @@
+package device_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	klog "k8s.io/klog/v2"
+
+	"kubevirt-nvidia-device-plugin/pkg/podresources"
+)
+
+// debugServer serves troubleshooting endpoints, it is meant to listen on a local address only
+type debugServer struct {
+	allocations *podresources.Tracker
+	server      *http.Server
+}
+
+func newDebugServer(address string, allocations *podresources.Tracker) *debugServer {
+	ds := &debugServer{allocations: allocations}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/allocations", ds.handleAllocations)
+	ds.server = &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+	return ds
+}
+
+// start serves the debug endpoints in the background
+func (ds *debugServer) start() {
+	go func() {
+		klog.InfoS("Serving debug endpoints", "address", ds.server.Addr)
+		if err := ds.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.ErrorS(err, "Debug server failed", "address", ds.server.Addr)
+		}
+	}()
+}
+
+// stop shuts the debug server down
+func (ds *debugServer) stop(ctx context.Context) error {
+	return ds.server.Shutdown(ctx)
+}
+
+// handleAllocations lists the allocated devices with the pod and VMI holding them.
+// The pciAddress, namespace and vmi query parameters filter the list.
+func (ds *debugServer) handleAllocations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	allocations := []podresources.Allocation{}
+	for _, allocation := range ds.allocations.Allocations() {
+		if !matches(query.Get("pciAddress"), allocation.PCIAddress) ||
+			!matches(query.Get("namespace"), allocation.Namespace) ||
+			!matches(query.Get("vmi"), allocation.VMI) {
+			continue
+		}
+		allocations = append(allocations, allocation)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(allocations); err != nil {
+		klog.ErrorS(err, "Could not write allocations")
+	}
+}
+
+func matches(filter string, value string) bool {
+	return filter == "" || filter == value
+}
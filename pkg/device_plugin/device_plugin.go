@@ -1,220 +1,274 @@
 package device_plugin
 
 import (
-	"bufio"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"regexp"
-	"strings"
+	"sort"
+	"sync"
 
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	klog "k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"kubevirt-nvidia-device-plugin/pkg/devicesource"
+	"kubevirt-nvidia-device-plugin/pkg/pciids"
+	"kubevirt-nvidia-device-plugin/pkg/resourcename"
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+	"kubevirt-nvidia-device-plugin/utils"
 )
 
 const (
-	nvidiaVendorID    = "10de"
-	basePath          = "/sys/bus/pci/devices"
-	pciIdsFilePath    = "/usr/pci.ids"
+	sysfsDevicesDir   = "sys/bus/pci/devices"
+	vfioDevicesDir    = "dev/vfio"
 	deviceIDSeparator = "|"
+	vfioDriver        = "vfio-pci"
 )
 
+// PCIDevice is a discovered PCI function selected for passthrough
 type PCIDevice struct {
-	pciAddress string
-	iommuGroup string
-	health     string
-}
+	devicesource.PCIDevice
+	health string
 
-var stop = make(chan struct{})
-
-func InitiateDevicePlugin() {
-	//Discover host Nvidia PCI devices
-	deviceMap := discoverPCIDevices()
-	//Create and start device plugin for each Nvidia device type
-	createDevicePlugins(deviceMap)
+	resourceNamespace string // namespace of the resource name, from the matching selector
+	resourceName      string // device name part of the resource name set by the matching selector, if any
+	// companions are the other functions of the slot passed through with the device, e.g. its HDMI audio
+	companions []devicesource.PCIDevice
 }
 
-func createDevicePlugins(deviceMap map[string][]*PCIDevice) {
-	var devicePlugins []*GenericDevicePlugin
-	var devs []*pluginapi.Device
-
-	//Iterate over deivceMap to create device plugin for each type
-	for id, devices := range deviceMap {
-		devs = nil
-		idToPCIMap := make(map[string]string)
-		for _, device := range devices {
-			deviceID := strings.Join([]string{device.iommuGroup, device.pciAddress}, deviceIDSeparator)
-			idToPCIMap[deviceID] = device.pciAddress
-			devs = append(devs, &pluginapi.Device{
-				ID:     deviceID,
-				Health: device.health,
-			})
-		}
-		deviceName := getDeviceName(id)
-		if deviceName == "" {
-			log.Printf("Error: Could not find device name for device id: %s", id)
-			deviceName = id
-		}
-		dp := NewGenericDevicePlugin(deviceName, vfioDevicePath, devs, idToPCIMap)
-		log.Printf("Starting Device Plugin: %s", deviceName)
-		err := startDevicePlugin(dp)
-		if err != nil {
-			log.Printf("Error starting %s device plugin: %v", dp.deviceName, err)
-		} else {
-			devicePlugins = append(devicePlugins, dp)
-		}
-	}
-	<-stop
-	log.Printf("Shutting down device plugin controller")
-	for _, v := range devicePlugins {
-		v.Stop()
-	}
+const (
+	// ModeDevicePlugin advertises the devices as extended resources through the device plugin API
+	ModeDevicePlugin = "device-plugin"
+	// ModeDRA publishes the devices as resource slices and hands them out as a DRA kubelet plugin
+	ModeDRA = "dra"
+)
 
+// Config holds the runtime options of the device plugin
+type Config struct {
+	// Mode selects how the devices are handed out to kubelet, ModeDevicePlugin or ModeDRA
+	Mode string
+	// CDI makes the device plugins hand out the devices as CDI devices instead of device nodes
+	CDI bool
+	// CDIRoot is the directory the CDI spec files are written to
+	CDIRoot string
+	// PodResourcesSocket is the socket of the kubelet PodResources API used to track the device allocations, disabled if empty
+	PodResourcesSocket string
+	// DebugAddress is the local address serving the /debug/allocations endpoint, disabled if empty
+	DebugAddress string
+	// ResetMethod enables resetting the devices before a container starts, using one of pcireset.Methods
+	ResetMethod string
+	// HTTPAddress is the address serving the /healthz and /readyz probes and the /metrics endpoint
+	HTTPAddress string
+	// NodeName is the name of the node the plugin runs on
+	NodeName string
+	// KubeClient is used to publish the discovered devices, it is nil when running without API access
+	KubeClient kubernetes.Interface
+	// DynamicClient is used to publish the device inventory, it is nil when running without API access
+	DynamicClient dynamic.Interface
+	// NodeLabels enables publishing node labels describing the discovered devices
+	NodeLabels bool
+	// NodeLabelsDryRun logs the node label changes instead of applying them
+	NodeLabelsDryRun bool
+	// NodeEvents enables recording device events on the node object
+	NodeEvents bool
+	// Inventory enables publishing the NvidiaPassthroughNode device inventory of the node
+	Inventory bool
+	// Selectors select the advertised PCI functions and their resource names, selector.Default() if empty
+	Selectors []selector.Selector
+	// HostRoot is the directory the host /sys and /dev are read from, / if empty. It points to the
+	// materialized tree of a simulated host.
+	HostRoot string
+	// Source lists the PCI functions of the host, the sysfs tree of HostRoot if nil
+	Source devicesource.Source
+	// DevicePluginDir is the directory of the kubelet registration socket and of the plugin
+	// sockets, the kubelet device plugin directory if empty
+	DevicePluginDir string
+	// AuditLog is the file the device allocations are recorded in, disabled if empty
+	AuditLog string
+	// AuditLogMaxSize is the size in bytes the audit log is rotated at, audit.DefaultMaxSize if 0
+	AuditLogMaxSize int64
+	// AuditLogMaxBackups is the number of rotated audit logs kept, audit.DefaultMaxBackups if 0
+	AuditLogMaxBackups int
+	// AuditWebhook receives every audit record as a JSON POST request, disabled if empty
+	AuditWebhook string
+	// RequireDeviceNames fails the discovery if a device name is not in pci.ids instead of
+	// advertising the device under its device ID
+	RequireDeviceNames bool
 }
 
-func startDevicePlugin(dp *GenericDevicePlugin) error {
-	return dp.Start(stop)
+// deviceType groups the discovered PCI functions advertised under one resource name
+type deviceType struct {
+	namespace  string // resource namespace, e.g. nvidia.com
+	vendorID   string
+	deviceID   string
+	deviceName string
+	devices    []*PCIDevice
 }
 
-func discoverPCIDevices() map[string][]*PCIDevice {
-
-	pciDevicesMap := make(map[string][]*PCIDevice)
+// resourceName returns the extended resource name of the device type, e.g. nvidia.com/GH100_H100_SXM5_80GB
+func (dt *deviceType) resourceName() string {
+	return fmt.Sprintf("%s/%s", dt.namespace, dt.deviceName)
+}
 
-	//Walk directory to discover PCI devices
-	filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Printf("Error accessing file path %q: %v\n", path, err)
-			return err
-		}
-		if info.IsDir() {
-			// Not a device
-			return nil
-		}
-		vendorID, err := readIDFromFile(basePath, info.Name(), "vendor")
-		if err != nil {
-			log.Println("Could not get vendor ID for device: ", info.Name())
-			return nil
+// resolveDeviceTypes groups the discovered devices by resource name, resolving the device name of
+// every discovered vendor and device ID unless the selector of the device names the resource.
+// Device IDs whose names collide get their device ID appended to the name.
+// The device types are sorted by resource namespace and device ID. With requireNames, a device
+// name missing from pci.ids is an error instead of being replaced by the device ID.
+func resolveDeviceTypes(devices []*PCIDevice, requireNames bool) ([]*deviceType, error) {
+	byKey := map[string]*deviceType{}
+	var deviceTypes []*deviceType
+	var candidates []resourcename.Candidate
+	for _, device := range devices {
+		// devices named by their selector share the name, other devices are grouped by ID
+		key := device.resourceNamespace + "/" + device.resourceName
+		if device.resourceName == "" {
+			key = device.resourceNamespace + " " + device.VendorID + ":" + device.DeviceID
 		}
-
-		//Nvidia vendor id is "10de". Proceed if vendor id is 10de
-		if vendorID == nvidiaVendorID {
-			log.Println("Nvidia device discovered: ", info.Name())
-			driver, err := readLink(basePath, info.Name(), "driver")
-			if err != nil {
-				log.Println("Could not get driver for device: ", info.Name())
-			}
-			iommuGroup, err := readLink(basePath, info.Name(), "iommu_group")
-			if err != nil {
-				log.Println("Could not get IOMMU Group for device: ", info.Name())
-				return nil
-			}
-			deviceID, err := readIDFromFile(basePath, info.Name(), "device")
-			if err != nil {
-				log.Println("Could not get device ID for device: ", info.Name())
-				return nil
-			}
-			pcidev := &PCIDevice{
-				pciAddress: info.Name(),
-				iommuGroup: iommuGroup,
-				health:     pluginapi.Healthy,
+		dt, ok := byKey[key]
+		if !ok {
+			deviceName := device.resourceName
+			if deviceName == "" {
+				deviceName = getDeviceName(device.VendorID, device.DeviceID)
+				if deviceName == "" && requireNames {
+					return nil, fmt.Errorf("no pci ids name for device %s:%s at %s", device.VendorID, device.DeviceID, device.PCIAddress)
+				}
+				if deviceName == "" {
+					klog.InfoS("Could not find device name, using the device ID as resource name", "vendorID", device.VendorID, "deviceID", device.DeviceID)
+					deviceName = device.DeviceID
+				}
 			}
-			if driver != "vfio-pci" {
-				log.Println("The device is not using vfio-pci kernel driver. Unhealthy for passthrough")
-				pcidev.health = pluginapi.Unhealthy
+			dt = &deviceType{
+				namespace:  device.resourceNamespace,
+				vendorID:   device.VendorID,
+				deviceID:   device.DeviceID,
+				deviceName: deviceName,
 			}
-			pciDevicesMap[deviceID] = append(pciDevicesMap[deviceID], pcidev)
-			log.Printf("Device ID: %s ; IOMMU Group: %s ; Driver: %s ; Health: %s", deviceID, iommuGroup, driver, pcidev.health)
+			byKey[key] = dt
+			deviceTypes = append(deviceTypes, dt)
+			candidates = append(candidates, resourcename.Candidate{
+				Namespace: dt.namespace,
+				Name:      deviceName,
+				VendorID:  dt.vendorID,
+				DeviceID:  dt.deviceID,
+				Fixed:     device.resourceName != "",
+			})
 		}
-		return nil
-	})
-	return pciDevicesMap
-}
-
-func readIDFromFile(basePath string, deviceAddress string, property string) (string, error) {
-	data, err := os.ReadFile(filepath.Join(basePath, deviceAddress, property))
-	if err != nil {
-		klog.Errorf("Could not read %s for device %s: %s", property, deviceAddress, err)
-		return "", err
+		dt.devices = append(dt.devices, device)
 	}
-	id := strings.Trim(string(data[2:]), "\n")
-	return id, nil
-}
 
-func readLink(basePath string, deviceAddress string, link string) (string, error) {
-	path, err := os.Readlink(filepath.Join(basePath, deviceAddress, link))
-	if err != nil {
-		klog.Errorf("Could not read link %s for device %s: %s", link, deviceAddress, err)
-		return "", err
+	for i, name := range resourcename.Resolve(candidates) {
+		deviceTypes[i].deviceName = name
+		if err := resourcename.Validate(deviceTypes[i].namespace, name); err != nil {
+			return nil, err
+		}
 	}
-	_, file := filepath.Split(path)
-	return file, nil
+	sort.Slice(deviceTypes, func(i, j int) bool {
+		if deviceTypes[i].namespace != deviceTypes[j].namespace {
+			return deviceTypes[i].namespace < deviceTypes[j].namespace
+		}
+		if deviceTypes[i].deviceID != deviceTypes[j].deviceID {
+			return deviceTypes[i].deviceID < deviceTypes[j].deviceID
+		}
+		return deviceTypes[i].deviceName < deviceTypes[j].deviceName
+	})
+	return deviceTypes, nil
 }
 
-func getDeviceName(deviceID string) string {
-	deviceName := ""
-	file, err := os.Open(pciIdsFilePath)
-	if err != nil {
-		log.Printf("Error opening pci ids file %s", pciIdsFilePath)
-		return ""
+// selectDevices returns the PCI functions matched by one of the selectors, in the order of the
+// functions. Functions without IOMMU group cannot be passed through and are skipped.
+// The companions of the functions whose selector attaches them are set.
+func selectDevices(functions []devicesource.PCIDevice, selectors []selector.Selector) []*PCIDevice {
+	var pciDevices []*PCIDevice
+	var parents []*PCIDevice
+	selected := map[string]bool{}
+	for _, function := range functions {
+		i := selector.Match(selectors, selector.Device{
+			VendorID: function.VendorID,
+			DeviceID: function.DeviceID,
+			Class:    function.Class,
+			Driver:   function.Driver,
+		})
+		if i < 0 {
+			continue
+		}
+		klog.V(2).InfoS("Device discovered", "pciAddress", function.PCIAddress, "vendorID", function.VendorID, "selector", i)
+		if function.IOMMUGroup == "" {
+			klog.ErrorS(nil, "Could not get IOMMU group for device", "pciAddress", function.PCIAddress)
+			continue
+		}
+		pcidev := &PCIDevice{
+			PCIDevice:         function,
+			health:            pluginapi.Healthy,
+			resourceNamespace: selectors[i].ResourceNamespace,
+			resourceName:      selectors[i].ResourceName,
+		}
+		if function.Driver != vfioDriver {
+			klog.InfoS("The device is not using vfio-pci kernel driver. Unhealthy for passthrough", "pciAddress", function.PCIAddress, "driver", function.Driver)
+			pcidev.health = pluginapi.Unhealthy
+		}
+		pciDevices = append(pciDevices, pcidev)
+		selected[function.PCIAddress] = true
+		if selectors[i].AttachCompanions {
+			parents = append(parents, pcidev)
+		}
+		klog.InfoS("Discovered device", "pciAddress", function.PCIAddress, "vendorID", function.VendorID, "deviceID", function.DeviceID, "class", function.Class, "kind", function.Kind(), "iommuGroup", function.IOMMUGroup, "driver", function.Driver, "numaNode", function.NUMANode, "pcieRoot", function.PCIeRoot, "health", pcidev.health)
 	}
-	defer file.Close()
-
-	// Locate beginning of NVIDIA device list in pci.ids file
-	scanner, err := locateVendor(file, nvidiaVendorID)
-	if err != nil {
-		log.Printf("Error locating NVIDIA in pci.ds file: %v", err)
-		return ""
+	for _, parent := range parents {
+		attachCompanions(parent, functions, selected)
 	}
+	return pciDevices
+}
 
-	// Find NVIDIA device by device id
-	prefix := fmt.Sprintf("\t%s", deviceID)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// ignore comments
-		if strings.HasPrefix(line, "#") {
+// attachCompanions sets the companions of the device: the functions of its slot which are not
+// selected themselves. A companion which is not bound to vfio-pci makes the device unhealthy.
+func attachCompanions(device *PCIDevice, functions []devicesource.PCIDevice, selected map[string]bool) {
+	for _, function := range functions {
+		if function.Slot() != device.Slot() || selected[function.PCIAddress] {
 			continue
 		}
-		// if line does not start with tab, we are visiting a different vendor
-		if !strings.HasPrefix(line, "\t") {
-			log.Printf("Could not find NVIDIA device with id: %s", deviceID)
-			return ""
-		}
-		if !strings.HasPrefix(line, prefix) {
+		if function.IOMMUGroup == "" {
+			klog.ErrorS(nil, "Could not get IOMMU group for companion function, not attaching it", "pciAddress", device.PCIAddress, "companion", function.PCIAddress)
 			continue
 		}
-
-		deviceName = strings.TrimPrefix(line, prefix)
-		deviceName = strings.TrimSpace(deviceName)
-		deviceName = strings.Replace(deviceName, "/", "_", -1)
-		deviceName = strings.Replace(deviceName, ".", "_", -1)
-		// Replace all spaces with underscore
-		reg, _ := regexp.Compile("\\s+")
-		deviceName = reg.ReplaceAllString(deviceName, "_")
-		// Removes any char other than alphanumeric and underscore
-		reg, _ = regexp.Compile("[^a-zA-Z0-9_.]+")
-		deviceName = reg.ReplaceAllString(deviceName, "")
-		break
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading pci ids file %s", err)
+		device.companions = append(device.companions, function)
+		klog.InfoS("Attached companion function", "pciAddress", device.PCIAddress, "companion", function.PCIAddress, "kind", function.Kind(), "driver", function.Driver)
+		if function.Driver != vfioDriver && device.health == pluginapi.Healthy {
+			klog.InfoS("The companion function is not using vfio-pci kernel driver. Unhealthy for passthrough", "pciAddress", device.PCIAddress, "companion", function.PCIAddress, "driver", function.Driver)
+			device.health = pluginapi.Unhealthy
+		}
 	}
-	return deviceName
 }
 
-func locateVendor(pciIdsFile *os.File, vendorID string) (*bufio.Scanner, error) {
-	scanner := bufio.NewScanner(pciIdsFile)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, vendorID) {
-			return scanner, nil
-		}
+// pciDatabase loads the first pci.ids file found, or the embedded snapshot, once on first use
+var pciDatabase = sync.OnceValues(func() (*pciids.Database, error) {
+	db, source, err := pciids.Find(pciids.DefaultPaths, utils.PCIIDs)
+	if err != nil {
+		klog.ErrorS(err, "Error loading pci ids database, devices are named after their device ID", "paths", pciids.DefaultPaths)
+		return nil, err
 	}
+	klog.InfoS("Loaded pci ids database", "source", source, "version", db.Version)
+	return db, nil
+})
 
-	if err := scanner.Err(); err != nil {
-		return scanner, fmt.Errorf("error reading pci.ids file: %v", err)
+// getDeviceName returns the resource name of a device derived from its pci.ids name, or "" if it is unknown
+func getDeviceName(vendorID string, deviceID string) string {
+	db, err := pciDatabase()
+	if err != nil {
+		return ""
+	}
+	deviceName := db.DeviceName(vendorID, deviceID)
+	if deviceName == "" {
+		klog.InfoS("Could not find device in pci.ids file", "vendorID", vendorID, "deviceID", deviceID)
+		return ""
 	}
+	return resourcename.Sanitize(deviceName)
+}
 
-	return scanner, fmt.Errorf("failed to find vendor id in pci.ids file: %s", vendorID)
+// lookupNames returns the vendor and subsystem names of a device, "" if they are unknown
+func lookupNames(device *PCIDevice) (vendor string, subsystem string) {
+	db, err := pciDatabase()
+	if err != nil {
+		return "", ""
+	}
+	return db.VendorName(device.VendorID), db.SubsystemName(device.VendorID, device.DeviceID, device.SubsystemVendorID, device.SubsystemDeviceID)
 }
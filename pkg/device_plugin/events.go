@@ -0,0 +1,104 @@
+package device_plugin
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const eventComponent = "kubevirt-nvidia-device-plugin"
+
+// Reasons of the events attached to the node
+const (
+	reasonDeviceAppeared     = "PassthroughDeviceAppeared"
+	reasonDeviceDisappeared  = "PassthroughDeviceDisappeared"
+	reasonDeviceHealthy      = "PassthroughDeviceHealthy"
+	reasonDeviceUnhealthy    = "PassthroughDeviceUnhealthy"
+	reasonDriverNotVFIO      = "PassthroughDriverNotVFIO"
+	reasonRegistrationFailed = "DevicePluginRegistrationFailed"
+	reasonAllocationFailed   = "PassthroughAllocationFailed"
+	reasonResetFailed        = "PassthroughDeviceResetFailed"
+)
+
+// nodeEvents records the device events of the node the plugin runs on.
+// A nil nodeEvents discards the events.
+type nodeEvents struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	node        *corev1.ObjectReference
+}
+
+func newNodeEvents(client kubernetes.Interface, nodeName string) *nodeEvents {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &nodeEvents{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent, Host: nodeName}),
+		// Like kubelet, identify the node by its name
+		node: &corev1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+			UID:  types.UID(nodeName),
+		},
+	}
+}
+
+func (e *nodeEvents) deviceAppeared(resource string, pciAddress string) {
+	e.eventf(corev1.EventTypeNormal, reasonDeviceAppeared, "Device %s of %s appeared", pciAddress, resource)
+}
+
+// deviceDisappeared records a device which disappeared, holder describes the container it was
+// allocated to, empty if it was free
+func (e *nodeEvents) deviceDisappeared(resource string, pciAddress string, holder string) {
+	if holder != "" {
+		e.eventf(corev1.EventTypeWarning, reasonDeviceDisappeared, "Device %s of %s disappeared while allocated to %s", pciAddress, resource, holder)
+		return
+	}
+	e.eventf(corev1.EventTypeWarning, reasonDeviceDisappeared, "Device %s of %s disappeared", pciAddress, resource)
+}
+
+func (e *nodeEvents) healthChanged(resource string, pciAddress string, health string) {
+	if health == pluginapi.Healthy {
+		e.eventf(corev1.EventTypeNormal, reasonDeviceHealthy, "Device %s of %s became healthy", pciAddress, resource)
+		return
+	}
+	e.eventf(corev1.EventTypeWarning, reasonDeviceUnhealthy, "Device %s of %s became unhealthy", pciAddress, resource)
+}
+
+func (e *nodeEvents) driverNotVFIO(resource string, pciAddress string, driver string) {
+	if driver == "" {
+		driver = "no driver"
+	}
+	e.eventf(corev1.EventTypeWarning, reasonDriverNotVFIO, "Device %s of %s is bound to %s instead of %s and cannot be passed through", pciAddress, resource, driver, vfioDriver)
+}
+
+func (e *nodeEvents) registrationFailed(resource string, err error) {
+	e.eventf(corev1.EventTypeWarning, reasonRegistrationFailed, "Failed to register %s with kubelet: %v", resource, err)
+}
+
+func (e *nodeEvents) allocationFailed(resource string, device string) {
+	e.eventf(corev1.EventTypeWarning, reasonAllocationFailed, "Missing device mapping for %s of %s", device, resource)
+}
+
+func (e *nodeEvents) resetFailed(resource string, pciAddress string, err error) {
+	e.eventf(corev1.EventTypeWarning, reasonResetFailed, "Failed to reset device %s of %s before container start: %v", pciAddress, resource, err)
+}
+
+func (e *nodeEvents) eventf(eventType string, reason string, messageFmt string, args ...any) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.node, eventType, reason, messageFmt, args...)
+}
+
+// shutdown flushes and stops the event broadcaster
+func (e *nodeEvents) shutdown() {
+	if e == nil {
+		return
+	}
+	e.broadcaster.Shutdown()
+}
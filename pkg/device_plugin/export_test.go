@@ -0,0 +1,95 @@
+package device_plugin
+
+import (
+	"context"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"kubevirt-nvidia-device-plugin/pkg/audit"
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+	"kubevirt-nvidia-device-plugin/pkg/pcireset"
+	"kubevirt-nvidia-device-plugin/pkg/podresources"
+)
+
+// NewTestDevicePlugin returns a plugin serving its socket in dir and registering with dir/kubelet.sock
+func NewTestDevicePlugin(dir string, namespace string, deviceName string, devicePath string, devices []*pluginapi.Device, idToPCIMap map[string]string) *GenericDevicePlugin {
+	dpi := NewGenericDevicePlugin(namespace, deviceName, devicePath, devices, idToPCIMap)
+	dpi.setPluginDir(dir)
+	return dpi
+}
+
+func (dpi *GenericDevicePlugin) SocketPath() string {
+	return dpi.socketPath
+}
+
+func (dpi *GenericDevicePlugin) Alive() error {
+	return dpi.alive()
+}
+
+func (dpi *GenericDevicePlugin) Ready() error {
+	return dpi.ready()
+}
+
+func (dpi *GenericDevicePlugin) ListAndWatchStreams() int {
+	return int(dpi.listAndWatchStreams.Load())
+}
+
+// SetListAndWatchGracePeriod changes the grace period until the returned function restores it
+func SetListAndWatchGracePeriod(period time.Duration) (restore func()) {
+	previous := listAndWatchGracePeriod
+	listAndWatchGracePeriod = period
+	return func() { listAndWatchGracePeriod = previous }
+}
+
+type Supervisor = supervisor
+
+func NewSupervisor(dp *GenericDevicePlugin) *Supervisor {
+	return newSupervisor(dp)
+}
+
+func (s *supervisor) Run(ctx context.Context) {
+	s.run(ctx)
+}
+
+func (s *supervisor) Ready() error {
+	return s.ready()
+}
+
+func (s *supervisor) Restarts() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.restarts
+}
+
+// SetCompanions sets the device IDs of the companion functions attached to each device
+func (dpi *GenericDevicePlugin) SetCompanions(companions map[string][]string) {
+	dpi.companions = companions
+}
+
+func (dpi *GenericDevicePlugin) SetAudit(logger *audit.Logger) {
+	dpi.audit = logger
+}
+
+// SetCDIRoot makes the plugin hand out CDI devices described in dir
+func (dpi *GenericDevicePlugin) SetCDIRoot(dir string) {
+	dpi.cdiRoot = dir
+}
+
+func (dpi *GenericDevicePlugin) WriteCDISpec() error {
+	return dpi.writeCDISpec()
+}
+
+// SetAllocations makes the plugin check the allocations of the tracker
+func (dpi *GenericDevicePlugin) SetAllocations(tracker *podresources.Tracker) {
+	dpi.allocations = tracker
+}
+
+// SetResetter makes the plugin reset the devices before a container starts
+func (dpi *GenericDevicePlugin) SetResetter(resetter *pcireset.Resetter) {
+	dpi.resetter = resetter
+}
+
+func (dpi *GenericDevicePlugin) SetInventory(inv *inventory.Inventory) {
+	dpi.inventory = inv
+}
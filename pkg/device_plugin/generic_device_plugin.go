@@ -2,61 +2,132 @@ package device_plugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	klog "k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"kubevirt-nvidia-device-plugin/pkg/audit"
+	"kubevirt-nvidia-device-plugin/pkg/cdi"
+	"kubevirt-nvidia-device-plugin/pkg/devicesource"
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+	"kubevirt-nvidia-device-plugin/pkg/metrics"
+	"kubevirt-nvidia-device-plugin/pkg/pcireset"
+	"kubevirt-nvidia-device-plugin/pkg/podresources"
+	"kubevirt-nvidia-device-plugin/pkg/selector"
 )
 
 const (
-	DeviceNamespace    = "nvidia.com"
+	DeviceNamespace    = selector.DefaultResourceNamespace
 	connectionTimeout  = 5 * time.Second
 	vfioDevicePath     = "/dev/vfio"
-	resourceNamePrefix = "PCI_RESOURCE_NVIDIA_COM"
+	resourceNamePrefix = "PCI_RESOURCE"
+	// companionsEnvVarSuffix is appended to the resource environment variable to list the companions
+	companionsEnvVarSuffix = "_COMPANIONS"
+	shutdownTimeout        = 10 * time.Second
 )
 
+// listAndWatchGracePeriod is how long kubelet is given to open the ListAndWatch stream of a
+// registered plugin before the plugin is reported dead
+var listAndWatchGracePeriod = 30 * time.Second
+
+// resourceEnvVar returns the environment variable KubeVirt reads the PCI addresses of the devices
+// allocated for a resource from, e.g. PCI_RESOURCE_NVIDIA_COM_GH100_H100_SXM5_80GB
+func resourceEnvVar(resourceName string) string {
+	name := strings.NewReplacer(".", "_", "/", "_").Replace(resourceName)
+	return fmt.Sprintf("%s_%s", resourceNamePrefix, strings.ToUpper(name))
+}
+
+// companionsEnvVar returns the environment variable listing the PCI addresses of the companion
+// functions of the devices allocated for a resource. KubeVirt only attaches the devices of
+// resourceEnvVar, the companions are for hook sidecars and guest tooling.
+func companionsEnvVar(resourceName string) string {
+	return resourceEnvVar(resourceName) + companionsEnvVarSuffix
+}
+
 // Implements the kubernetes device plugin API
 type GenericDevicePlugin struct {
-	devs       []*pluginapi.Device
-	server     *grpc.Server
-	socketPath string
-	stop       chan struct{} // this channel signals to stop the DP
-	term       chan bool     // this channel detects kubelet restarts
-	healthy    chan string
-	unhealthy  chan string
-	devicePath string
-	deviceName string
-	devsHealth []*pluginapi.Device
-	idToPCIMap map[string]string
+	devs          []*pluginapi.Device
+	server        *grpc.Server
+	socketPath    string
+	kubeletSocket string     // the kubelet registration socket, in the directory of socketPath
+	mu            sync.Mutex // guards server and stop
+	ctx           context.Context
+	stop          chan struct{}      // closed when the running gRPC server is stopped
+	devsMu        sync.Mutex         // guards the health of devs and devsChanged
+	devsChanged   chan struct{}      // closed and replaced whenever the health of a device changes
+	register      chan struct{}      // this channel requests (re-)registration with kubelet
+	failures      chan pluginFailure // this channel reports unexpected exits to the supervisor
+	devicePath    string
+	namespace     string // resource namespace, e.g. nvidia.com
+	deviceName    string
+	devsHealth    []*pluginapi.Device
+	idToPCIMap    map[string]string
+	companions    map[string][]string // device ID to the device IDs of the companion functions attached to it
+	events        *nodeEvents
+	inventory     *inventory.Inventory
+	cdiRoot       string             // the devices are handed out as CDI devices described in this directory, if set
+	resetter      *pcireset.Resetter // the devices are reset before a container starts, if set
+	allocations   *podresources.Tracker
+	audit         *audit.Logger // the allocations are recorded if set
+
+	// state reported through the health and readiness probes
+	serving             atomic.Bool
+	registered          atomic.Bool
+	registeredAt        atomic.Int64 // unix time in nanoseconds of the last registration
+	healthChecks        atomic.Int32 // number of running healthCheck goroutines
+	listAndWatchStreams atomic.Int32 // number of open ListAndWatch streams
+}
+
+// SocketPath returns the socket the device plugin of a resource serves, e.g.
+// /var/lib/kubelet/device-plugins/kubevirt-GH100_H100_SXM5_80GB.sock for nvidia.com/GH100_H100_SXM5_80GB
+func SocketPath(namespace string, deviceName string) string {
+	if namespace != DeviceNamespace {
+		// device names are only unique within a namespace
+		return fmt.Sprintf(pluginapi.DevicePluginPath+"kubevirt-%s-%s.sock", namespace, deviceName)
+	}
+	return fmt.Sprintf(pluginapi.DevicePluginPath+"kubevirt-%s.sock", deviceName)
 }
 
 // NewGenericDevicePlugin returns an initialized instance of GenericDevicePlugin
-func NewGenericDevicePlugin(deviceName string, devicePath string, devices []*pluginapi.Device, idToPCIMap map[string]string) *GenericDevicePlugin {
+func NewGenericDevicePlugin(namespace string, deviceName string, devicePath string, devices []*pluginapi.Device, idToPCIMap map[string]string) *GenericDevicePlugin {
 
-	serverSock := fmt.Sprintf(pluginapi.DevicePluginPath+"kubevirt-%s.sock", deviceName)
+	serverSock := SocketPath(namespace, deviceName)
 
 	dpi := &GenericDevicePlugin{
-		devs:       devices,
-		socketPath: serverSock,
-		term:       make(chan bool, 1),
-		healthy:    make(chan string),
-		unhealthy:  make(chan string),
-		deviceName: deviceName,
-		devicePath: devicePath,
-		idToPCIMap: idToPCIMap,
+		devs:          devices,
+		socketPath:    serverSock,
+		kubeletSocket: pluginapi.KubeletSocket,
+		devsChanged:   make(chan struct{}),
+		register:      make(chan struct{}, 1),
+		failures:      make(chan pluginFailure, 2),
+		namespace:     namespace,
+		deviceName:    deviceName,
+		devicePath:    devicePath,
+		idToPCIMap:    idToPCIMap,
 	}
 	return dpi
 }
 
+// setPluginDir makes the plugin serve its socket in dir and register with the kubelet socket of dir
+func (dpi *GenericDevicePlugin) setPluginDir(dir string) {
+	dpi.socketPath = filepath.Join(dir, filepath.Base(dpi.socketPath))
+	dpi.kubeletSocket = filepath.Join(dir, filepath.Base(pluginapi.KubeletSocket))
+}
+
 func waitForGrpcServer(socketPath string, timeout time.Duration) error {
 	conn, err := connect(socketPath, timeout)
 	if err != nil {
@@ -66,9 +137,10 @@ func waitForGrpcServer(socketPath string, timeout time.Duration) error {
 	return nil
 }
 
-func connect(socketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	c, err := grpc.DialContext(ctx, socketPath,
+func connect(socketPath string, timeout time.Duration, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	opts = append([]grpc.DialOption{
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithBlock(),
 		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
@@ -77,7 +149,8 @@ func connect(socketPath string, timeout time.Duration) (*grpc.ClientConn, error)
 			}
 			return net.DialTimeout("unix", addr, connectionTimeout)
 		}),
-	)
+	}, opts...)
+	c, err := grpc.DialContext(ctx, socketPath, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -85,19 +158,29 @@ func connect(socketPath string, timeout time.Duration) (*grpc.ClientConn, error)
 	return c, nil
 }
 
-// Start starts the gRPC server of the device plugin
-func (dpi *GenericDevicePlugin) Start(stop chan struct{}) error {
+// Start starts the gRPC server of the device plugin.
+// The plugin stops serving ListAndWatch streams and health checks once ctx is cancelled,
+// Stop still has to be called to shut the server down and remove its socket.
+func (dpi *GenericDevicePlugin) Start(ctx context.Context) error {
+	dpi.mu.Lock()
+	defer dpi.mu.Unlock()
+
 	if dpi.server != nil {
 		return fmt.Errorf("gRPC server already started")
 	}
 
-	dpi.stop = stop
+	dpi.ctx = ctx
+	dpi.stop = make(chan struct{})
 
 	err := dpi.cleanup()
 	if err != nil {
 		return err
 	}
 
+	if err := dpi.writeCDISpec(); err != nil {
+		return fmt.Errorf("[%s] Error writing CDI spec: %v", dpi.deviceName, err)
+	}
+
 	sock, err := net.Listen("unix", dpi.socketPath)
 	if err != nil {
 		return fmt.Errorf("[%s] Error creating GRPC server socket: %v", dpi.deviceName, err)
@@ -106,56 +189,152 @@ func (dpi *GenericDevicePlugin) Start(stop chan struct{}) error {
 	dpi.server = grpc.NewServer([]grpc.ServerOption{}...)
 	pluginapi.RegisterDevicePluginServer(dpi.server, dpi)
 
-	go dpi.server.Serve(sock)
+	go dpi.serve(dpi.server, sock, dpi.stop)
 
 	err = waitForGrpcServer(dpi.socketPath, connectionTimeout)
 	if err != nil {
 		return fmt.Errorf("[%s] Error connecting to GRPC server: %v", dpi.deviceName, err)
 	}
+	dpi.serving.Store(true)
 
-	err = dpi.Register()
-	if err != nil {
-		return fmt.Errorf("[%s] Error registering with device plugin manager: %v", dpi.deviceName, err)
-	}
+	// Registration is retried in the background until kubelet accepts it
+	go dpi.registrationLoop(ctx, dpi.stop)
+	dpi.requestRegistration()
 
-	go dpi.healthCheck()
+	go dpi.runHealthCheck(ctx, dpi.stop)
 
-	log.Println(dpi.deviceName + " Device plugin server ready")
+	klog.InfoS("Device plugin server ready", "resource", dpi.resourceName(), "socket", dpi.socketPath)
 
-	return err
+	return nil
 }
 
-// Stop stops the gRPC server
+// Stop ends the open ListAndWatch streams, gracefully stops the gRPC server
+// and removes the plugin socket
 func (dpi *GenericDevicePlugin) Stop() error {
-	if dpi.server == nil {
-		return nil
+	dpi.mu.Lock()
+	server := dpi.server
+	if server == nil {
+		dpi.mu.Unlock()
+		return dpi.cleanup()
 	}
-
-	// Send terminate signal to ListAndWatch()
-	dpi.term <- true
-
-	dpi.server.Stop()
 	dpi.server = nil
+	dpi.serving.Store(false)
+	dpi.setRegistered(false)
+
+	// Terminate ListAndWatch() and healthCheck()
+	close(dpi.stop)
+	dpi.mu.Unlock()
+
+	// Let in-flight calls complete, but do not wait for clients forever
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		klog.InfoS("Timed out waiting for device plugin server to stop gracefully", "resource", dpi.resourceName())
+		server.Stop()
+	}
 
 	return dpi.cleanup()
 }
 
-func (dpi *GenericDevicePlugin) restart() error {
-	log.Printf("Restarting %s device plugin server", dpi.deviceName)
+// serve runs the gRPC server and reports it to the supervisor if it exits unexpectedly
+func (dpi *GenericDevicePlugin) serve(server *grpc.Server, sock net.Listener, stop <-chan struct{}) {
+	// Serve returns nil once the server is stopped
+	if err := server.Serve(sock); err != nil {
+		dpi.reportFailure(stop, componentServer, err)
+	}
+}
+
+// startHealthCheck restarts the health check of the running gRPC server
+func (dpi *GenericDevicePlugin) startHealthCheck() {
+	dpi.mu.Lock()
+	defer dpi.mu.Unlock()
 	if dpi.server == nil {
-		return fmt.Errorf("grpc server instance not found for %s", dpi.deviceName)
+		return
+	}
+	go dpi.runHealthCheck(dpi.ctx, dpi.stop)
+}
+
+// runHealthCheck runs the health check and reports it to the supervisor if it exits unexpectedly
+func (dpi *GenericDevicePlugin) runHealthCheck(ctx context.Context, stop <-chan struct{}) {
+	if err := dpi.healthCheck(ctx, stop); err != nil {
+		component := componentHealthCheck
+		if errors.Is(err, errSocketRemoved) {
+			// The server cannot be reached without its socket, nor re-register with a restarted kubelet
+			component = componentServer
+		}
+		dpi.reportFailure(stop, component, err)
+	}
+}
+
+func (dpi *GenericDevicePlugin) reportFailure(stop <-chan struct{}, component string, err error) {
+	select {
+	case dpi.failures <- pluginFailure{component: component, err: err}:
+	case <-stop:
+		// The failure belongs to a server which is already being stopped
+	}
+}
+
+// requestRegistration asks the registration loop to (re-)register the plugin with kubelet
+func (dpi *GenericDevicePlugin) requestRegistration() {
+	select {
+	case dpi.register <- struct{}{}:
+	default:
+		// a registration is already pending
+	}
+}
+
+// registrationLoop registers the plugin with kubelet whenever it is requested,
+// retrying with exponential backoff until kubelet accepts the registration.
+func (dpi *GenericDevicePlugin) registrationLoop(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-dpi.register:
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		dpi.setRegistered(false)
+		err := retryWithBackoff(ctx, stop, "register device plugin with kubelet", func() error {
+			err := dpi.Register()
+			if err != nil {
+				dpi.events.registrationFailed(dpi.resourceName(), err)
+			}
+			return err
+		}, "resource", dpi.resourceName())
+		if err != nil {
+			// The plugin is being stopped
+			return
+		}
+		dpi.setRegistered(true)
+		klog.InfoS("Device plugin registered with kubelet", "resource", dpi.resourceName())
 	}
+}
 
-	dpi.Stop()
+func (dpi *GenericDevicePlugin) setRegistered(registered bool) {
+	value := 0.0
+	if registered {
+		dpi.registeredAt.Store(time.Now().UnixNano())
+		value = 1
+	}
+	dpi.registered.Store(registered)
+	metrics.PluginRegistered.WithLabelValues(dpi.resourceName()).Set(value)
+}
 
-	// Create new instance of a grpc server
-	var stop = make(chan struct{})
-	return dpi.Start(stop)
+// resourceName returns the extended resource name advertised to kubelet
+func (dpi *GenericDevicePlugin) resourceName() string {
+	return fmt.Sprintf("%s/%s", dpi.namespace, dpi.deviceName)
 }
 
 // Register registers the device plugin for the given resourceName with Kubelet.
 func (dpi *GenericDevicePlugin) Register() error {
-	conn, err := connect(pluginapi.KubeletSocket, connectionTimeout)
+	conn, err := connect(dpi.kubeletSocket, connectionTimeout)
 	if err != nil {
 		return err
 	}
@@ -165,10 +344,12 @@ func (dpi *GenericDevicePlugin) Register() error {
 	reqt := &pluginapi.RegisterRequest{
 		Version:      pluginapi.Version,
 		Endpoint:     path.Base(dpi.socketPath),
-		ResourceName: fmt.Sprintf("%s/%s", DeviceNamespace, dpi.deviceName),
+		ResourceName: dpi.resourceName(),
 	}
 
-	_, err = client.Register(context.Background(), reqt)
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+	_, err = client.Register(ctx, reqt)
 	if err != nil {
 		return err
 	}
@@ -176,64 +357,141 @@ func (dpi *GenericDevicePlugin) Register() error {
 }
 
 // ListAndWatch returns a stream of List of Devices
-// Whenever a Device state change or a Device disappears, ListAndWatch returns the new list
+// Whenever a Device state change or a Device disappears, ListAndWatch returns the new list.
+// The stream ends when kubelet closes it or a list cannot be sent, kubelet opens a new one
+// which starts with the current list.
 func (dpi *GenericDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	dpi.listAndWatchStreams.Add(1)
+	defer dpi.listAndWatchStreams.Add(-1)
 
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
+	dpi.mu.Lock()
+	ctx, stop := dpi.ctx, dpi.stop
+	dpi.mu.Unlock()
 
 	for {
+		devs, changed := dpi.devices()
+		if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+			klog.ErrorS(err, "Could not send the devices to kubelet, closing ListAndWatch stream", "resource", dpi.resourceName())
+			return err
+		}
+
 		select {
-		case unhealthy := <-dpi.unhealthy:
-			for _, dev := range dpi.devs {
-				if unhealthy == dev.ID {
-					dev.Health = pluginapi.Unhealthy
-					log.Printf("Device %s has become %s", dev.ID, pluginapi.Unhealthy)
-				}
-			}
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
-		case healthy := <-dpi.healthy:
-			for _, dev := range dpi.devs {
-				if healthy == dev.ID {
-					dev.Health = pluginapi.Healthy
-					log.Printf("Device %s has become %s", dev.ID, pluginapi.Healthy)
-				}
-			}
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
-		case <-dpi.stop:
+		case <-changed:
+		case <-s.Context().Done():
+			klog.InfoS("ListAndWatch stream closed by kubelet", "resource", dpi.resourceName())
+			return nil
+		case <-stop:
 			return nil
-		case <-dpi.term:
+		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
+// devices returns a copy of the devices sent to kubelet and a channel closed once their health changes
+func (dpi *GenericDevicePlugin) devices() ([]*pluginapi.Device, <-chan struct{}) {
+	dpi.devsMu.Lock()
+	defer dpi.devsMu.Unlock()
+	devs := make([]*pluginapi.Device, 0, len(dpi.devs))
+	for _, dev := range dpi.devs {
+		devs = append(devs, &pluginapi.Device{ID: dev.ID, Health: dev.Health, Topology: dev.Topology})
+	}
+	return devs, dpi.devsChanged
+}
+
+// setDeviceHealth updates the health of the device sent to kubelet and wakes the ListAndWatch
+// streams up. It never blocks, whether kubelet reads a stream or not.
+func (dpi *GenericDevicePlugin) setDeviceHealth(devID string, health string) {
+	dpi.devsMu.Lock()
+	changed := false
+	for _, dev := range dpi.devs {
+		if devID == dev.ID && dev.Health != health {
+			dev.Health = health
+			changed = true
+		}
+	}
+	if changed {
+		close(dpi.devsChanged)
+		dpi.devsChanged = make(chan struct{})
+	}
+	dpi.devsMu.Unlock()
+
+	if changed {
+		iommuGroup, pciAddress := parseDeviceID(devID)
+		klog.InfoS("Device health changed", "resource", dpi.resourceName(), "pciAddress", pciAddress, "iommuGroup", iommuGroup, "health", health)
+		dpi.events.healthChanged(dpi.resourceName(), pciAddress, health)
+	}
+}
+
 // Allocate is called by Kubelet during container creation
 // It adds vfio device path to container and creates environment variables used by KubeVirt
-func (dpi *GenericDevicePlugin) Allocate(_ context.Context, r *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	resourceNameEnvVar := fmt.Sprintf("%s_%s", resourceNamePrefix, strings.ToUpper(dpi.deviceName))
-	allocatedDevices := []string{}
+func (dpi *GenericDevicePlugin) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	resourceNameEnvVar := resourceEnvVar(dpi.resourceName())
 	resp := new(pluginapi.AllocateResponse)
-	containerResponse := new(pluginapi.ContainerAllocateResponse)
+	event := audit.EventAllocate
+	if isDebugCall(ctx) {
+		// nothing is handed out to a container
+		event = audit.EventDebugAllocate
+	}
 
 	for _, request := range r.ContainerRequests {
+		// the devices of this container and their companions
+		allocatedDevices := []string{}
+		companionDevices := []string{}
+		containerResponse := new(pluginapi.ContainerAllocateResponse)
 		deviceSpecs := make([]*pluginapi.DeviceSpec, 0)
+		cdiDevices := make([]*pluginapi.CDIDevice, 0)
+		var unknownDevices []string
 		for _, devID := range request.DevicesIDs {
 			// translate device's id to its pci address
 			devPCIAddress, exist := dpi.idToPCIMap[devID]
 			if !exist {
-				log.Printf("Missing device mapping for %s", devID)
+				klog.ErrorS(nil, "Missing device mapping", "resource", dpi.resourceName(), "device", devID)
+				dpi.events.allocationFailed(dpi.resourceName(), devID)
+				unknownDevices = append(unknownDevices, devID)
 				continue
 			}
+			iommuGroup, _ := parseDeviceID(devID)
+			klog.V(2).InfoS("Allocating device", "resource", dpi.resourceName(), "pciAddress", devPCIAddress, "iommuGroup", iommuGroup)
 			allocatedDevices = append(allocatedDevices, devPCIAddress)
+			for _, companionID := range dpi.companions[devID] {
+				_, companionPCIAddress := parseDeviceID(companionID)
+				companionDevices = append(companionDevices, companionPCIAddress)
+			}
+			if dpi.cdiRoot != "" {
+				cdiDevices = append(cdiDevices, &pluginapi.CDIDevice{Name: cdi.QualifiedName(dpi.cdiKind(), devPCIAddress)})
+				continue
+			}
 			deviceSpecs = append(deviceSpecs, formatDeviceSpecs(devID)...)
+			deviceSpecs = append(deviceSpecs, dpi.companionDeviceSpecs(devID)...)
+		}
+		if dpi.cdiRoot != "" {
+			containerResponse.CDIDevices = cdiDevices
+		} else {
+			containerResponse.Devices = deviceSpecs
 		}
-		containerResponse.Devices = deviceSpecs
 		envVar := make(map[string]string)
 		envVar[resourceNameEnvVar] = strings.Join(allocatedDevices, ",")
+		if len(companionDevices) > 0 {
+			envVar[companionsEnvVar(dpi.resourceName())] = strings.Join(companionDevices, ",")
+		}
 
-		log.Printf("Device Plugin %s Allocated devices %s", dpi.deviceName, envVar[resourceNameEnvVar])
+		klog.InfoS("Allocated devices", "resource", dpi.resourceName(), "pciAddresses", allocatedDevices, "companions", companionDevices, "envVar", resourceNameEnvVar, "debug", event == audit.EventDebugAllocate)
 		containerResponse.Envs = envVar
 		resp.ContainerResponses = append(resp.ContainerResponses, containerResponse)
+
+		record := audit.Record{
+			Event:        event,
+			Resource:     dpi.resourceName(),
+			DeviceIDs:    request.DevicesIDs,
+			PCIAddresses: allocatedDevices,
+			Companions:   companionDevices,
+			Env:          envVar,
+		}
+		if len(unknownDevices) > 0 {
+			record.Error = fmt.Sprintf("unknown devices %s", strings.Join(unknownDevices, ", "))
+		}
+		dpi.audit.Record(record)
 	}
 	return resp, nil
 }
@@ -249,15 +507,140 @@ func (dpi *GenericDevicePlugin) cleanup() error {
 // GetDevicePluginOptions
 func (dpi *GenericDevicePlugin) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	options := &pluginapi.DevicePluginOptions{
-		PreStartRequired: false,
+		// the pod of the devices is audited once kubelet reports it, when the container starts
+		PreStartRequired: dpi.resetter != nil || dpi.audit != nil,
 	}
 	return options, nil
 }
 
-// PreStartContainer
+// PreStartContainer resets the devices allocated to the container when resets are enabled,
+// so a VM never receives a device carrying state from the previous VM. A failed reset fails
+// the container start. The devices are audited with the pod they are allocated to.
 func (dpi *GenericDevicePlugin) PreStartContainer(ctx context.Context, in *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	res := &pluginapi.PreStartContainerResponse{}
-	return res, nil
+	err := dpi.resetDevices(ctx, in.DevicesIDs)
+	dpi.auditPreStart(ctx, in.DevicesIDs, err)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+// resetDevices resets the devices of a starting container, if resets are enabled
+func (dpi *GenericDevicePlugin) resetDevices(ctx context.Context, devIDs []string) error {
+	if dpi.resetter == nil {
+		return nil
+	}
+	if err := dpi.guardReset(ctx, devIDs); err != nil {
+		klog.ErrorS(err, "Refusing to reset devices", "resource", dpi.resourceName(), "devices", devIDs)
+		return err
+	}
+	for _, devID := range devIDs {
+		devPCIAddress, exist := dpi.idToPCIMap[devID]
+		if !exist {
+			klog.ErrorS(nil, "Missing device mapping", "resource", dpi.resourceName(), "device", devID)
+			dpi.events.allocationFailed(dpi.resourceName(), devID)
+			return fmt.Errorf("unknown device %s of %s", devID, dpi.resourceName())
+		}
+		if err := dpi.resetter.Reset(ctx, devPCIAddress); err != nil {
+			klog.ErrorS(err, "Failed to reset device", "resource", dpi.resourceName(), "pciAddress", devPCIAddress, "method", dpi.resetter.Method)
+			dpi.events.resetFailed(dpi.resourceName(), devPCIAddress, err)
+			return err
+		}
+		klog.InfoS("Reset device before container start", "resource", dpi.resourceName(), "pciAddress", devPCIAddress, "method", dpi.resetter.Method)
+	}
+	return nil
+}
+
+// auditPreStart records the devices of a starting container and the pod kubelet allocated them to
+func (dpi *GenericDevicePlugin) auditPreStart(ctx context.Context, devIDs []string, err error) {
+	if dpi.audit == nil {
+		return
+	}
+	record := audit.Record{
+		Event:     audit.EventPreStart,
+		Resource:  dpi.resourceName(),
+		DeviceIDs: devIDs,
+		Pod:       dpi.lookupPod(ctx, devIDs),
+	}
+	for _, devID := range devIDs {
+		if devPCIAddress, exist := dpi.idToPCIMap[devID]; exist {
+			record.PCIAddresses = append(record.PCIAddresses, devPCIAddress)
+		}
+		for _, companionID := range dpi.companions[devID] {
+			_, companionPCIAddress := parseDeviceID(companionID)
+			record.Companions = append(record.Companions, companionPCIAddress)
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	dpi.audit.Record(record)
+}
+
+// lookupPod returns the container kubelet reports the devices allocated to, nil if it is unknown
+func (dpi *GenericDevicePlugin) lookupPod(ctx context.Context, devIDs []string) *audit.Pod {
+	if dpi.allocations == nil {
+		return nil
+	}
+	// guardReset refreshed the allocations when resets are enabled
+	if dpi.resetter == nil {
+		if err := dpi.allocations.Refresh(ctx); err != nil {
+			klog.ErrorS(err, "Could not look up the pod of the devices", "resource", dpi.resourceName())
+			return nil
+		}
+	}
+	for _, devID := range devIDs {
+		if allocation, ok := dpi.allocations.Lookup(devID); ok {
+			return &audit.Pod{
+				Namespace: allocation.Namespace,
+				Name:      allocation.Pod,
+				Container: allocation.Container,
+				VMI:       allocation.VMI,
+			}
+		}
+	}
+	return nil
+}
+
+// guardReset makes sure resetting the devices cannot disturb a running VM. Kubelet allocated the
+// devices of a PreStartContainer call to the container which is starting, so a device kubelet
+// reports held by a container which is already running, or by another pod than the other devices,
+// belongs to another VM.
+func (dpi *GenericDevicePlugin) guardReset(ctx context.Context, devIDs []string) error {
+	if dpi.allocations == nil {
+		return nil
+	}
+	if err := dpi.allocations.Refresh(ctx); err != nil {
+		// Without the PodResources API the devices are trusted to belong to the starting container
+		klog.ErrorS(err, "Could not check the device allocations before reset", "resource", dpi.resourceName())
+		return nil
+	}
+	var owner *podresources.Allocation
+	for _, devID := range devIDs {
+		allocation, ok := dpi.allocations.Lookup(devID)
+		if !ok {
+			continue
+		}
+		running, err := dpi.allocations.ContainerRunning(ctx, allocation)
+		if errors.Is(err, podresources.ErrNoPodClient) {
+			klog.V(2).InfoS("Could not check whether the container holding the device is running, the pods cannot be read", "resource", dpi.resourceName(), "pciAddress", allocation.PCIAddress)
+		} else if err != nil {
+			// Without the pod the device is trusted to belong to the starting container
+			klog.ErrorS(err, "Could not check whether the container holding the device is running", "resource", dpi.resourceName(), "pciAddress", allocation.PCIAddress)
+		} else if running {
+			return fmt.Errorf("device %s is held by container %s of pod %s/%s, which is running",
+				allocation.PCIAddress, allocation.Container, allocation.Namespace, allocation.Pod)
+		}
+		if owner == nil {
+			owner = &allocation
+			continue
+		}
+		if allocation.Namespace != owner.Namespace || allocation.Pod != owner.Pod {
+			return fmt.Errorf("device %s is allocated to pod %s/%s while device %s is allocated to pod %s/%s",
+				allocation.PCIAddress, allocation.Namespace, allocation.Pod, owner.PCIAddress, owner.Namespace, owner.Pod)
+		}
+	}
+	return nil
 }
 
 // GetPreferredAllocation
@@ -266,77 +649,153 @@ func (dpi *GenericDevicePlugin) GetPreferredAllocation(ctx context.Context, in *
 }
 
 // Health check for devices
-func (dpi *GenericDevicePlugin) healthCheck() error {
-	method := fmt.Sprintf("healthCheck(%s)", dpi.deviceName)
-	log.Printf("%s: invoked", method)
+func (dpi *GenericDevicePlugin) healthCheck(ctx context.Context, stop <-chan struct{}) error {
+	klog.V(2).InfoS("Health check started", "resource", dpi.resourceName())
 	var pathDeviceMap = make(map[string]string)
 	var path = dpi.devicePath
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Printf("%s: Unable to create fsnotify watcher: %v", method, err)
+		klog.ErrorS(err, "Unable to create fsnotify watcher", "resource", dpi.resourceName())
 		return err
 	}
 	defer watcher.Close()
 
+	// The device plugin directory holds both the plugin socket and kubelet.sock
 	err = watcher.Add(filepath.Dir(dpi.socketPath))
 	if err != nil {
-		log.Printf("%s: Unable to add device plugin socket path to fsnotify watcher: %v", method, err)
+		klog.ErrorS(err, "Unable to add device plugin socket path to fsnotify watcher", "resource", dpi.resourceName(), "path", filepath.Dir(dpi.socketPath))
 		return err
 	}
 
 	err = watcher.Add(path)
 	if err != nil {
-		log.Printf("%s: Unable to add %s to fsnotify watcher: %v", method, path, err)
+		klog.ErrorS(err, "Unable to add device path to fsnotify watcher", "resource", dpi.resourceName(), "path", path)
 		return err
 	}
 
 	_, err = os.Stat(path)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			log.Printf("%s: Unable to stat device: %v", method, err)
+			klog.ErrorS(err, "Unable to stat device", "resource", dpi.resourceName(), "path", path)
 			return err
 		}
 	}
 
 	for _, dev := range dpi.devs {
-		iommuGroup := strings.Split(dev.ID, deviceIDSeparator)[0]
+		iommuGroup, _ := parseDeviceID(dev.ID)
 		devicePath := filepath.Join(path, iommuGroup)
 		watcher.Add(devicePath)
 		pathDeviceMap[devicePath] = dev.ID
 	}
 
+	// the health check is counted running once it watches the devices
+	dpi.healthChecks.Add(1)
+	defer dpi.healthChecks.Add(-1)
 	for {
 		select {
-		case <-dpi.stop:
+		case <-stop:
+			return nil
+		case <-ctx.Done():
 			return nil
-		case err := <-watcher.Errors:
-			log.Printf("Error watching devices and device plugin directory: %v", err)
-		case event := <-watcher.Events:
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errWatcherClosed
+			}
+			klog.ErrorS(err, "Error watching devices and device plugin directory", "resource", dpi.resourceName())
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errWatcherClosed
+			}
 			v, ok := pathDeviceMap[event.Name]
 			if ok {
 				// Health in this case is if the device path actually exists
 				if event.Op == fsnotify.Create {
-					log.Printf("%s: Monitored device %s appeared", method, event.Name)
-					dpi.healthy <- v
+					iommuGroup, pciAddress := parseDeviceID(v)
+					klog.InfoS("Monitored device appeared", "resource", dpi.resourceName(), "pciAddress", pciAddress, "iommuGroup", iommuGroup, "path", event.Name)
+					dpi.events.deviceAppeared(dpi.resourceName(), pciAddress)
+					dpi.inventory.SetHealth(pciAddress, pluginapi.Healthy, "")
+					dpi.setDeviceHealth(v, pluginapi.Healthy)
 				} else if (event.Op == fsnotify.Remove) || (event.Op == fsnotify.Rename) {
-					log.Printf("%s: Monitored device %s disappeared", method, event.Name)
-					dpi.unhealthy <- v
+					iommuGroup, pciAddress := parseDeviceID(v)
+					klog.InfoS("Monitored device disappeared", "resource", dpi.resourceName(), "pciAddress", pciAddress, "iommuGroup", iommuGroup, "path", event.Name)
+					// Marking the device unhealthy is not guarded, the container holding it is
+					// recorded instead so the operators know which VM lost it
+					cause := fmt.Sprintf("%s was removed", event.Name)
+					holder := ""
+					if allocation, ok := dpi.allocations.Lookup(v); ok {
+						klog.InfoS("Disappeared device is allocated", "resource", dpi.resourceName(), "pciAddress", pciAddress, "pod", klog.KRef(allocation.Namespace, allocation.Pod), "vmi", allocation.VMI)
+						holder = describeHolder(allocation)
+						cause += " while allocated to " + holder
+					}
+					dpi.events.deviceDisappeared(dpi.resourceName(), pciAddress, holder)
+					dpi.inventory.SetHealth(pciAddress, pluginapi.Unhealthy, cause)
+					dpi.setDeviceHealth(v, pluginapi.Unhealthy)
 				}
+			} else if event.Name == dpi.kubeletSocket && event.Op&fsnotify.Create != 0 {
+				klog.InfoS("Kubelet socket was created, kubelet restarted. Re-registering device plugin", "resource", dpi.resourceName())
+				dpi.requestRegistration()
 			} else if event.Name == dpi.socketPath && event.Op == fsnotify.Remove {
-				log.Printf("%s: Socket path for GPU device was removed, kubelet likely restarted", method)
-				// Trigger restart of the DP servers
-				if err := dpi.restart(); err != nil {
-					log.Printf("%s: Unable to restart server %v", method, err)
-					return err
-				}
-				log.Printf("%s: Successfully restarted %s device plugin server. Terminating.", method, dpi.deviceName)
-				return nil
+				klog.InfoS("Device plugin socket was removed, kubelet likely restarted", "resource", dpi.resourceName(), "socket", dpi.socketPath)
+				// The supervisor restarts the whole plugin, recreating the socket and re-registering
+				return errSocketRemoved
 			}
 		}
 	}
 }
 
+// describeHolder describes the container a device is allocated to, e.g.
+// pod vms/virt-launcher-gpu-vm-x7k2p (VMI gpu-vm)
+func describeHolder(allocation podresources.Allocation) string {
+	holder := fmt.Sprintf("pod %s/%s", allocation.Namespace, allocation.Pod)
+	if allocation.VMI != "" {
+		holder += fmt.Sprintf(" (VMI %s)", allocation.VMI)
+	}
+	return holder
+}
+
+// ready returns an error unless the plugin is serving and registered with kubelet
+func (dpi *GenericDevicePlugin) ready() error {
+	if !dpi.serving.Load() {
+		return fmt.Errorf("%s: gRPC server is not serving", dpi.deviceName)
+	}
+	if !dpi.registered.Load() {
+		return fmt.Errorf("%s: not registered with kubelet", dpi.deviceName)
+	}
+	return nil
+}
+
+// alive returns an error if a serving plugin lost one of its internal goroutines.
+// Plugins which are not serving have nothing to monitor and are reported by ready.
+// Kubelet opens the ListAndWatch stream shortly after the registration, a plugin without
+// stream is only reported once listAndWatchGracePeriod passed since it registered.
+func (dpi *GenericDevicePlugin) alive() error {
+	if !dpi.serving.Load() {
+		return nil
+	}
+	if dpi.healthChecks.Load() == 0 {
+		return fmt.Errorf("%s: health check is not running", dpi.deviceName)
+	}
+	if dpi.registered.Load() && dpi.listAndWatchStreams.Load() == 0 {
+		registeredAt := time.Unix(0, dpi.registeredAt.Load())
+		if time.Since(registeredAt) > listAndWatchGracePeriod {
+			return fmt.Errorf("%s: no ListAndWatch stream is open %s after the registration", dpi.deviceName, time.Since(registeredAt).Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// formatDeviceID returns the plugin device ID of a PCI function, its IOMMU group and PCI address
+func formatDeviceID(device devicesource.PCIDevice) string {
+	return device.IOMMUGroup + deviceIDSeparator + device.PCIAddress
+}
+
+// parseDeviceID splits a plugin device ID into its IOMMU group and PCI address
+func parseDeviceID(devID string) (iommuGroup string, pciAddress string) {
+	iommuGroup, pciAddress, _ = strings.Cut(devID, deviceIDSeparator)
+	return iommuGroup, pciAddress
+}
+
 func formatDeviceSpecs(devID string) []*pluginapi.DeviceSpec {
 	// always add /dev/vfio/vfio device as well
 	devSpecs := make([]*pluginapi.DeviceSpec, 0)
@@ -345,7 +804,7 @@ func formatDeviceSpecs(devID string) []*pluginapi.DeviceSpec {
 		ContainerPath: filepath.Join(vfioDevicePath, "vfio"),
 		Permissions:   "mrw",
 	})
-	iommuGroup := strings.Split(devID, deviceIDSeparator)[0]
+	iommuGroup, _ := parseDeviceID(devID)
 	vfioDevice := filepath.Join(vfioDevicePath, iommuGroup)
 	devSpecs = append(devSpecs, &pluginapi.DeviceSpec{
 		HostPath:      vfioDevice,
@@ -354,3 +813,66 @@ func formatDeviceSpecs(devID string) []*pluginapi.DeviceSpec {
 	})
 	return devSpecs
 }
+
+// companionGroups returns the IOMMU groups of the companions of a device which differ from the
+// group of the device, the companions usually share the group of their GPU
+func (dpi *GenericDevicePlugin) companionGroups(devID string) []string {
+	iommuGroup, _ := parseDeviceID(devID)
+	var groups []string
+	for _, companionID := range dpi.companions[devID] {
+		companionGroup, _ := parseDeviceID(companionID)
+		if companionGroup != iommuGroup && !slices.Contains(groups, companionGroup) {
+			groups = append(groups, companionGroup)
+		}
+	}
+	return groups
+}
+
+// companionDeviceSpecs returns the VFIO group devices of the companions of a device outside its IOMMU group
+func (dpi *GenericDevicePlugin) companionDeviceSpecs(devID string) []*pluginapi.DeviceSpec {
+	var devSpecs []*pluginapi.DeviceSpec
+	for _, group := range dpi.companionGroups(devID) {
+		vfioDevice := filepath.Join(vfioDevicePath, group)
+		devSpecs = append(devSpecs, &pluginapi.DeviceSpec{
+			HostPath:      vfioDevice,
+			ContainerPath: vfioDevice,
+			Permissions:   "mrw",
+		})
+	}
+	return devSpecs
+}
+
+// cdiKind returns the CDI kind of the devices, the resource name with the device name made a valid CDI class
+func (dpi *GenericDevicePlugin) cdiKind() string {
+	return dpi.namespace + "/" + cdi.Class(dpi.deviceName)
+}
+
+// writeCDISpec describes every device of the plugin, named after its PCI address, in a CDI spec file.
+// The KubeVirt env var lists all the devices allocated to a container, so it is returned by Allocate
+// instead of being fixed in the spec.
+func (dpi *GenericDevicePlugin) writeCDISpec() error {
+	if dpi.cdiRoot == "" {
+		return nil
+	}
+	spec := &cdi.Spec{
+		Version: cdi.Version,
+		Kind:    dpi.cdiKind(),
+	}
+	for _, dev := range dpi.devs {
+		iommuGroup, pciAddress := parseDeviceID(dev.ID)
+		deviceNodes := cdi.VFIODeviceNodes(iommuGroup)
+		for _, group := range dpi.companionGroups(dev.ID) {
+			deviceNodes = append(deviceNodes, cdi.VFIOGroupDeviceNode(group))
+		}
+		spec.Devices = append(spec.Devices, cdi.Device{
+			Name:           pciAddress,
+			ContainerEdits: cdi.ContainerEdits{DeviceNodes: deviceNodes},
+		})
+	}
+	name := strings.ReplaceAll(dpi.cdiKind(), "/", "-")
+	if err := cdi.WriteSpec(dpi.cdiRoot, name, spec); err != nil {
+		return err
+	}
+	klog.InfoS("Wrote CDI spec", "resource", dpi.resourceName(), "kind", spec.Kind, "devices", len(spec.Devices), "dir", dpi.cdiRoot)
+	return nil
+}
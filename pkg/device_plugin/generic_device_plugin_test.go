@@ -0,0 +1,418 @@
+package device_plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"kubevirt-nvidia-device-plugin/pkg/audit"
+	"kubevirt-nvidia-device-plugin/pkg/cdi"
+	"kubevirt-nvidia-device-plugin/pkg/device_plugin"
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+	"kubevirt-nvidia-device-plugin/pkg/pcireset"
+	"kubevirt-nvidia-device-plugin/pkg/podresources"
+)
+
+const (
+	testResource = "nvidia.com/GH100_H100_SXM5_80GB"
+	testDeviceID = "42|0000:1b:00.0"
+)
+
+// listAndWatch opens a ListAndWatch stream to the plugin serving socketPath, like kubelet does
+func listAndWatch(ctx context.Context, socketPath string) pluginapi.DevicePlugin_ListAndWatchClient {
+	client, conn, err := device_plugin.DialDevicePlugin(socketPath, 5*time.Second)
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(conn.Close)
+	stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+	Expect(err).NotTo(HaveOccurred())
+	return stream
+}
+
+// shortTempDir returns a temporary directory whose sockets fit the 108 bytes limit of unix socket paths
+func shortTempDir() string {
+	dir, err := os.MkdirTemp("", "dp")
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(os.RemoveAll, dir)
+	return dir
+}
+
+// newTestPlugin returns a plugin of testResource serving in dir, with the VFIO group of its
+// device in dir/vfio
+func newTestPlugin(dir string) *device_plugin.GenericDevicePlugin {
+	vfioDir := filepath.Join(dir, "vfio")
+	Expect(os.Mkdir(vfioDir, 0755)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(vfioDir, "42"), nil, 0644)).To(Succeed())
+	return device_plugin.NewTestDevicePlugin(dir, "nvidia.com", "GH100_H100_SXM5_80GB", vfioDir,
+		[]*pluginapi.Device{{ID: testDeviceID, Health: pluginapi.Healthy}},
+		map[string]string{testDeviceID: "0000:1b:00.0"})
+}
+
+var _ = Describe("GenericDevicePlugin", func() {
+	var (
+		dir     string
+		vfioDir string
+		kubelet *fakeKubelet
+		dp      *device_plugin.GenericDevicePlugin
+	)
+
+	BeforeEach(func() {
+		dir = shortTempDir()
+		vfioDir = filepath.Join(dir, "vfio")
+		kubelet = startFakeKubelet(dir)
+		DeferCleanup(kubelet.stop)
+
+		dp = newTestPlugin(dir)
+		ctx, cancel := context.WithCancel(context.Background())
+		Expect(dp.Start(ctx)).To(Succeed())
+		DeferCleanup(func() {
+			cancel()
+			Expect(dp.Stop()).To(Succeed())
+		})
+	})
+
+	Context("probes", func() {
+		It("reports the plugin ready once it is registered with kubelet", func() {
+			Eventually(dp.Ready).Should(Succeed())
+			Expect(kubelet.Registrations()).To(ConsistOf(testResource))
+		})
+
+		It("reports the plugin alive while kubelet has yet to open the ListAndWatch stream", func() {
+			Eventually(dp.Ready).Should(Succeed())
+			Expect(dp.ListAndWatchStreams()).To(BeZero())
+			Expect(dp.Alive()).To(Succeed())
+		})
+
+		It("reports the plugin dead when kubelet does not open the ListAndWatch stream", func() {
+			DeferCleanup(device_plugin.SetListAndWatchGracePeriod(100 * time.Millisecond))
+			Eventually(dp.Ready).Should(Succeed())
+			Eventually(dp.Alive).Should(MatchError(ContainSubstring("no ListAndWatch stream is open")))
+
+			stream := listAndWatch(context.Background(), dp.SocketPath())
+			_, err := stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dp.Alive()).To(Succeed())
+		})
+
+		It("reports the plugin dead once kubelet closed the ListAndWatch stream", func() {
+			DeferCleanup(device_plugin.SetListAndWatchGracePeriod(100 * time.Millisecond))
+			Eventually(dp.Ready).Should(Succeed())
+			ctx, cancel := context.WithCancel(context.Background())
+			stream := listAndWatch(ctx, dp.SocketPath())
+			_, err := stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dp.Alive()).To(Succeed())
+
+			cancel()
+			Eventually(dp.ListAndWatchStreams).Should(BeZero())
+			Eventually(dp.Alive).Should(MatchError(ContainSubstring("no ListAndWatch stream is open")))
+		})
+	})
+
+	Context("health check", func() {
+		It("re-registers with a restarted kubelet after health changes no stream received", func() {
+			Eventually(dp.Ready).Should(Succeed())
+			Eventually(dp.Alive).Should(Succeed(), "the health check watches the devices")
+			Expect(dp.ListAndWatchStreams()).To(BeZero())
+
+			Expect(os.Remove(filepath.Join(vfioDir, "42"))).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(vfioDir, "42"), nil, 0644)).To(Succeed())
+			Expect(os.Remove(filepath.Join(vfioDir, "42"))).To(Succeed())
+
+			kubelet.stop()
+			restarted := startFakeKubelet(dir)
+			DeferCleanup(restarted.stop)
+			Eventually(restarted.Registrations).Should(ConsistOf(testResource))
+
+			// the stream kubelet opens after the registration gets the latest health
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			DeferCleanup(cancel)
+			resp, err := listAndWatch(ctx, dp.SocketPath()).Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Devices[0].Health).To(Equal(pluginapi.Unhealthy))
+		})
+	})
+
+	Context("ListAndWatch", func() {
+		It("ends the stream when kubelet cancels it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			stream := listAndWatch(ctx, dp.SocketPath())
+			resp, err := stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Devices).To(HaveLen(1))
+			Expect(dp.ListAndWatchStreams()).To(Equal(1))
+
+			cancel()
+			Eventually(dp.ListAndWatchStreams).Should(BeZero())
+		})
+
+		It("ends the stream when the client closes its connection without cancelling it", func() {
+			// the allocate command closes its connection once it listed the devices
+			client, conn, err := device_plugin.DialDevicePlugin(dp.SocketPath(), 5*time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			stream, err := client.ListAndWatch(context.Background(), &pluginapi.Empty{})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dp.ListAndWatchStreams()).To(Equal(1))
+
+			Expect(conn.Close()).To(Succeed())
+			Eventually(dp.ListAndWatchStreams).Should(BeZero())
+		})
+
+		It("sends the health changes to the stream opened after a closed one", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			closed := listAndWatch(ctx, dp.SocketPath())
+			_, err := closed.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			cancel()
+			Eventually(dp.ListAndWatchStreams).Should(BeZero())
+
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+			DeferCleanup(cancel)
+			stream := listAndWatch(ctx, dp.SocketPath())
+			resp, err := stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Devices[0].Health).To(Equal(pluginapi.Healthy))
+
+			Expect(os.Remove(filepath.Join(vfioDir, "42"))).To(Succeed())
+			resp, err = stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Devices[0].ID).To(Equal(testDeviceID))
+			Expect(resp.Devices[0].Health).To(Equal(pluginapi.Unhealthy))
+		})
+	})
+})
+
+var _ = Describe("Allocate", func() {
+	const (
+		resourceEnvVar   = "PCI_RESOURCE_NVIDIA_COM_GH100_H100_SXM5_80GB"
+		companionsEnvVar = resourceEnvVar + "_COMPANIONS"
+		secondDeviceID   = "84|0000:9a:00.0"
+	)
+
+	var (
+		dp       *device_plugin.GenericDevicePlugin
+		auditLog string
+	)
+
+	BeforeEach(func() {
+		auditLog = filepath.Join(GinkgoT().TempDir(), "audit.log")
+		logger, err := audit.NewLogger(audit.Config{Path: auditLog})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(logger.Close)
+
+		dp = device_plugin.NewTestDevicePlugin(shortTempDir(), "nvidia.com", "GH100_H100_SXM5_80GB", "/dev/vfio",
+			[]*pluginapi.Device{{ID: testDeviceID, Health: pluginapi.Healthy}, {ID: secondDeviceID, Health: pluginapi.Healthy}},
+			map[string]string{testDeviceID: "0000:1b:00.0", secondDeviceID: "0000:9a:00.0"})
+		dp.SetCompanions(map[string][]string{
+			testDeviceID:   {"42|0000:1b:00.1"},
+			secondDeviceID: {"85|0000:9a:00.1"},
+		})
+		dp.SetAudit(logger)
+	})
+
+	hostPaths := func(specs []*pluginapi.DeviceSpec) []string {
+		var paths []string
+		for _, spec := range specs {
+			paths = append(paths, spec.HostPath)
+		}
+		return paths
+	}
+
+	It("hands out the devices and companions of each container only", func() {
+		resp, err := dp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{testDeviceID}},
+				{DevicesIDs: []string{secondDeviceID}},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.ContainerResponses).To(HaveLen(2))
+		Expect(resp.ContainerResponses[0].Envs).To(Equal(map[string]string{
+			resourceEnvVar:   "0000:1b:00.0",
+			companionsEnvVar: "0000:1b:00.1",
+		}))
+		Expect(hostPaths(resp.ContainerResponses[0].Devices)).To(ConsistOf("/dev/vfio/vfio", "/dev/vfio/42"))
+		Expect(resp.ContainerResponses[1].Envs).To(Equal(map[string]string{
+			resourceEnvVar:   "0000:9a:00.0",
+			companionsEnvVar: "0000:9a:00.1",
+		}))
+		Expect(hostPaths(resp.ContainerResponses[1].Devices)).To(ConsistOf("/dev/vfio/vfio", "/dev/vfio/84", "/dev/vfio/85"))
+	})
+
+	It("audits the devices of each container only", func() {
+		_, err := dp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{testDeviceID}},
+				{DevicesIDs: []string{secondDeviceID}},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		records, err := audit.Read(auditLog)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Event).To(Equal(audit.EventAllocate))
+		Expect(records[0].PCIAddresses).To(Equal([]string{"0000:1b:00.0"}))
+		Expect(records[0].Companions).To(Equal([]string{"0000:1b:00.1"}))
+		Expect(records[1].Event).To(Equal(audit.EventAllocate))
+		Expect(records[1].PCIAddresses).To(Equal([]string{"0000:9a:00.0"}))
+		Expect(records[1].Companions).To(Equal([]string{"0000:9a:00.1"}))
+	})
+
+	It("hands out CDI devices of a valid kind when the resource is named after the device ID", func() {
+		cdiRoot := GinkgoT().TempDir()
+		dp = device_plugin.NewTestDevicePlugin(shortTempDir(), "nvidia.com", "2335", "/dev/vfio",
+			[]*pluginapi.Device{{ID: testDeviceID, Health: pluginapi.Healthy}},
+			map[string]string{testDeviceID: "0000:1b:00.0"})
+		dp.SetCDIRoot(cdiRoot)
+		Expect(dp.WriteCDISpec()).To(Succeed())
+
+		data, err := os.ReadFile(filepath.Join(cdiRoot, "nvidia.com-pci_2335.json"))
+		Expect(err).NotTo(HaveOccurred())
+		spec := &cdi.Spec{}
+		Expect(json.Unmarshal(data, spec)).To(Succeed())
+		Expect(spec.Kind).To(Equal("nvidia.com/pci_2335"))
+
+		resp, err := dp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{testDeviceID}}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.ContainerResponses[0].CDIDevices).To(Equal([]*pluginapi.CDIDevice{{Name: "nvidia.com/pci_2335=0000:1b:00.0"}}))
+		Expect(resp.ContainerResponses[0].Envs).To(HaveKeyWithValue("PCI_RESOURCE_NVIDIA_COM_2335", "0000:1b:00.0"))
+	})
+
+	It("audits the calls of debugging clients apart from the allocations of kubelet", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		Expect(dp.Start(ctx)).To(Succeed())
+		DeferCleanup(dp.Stop)
+
+		client, conn, err := device_plugin.DialDevicePlugin(dp.SocketPath(), 5*time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+		_, err = client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{testDeviceID}}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		records, err := audit.Read(auditLog)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Event).To(Equal(audit.EventDebugAllocate))
+		Expect(records[0].PCIAddresses).To(Equal([]string{"0000:1b:00.0"}))
+	})
+})
+
+// podResourcesLister reports the test device allocated to the compute container of a pod, like the
+// PodResources API of kubelet
+type podResourcesLister struct {
+	podresourcesapi.PodResourcesListerClient
+	pod string
+}
+
+func (l *podResourcesLister) List(ctx context.Context, in *podresourcesapi.ListPodResourcesRequest, opts ...grpc.CallOption) (*podresourcesapi.ListPodResourcesResponse, error) {
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: []*podresourcesapi.PodResources{{
+		Namespace: "vms",
+		Name:      l.pod,
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name:    "compute",
+			Devices: []*podresourcesapi.ContainerDevices{{ResourceName: testResource, DeviceIds: []string{testDeviceID}}},
+		}},
+	}}}, nil
+}
+
+// launcherPod returns a virt-launcher pod whose compute container is in the given state
+func launcherPod(name string, state corev1.ContainerState) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "vms", Name: name},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "compute", State: state},
+		}},
+	}
+}
+
+var _ = Describe("PreStartContainer", func() {
+	var (
+		dp        *device_plugin.GenericDevicePlugin
+		resetFile string
+	)
+
+	// withOwner makes kubelet report the test device held by the pod
+	withOwner := func(pod string) {
+		tracker := podresources.NewTracker(&podResourcesLister{pod: pod}, map[string]string{testDeviceID: "0000:1b:00.0"})
+		tracker.SetPodClient(fake.NewSimpleClientset(
+			launcherPod("virt-launcher-old-vm-abcde", corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}),
+			launcherPod("virt-launcher-new-vm-fghij", corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}),
+		))
+		dp.SetAllocations(tracker)
+	}
+
+	BeforeEach(func() {
+		dir := shortTempDir()
+		dp = newTestPlugin(dir)
+
+		sysfs := filepath.Join(dir, "sys")
+		devicePath := filepath.Join(sysfs, "0000:1b:00.0")
+		Expect(os.MkdirAll(devicePath, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(devicePath, "config"), []byte("\xde\x10\x30\x23"), 0644)).To(Succeed())
+		resetFile = filepath.Join(devicePath, "reset")
+		Expect(os.WriteFile(resetFile, nil, 0644)).To(Succeed())
+		dp.SetResetter(pcireset.New(sysfs, pcireset.MethodAuto))
+	})
+
+	It("resets a device held by the container which is starting", func() {
+		withOwner("virt-launcher-new-vm-fghij")
+		_, err := dp.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: []string{testDeviceID}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.ReadFile(resetFile)).To(BeEquivalentTo("1"))
+	})
+
+	It("refuses to reset a device held by the running container of another pod", func() {
+		withOwner("virt-launcher-old-vm-abcde")
+		_, err := dp.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: []string{testDeviceID}})
+		Expect(err).To(MatchError(ContainSubstring("held by container compute of pod vms/virt-launcher-old-vm-abcde, which is running")))
+		Expect(os.ReadFile(resetFile)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Health check", func() {
+	It("records the pod holding a device which disappeared", func() {
+		dir := shortTempDir()
+		kubelet := startFakeKubelet(dir)
+		DeferCleanup(kubelet.stop)
+		dp := newTestPlugin(dir)
+
+		inv := inventory.New(nil, "node-1")
+		inv.SetDevices([]inventory.Device{{PCIAddress: "0000:1b:00.0", Health: pluginapi.Healthy}})
+		dp.SetInventory(inv)
+		tracker := podresources.NewTracker(&podResourcesLister{pod: "virt-launcher-gpu-vm-x7k2p"}, map[string]string{testDeviceID: "0000:1b:00.0"})
+		Expect(tracker.Refresh(context.Background())).To(Succeed())
+		dp.SetAllocations(tracker)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Expect(dp.Start(ctx)).To(Succeed())
+		DeferCleanup(func() {
+			cancel()
+			Expect(dp.Stop()).To(Succeed())
+		})
+
+		Eventually(dp.Alive).Should(Succeed(), "the health check watches the devices")
+		Expect(os.Remove(filepath.Join(dir, "vfio", "42"))).To(Succeed())
+		Eventually(inv.Devices).Should(ConsistOf(And(
+			HaveField("Health", pluginapi.Unhealthy),
+			HaveField("LastError", HaveSuffix("42 was removed while allocated to pod vms/virt-launcher-gpu-vm-x7k2p (VMI gpu-vm)")),
+		)))
+	})
+})
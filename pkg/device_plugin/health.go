@@ -0,0 +1,115 @@
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	klog "k8s.io/klog/v2"
+
+	"kubevirt-nvidia-device-plugin/pkg/dra"
+	"kubevirt-nvidia-device-plugin/pkg/metrics"
+)
+
+// healthServer serves the liveness and readiness endpoints probed by the kubelet
+// as well as the Prometheus metrics
+type healthServer struct {
+	mu          sync.RWMutex
+	supervisors []*supervisor
+	driver      *dra.Driver
+	discovered  bool
+	server      *http.Server
+}
+
+func newHealthServer(address string) *healthServer {
+	hs := &healthServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", hs.handleHealthz)
+	mux.HandleFunc("/readyz", hs.handleReadyz)
+	mux.Handle("/metrics", metrics.Handler())
+	hs.server = &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+	return hs
+}
+
+// start serves the probe endpoints in the background
+func (hs *healthServer) start() {
+	go func() {
+		klog.InfoS("Serving health probes and metrics", "address", hs.server.Addr)
+		if err := hs.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.ErrorS(err, "Health probe server failed", "address", hs.server.Addr)
+		}
+	}()
+}
+
+// stop shuts the probe server down
+func (hs *healthServer) stop(ctx context.Context) error {
+	return hs.server.Shutdown(ctx)
+}
+
+// setSupervisors records the supervisors of the device plugins created for the discovered devices
+func (hs *healthServer) setSupervisors(supervisors []*supervisor) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.supervisors = supervisors
+	hs.discovered = true
+}
+
+// setDriver records the DRA driver serving the discovered devices
+func (hs *healthServer) setDriver(driver *dra.Driver) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.driver = driver
+	hs.discovered = true
+}
+
+// handleHealthz reports whether the internal goroutines of every serving plugin are alive
+func (hs *healthServer) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	var failures []string
+	for _, s := range hs.supervisors {
+		if err := s.alive(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	writeProbeResult(w, failures)
+}
+
+// handleReadyz reports whether every discovered plugin is serving and registered with kubelet
+func (hs *healthServer) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	var failures []string
+	if !hs.discovered {
+		failures = append(failures, "device discovery has not completed")
+	}
+	for _, s := range hs.supervisors {
+		if err := s.ready(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if hs.driver != nil {
+		if err := hs.driver.Ready(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	writeProbeResult(w, failures)
+}
+
+func writeProbeResult(w http.ResponseWriter, failures []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failures, "\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,57 @@
+package device_plugin_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeKubelet serves the device plugin registration service in a directory, like kubelet does in
+// /var/lib/kubelet/device-plugins
+type fakeKubelet struct {
+	dir    string
+	server *grpc.Server
+
+	mu            sync.Mutex
+	registrations []*pluginapi.RegisterRequest
+}
+
+func startFakeKubelet(dir string) *fakeKubelet {
+	k := &fakeKubelet{dir: dir}
+	socket := filepath.Join(dir, filepath.Base(pluginapi.KubeletSocket))
+	Expect(os.RemoveAll(socket)).To(Succeed())
+	listener, err := net.Listen("unix", socket)
+	Expect(err).NotTo(HaveOccurred())
+	k.server = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(listener)
+	return k
+}
+
+func (k *fakeKubelet) Register(_ context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.registrations = append(k.registrations, r)
+	return &pluginapi.Empty{}, nil
+}
+
+// Registrations returns the resource names of the registrations received so far
+func (k *fakeKubelet) Registrations() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var resources []string
+	for _, r := range k.registrations {
+		resources = append(resources, r.ResourceName)
+	}
+	return resources
+}
+
+func (k *fakeKubelet) stop() {
+	k.server.Stop()
+}
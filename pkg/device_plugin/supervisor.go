@@ -0,0 +1,183 @@
+package device_plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+
+	"kubevirt-nvidia-device-plugin/pkg/backoff"
+	"kubevirt-nvidia-device-plugin/pkg/metrics"
+)
+
+const (
+	componentServer      = "server"
+	componentHealthCheck = "healthCheck"
+
+	// a component which stayed up this long starts over with the initial restart delay
+	backoffResetInterval = 5 * time.Minute
+)
+
+var (
+	errSocketRemoved = errors.New("device plugin socket was removed")
+	errWatcherClosed = errors.New("fsnotify watcher was closed")
+)
+
+// pluginFailure reports a device plugin component which exited unexpectedly
+type pluginFailure struct {
+	component string
+	err       error
+}
+
+type pluginState string
+
+const (
+	stateStarting   pluginState = "Starting"
+	stateRunning    pluginState = "Running"
+	stateRestarting pluginState = "Restarting"
+	stateStopped    pluginState = "Stopped"
+)
+
+var pluginStates = []pluginState{stateStarting, stateRunning, stateRestarting, stateStopped}
+
+// supervisor keeps the gRPC server and the health check of a device plugin running.
+// Whichever component exits unexpectedly is restarted with exponential backoff.
+type supervisor struct {
+	dp *GenericDevicePlugin
+
+	mu          sync.RWMutex
+	state       pluginState
+	restarts    int
+	lastFailure error
+}
+
+func newSupervisor(dp *GenericDevicePlugin) *supervisor {
+	s := &supervisor{dp: dp}
+	s.setState(stateStarting)
+	return s
+}
+
+// run starts the device plugin and restarts its components until ctx is cancelled.
+// Stopping the plugin itself is left to the caller.
+func (s *supervisor) run(ctx context.Context) {
+	defer s.setState(stateStopped)
+
+	klog.InfoS("Starting device plugin", "resource", s.dp.resourceName())
+	if err := s.start(ctx); err != nil {
+		return
+	}
+	s.setState(stateRunning)
+
+	backoffs := map[string]*wait.Backoff{
+		componentServer:      backoff.New(),
+		componentHealthCheck: backoff.New(),
+	}
+	lastRestart := map[string]time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case failure := <-s.dp.failures:
+			klog.ErrorS(failure.err, "Device plugin component exited unexpectedly", "resource", s.dp.resourceName(), "component", failure.component)
+			s.recordFailure(failure)
+
+			if time.Since(lastRestart[failure.component]) > backoffResetInterval {
+				backoffs[failure.component] = backoff.New()
+			}
+			delay := backoffs[failure.component].Step()
+			klog.InfoS("Restarting device plugin component", "resource", s.dp.resourceName(), "component", failure.component, "delay", delay.Round(time.Millisecond))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+
+			if err := s.restart(ctx, failure.component); err != nil {
+				return
+			}
+			lastRestart[failure.component] = time.Now()
+			metrics.PluginRestarts.WithLabelValues(s.dp.resourceName(), failure.component).Inc()
+			s.setState(stateRunning)
+		}
+	}
+}
+
+// start starts the plugin until it succeeds or ctx is cancelled.
+// Whatever was started by a failed attempt is released before the next one.
+func (s *supervisor) start(ctx context.Context) error {
+	return retryWithBackoff(ctx, nil, "start device plugin", func() error {
+		if err := s.dp.Start(ctx); err != nil {
+			s.dp.Stop()
+			return err
+		}
+		return nil
+	}, "resource", s.dp.resourceName())
+}
+
+// restart restarts the failed component. A failed server takes down the whole plugin,
+// since the health check and registration are bound to the server instance.
+func (s *supervisor) restart(ctx context.Context, component string) error {
+	if component == componentHealthCheck {
+		s.dp.startHealthCheck()
+		return nil
+	}
+	if err := s.dp.Stop(); err != nil {
+		klog.ErrorS(err, "Error stopping device plugin", "resource", s.dp.resourceName())
+	}
+	// Failures reported by the stopped server instance are stale now
+	for len(s.dp.failures) > 0 {
+		<-s.dp.failures
+	}
+	return s.start(ctx)
+}
+
+func (s *supervisor) recordFailure(failure pluginFailure) {
+	s.mu.Lock()
+	s.restarts++
+	s.lastFailure = fmt.Errorf("%s: %w", failure.component, failure.err)
+	s.mu.Unlock()
+	s.setState(stateRestarting)
+}
+
+func (s *supervisor) setState(state pluginState) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+
+	for _, st := range pluginStates {
+		value := 0.0
+		if st == state {
+			value = 1
+		}
+		metrics.PluginState.WithLabelValues(s.dp.resourceName(), string(st)).Set(value)
+	}
+}
+
+// ready returns an error unless the plugin is running, serving and registered with kubelet
+func (s *supervisor) ready() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.state != stateRunning {
+		if s.lastFailure != nil {
+			return fmt.Errorf("%s: device plugin is %s after %d restarts, last failure: %v", s.dp.deviceName, s.state, s.restarts, s.lastFailure)
+		}
+		return fmt.Errorf("%s: device plugin is %s", s.dp.deviceName, s.state)
+	}
+	return s.dp.ready()
+}
+
+// alive returns an error if the running plugin lost one of its goroutines.
+// Components being restarted by the supervisor are not reported.
+func (s *supervisor) alive() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.state != stateRunning {
+		return nil
+	}
+	return s.dp.alive()
+}
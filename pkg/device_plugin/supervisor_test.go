@@ -0,0 +1,60 @@
+package device_plugin_test
+
+import (
+	"context"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/device_plugin"
+)
+
+var _ = Describe("supervisor", func() {
+	var (
+		kubelet    *fakeKubelet
+		dp         *device_plugin.GenericDevicePlugin
+		supervisor *device_plugin.Supervisor
+	)
+
+	BeforeEach(func() {
+		dir := shortTempDir()
+		kubelet = startFakeKubelet(dir)
+		DeferCleanup(kubelet.stop)
+
+		dp = newTestPlugin(dir)
+		supervisor = device_plugin.NewSupervisor(dp)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			supervisor.Run(ctx)
+		}()
+		DeferCleanup(func() {
+			cancel()
+			<-done
+			Expect(dp.Stop()).To(Succeed())
+		})
+	})
+
+	It("starts the plugin and registers it with kubelet", func() {
+		Eventually(supervisor.Ready).Should(Succeed())
+		Expect(kubelet.Registrations()).To(ConsistOf(testResource))
+	})
+
+	It("restarts the plugin and re-registers it when its socket is removed", func() {
+		Eventually(supervisor.Ready).Should(Succeed())
+		Expect(os.Remove(dp.SocketPath())).To(Succeed())
+
+		Eventually(kubelet.Registrations, 10*time.Second).Should(ConsistOf(testResource, testResource))
+		Eventually(supervisor.Ready).Should(Succeed())
+		Expect(supervisor.Restarts()).To(Equal(1))
+		Expect(dp.SocketPath()).To(BeAnExistingFile())
+
+		stream := listAndWatch(context.Background(), dp.SocketPath())
+		resp, err := stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Devices).To(HaveLen(1))
+	})
+})
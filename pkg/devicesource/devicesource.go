@@ -0,0 +1,144 @@
+package devicesource
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// DefaultPollInterval is how often the sysfs and static file sources check for changed devices
+const DefaultPollInterval = 30 * time.Second
+
+// PCIDevice is a PCI function of the host
+type PCIDevice struct {
+	// PCIAddress is the address of the function, e.g. 0000:1b:00.0
+	PCIAddress string `json:"pciAddress"`
+	VendorID   string `json:"vendorID"`
+	DeviceID   string `json:"deviceID"`
+	// Class is the class code with subclass and programming interface, e.g. 030200
+	Class string `json:"class,omitempty"`
+	// subsystem IDs identify the board, e.g. the OEM variant of a GPU
+	SubsystemVendorID string `json:"subsystemVendorID,omitempty"`
+	SubsystemDeviceID string `json:"subsystemDeviceID,omitempty"`
+	// IOMMUGroup is empty if the function is not in an IOMMU group, e.g. the IOMMU is disabled
+	IOMMUGroup string `json:"iommuGroup,omitempty"`
+	// Driver is the kernel driver bound to the function, empty if it is not bound
+	Driver string `json:"driver,omitempty"`
+	// NUMANode is -1 if the function is not attached to a NUMA node
+	NUMANode int `json:"numaNode"`
+	// PCIeRoot is the PCIe root complex the function is attached to, e.g. pci0000:00
+	PCIeRoot string `json:"pcieRoot,omitempty"`
+}
+
+// Kind is the role of a PCI function on a GPU board, derived from its class code
+type Kind string
+
+const (
+	// KindGPU is a display (0300) or 3D (0302) controller
+	KindGPU Kind = "gpu"
+	// KindAudio is an audio device (0403), e.g. the HDMI audio function of a GPU
+	KindAudio Kind = "audio"
+	// KindUSB is a USB controller (0c03), e.g. the USB-C function of a GPU
+	KindUSB Kind = "usb"
+	// KindSerialBus is another serial bus controller (0c80), e.g. the UCSI function of a GPU
+	KindSerialBus Kind = "serial-bus"
+	// KindBridge is a PCI-to-PCI bridge (0604), e.g. a port of a PCIe switch
+	KindBridge Kind = "bridge"
+	// KindSwitch is another bridge (0680), e.g. an NVSwitch
+	KindSwitch Kind = "switch"
+	// KindOther is any other class
+	KindOther Kind = "other"
+)
+
+// kinds maps the class and subclass codes to their kind
+var kinds = map[string]Kind{
+	"0300": KindGPU,
+	"0302": KindGPU,
+	"0403": KindAudio,
+	"0c03": KindUSB,
+	"0c80": KindSerialBus,
+	"0604": KindBridge,
+	"0680": KindSwitch,
+}
+
+// Classify returns the kind of a class code given as class and subclass (0302) or class, subclass
+// and programming interface (030200)
+func Classify(class string) Kind {
+	class = strings.ToLower(class)
+	if len(class) < 4 {
+		return KindOther
+	}
+	if kind, ok := kinds[class[:4]]; ok {
+		return kind
+	}
+	return KindOther
+}
+
+// Kind returns the kind of the function
+func (d PCIDevice) Kind() Kind {
+	return Classify(d.Class)
+}
+
+// Slot returns the PCI address of the device without the function number, e.g. 0000:1b:00 for
+// 0000:1b:00.1. The functions of a slot are the functions of one board.
+func (d PCIDevice) Slot() string {
+	if i := strings.LastIndex(d.PCIAddress, "."); i > 0 {
+		return d.PCIAddress[:i]
+	}
+	return d.PCIAddress
+}
+
+// Source lists the PCI functions of a host
+type Source interface {
+	// List returns the PCI functions, sorted by PCI address
+	List() ([]PCIDevice, error)
+	// Watch sends the PCI functions every time they change until ctx is cancelled, then closes
+	// the channel. The functions listed when Watch is called are not sent.
+	Watch(ctx context.Context) <-chan []PCIDevice
+}
+
+func sortByAddress(devices []PCIDevice) {
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].PCIAddress < devices[j].PCIAddress
+	})
+}
+
+// poll lists the devices every interval and sends them when they differ from the previous list
+func poll(ctx context.Context, interval time.Duration, list func() ([]PCIDevice, error)) <-chan []PCIDevice {
+	ch := make(chan []PCIDevice)
+	last, err := list()
+	if err != nil {
+		klog.ErrorS(err, "Could not list devices")
+	}
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			devices, err := list()
+			if err != nil {
+				klog.ErrorS(err, "Could not list devices")
+				continue
+			}
+			if slices.Equal(devices, last) {
+				continue
+			}
+			last = devices
+			select {
+			case ch <- devices:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,13 @@
+package devicesource_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDeviceSource(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Device Source Suite")
+}
@@ -0,0 +1,173 @@
+package devicesource_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/devicesource"
+	"kubevirt-nvidia-device-plugin/pkg/simulation"
+)
+
+const hostDescription = `devices:
+- pciAddress: "0000:9a:00.0"
+  deviceID: "2330"
+  iommuGroup: "84"
+  numaNode: 1
+  pcieRoot: pci0000:97
+- pciAddress: "0000:1b:00.0"
+  deviceID: "2236"
+  subsystemDeviceID: "1482"
+  iommuGroup: "42"
+  driver: none
+`
+
+var expectedDevices = []devicesource.PCIDevice{
+	{
+		PCIAddress:        "0000:1b:00.0",
+		VendorID:          "10de",
+		DeviceID:          "2236",
+		Class:             "030200",
+		SubsystemVendorID: "10de",
+		SubsystemDeviceID: "1482",
+		IOMMUGroup:        "42",
+		NUMANode:          -1,
+		PCIeRoot:          "pci0000:00",
+	},
+	{
+		PCIAddress:        "0000:9a:00.0",
+		VendorID:          "10de",
+		DeviceID:          "2330",
+		Class:             "030200",
+		SubsystemVendorID: "10de",
+		SubsystemDeviceID: "0000",
+		IOMMUGroup:        "84",
+		Driver:            "vfio-pci",
+		NUMANode:          1,
+		PCIeRoot:          "pci0000:97",
+	},
+}
+
+var _ = Describe("PCIDevice", func() {
+	DescribeTable("classifies the functions by class code",
+		func(class string, kind devicesource.Kind) {
+			Expect(devicesource.PCIDevice{Class: class}.Kind()).To(Equal(kind))
+		},
+		Entry("VGA controller", "030000", devicesource.KindGPU),
+		Entry("3D controller", "030200", devicesource.KindGPU),
+		Entry("HDMI audio", "040300", devicesource.KindAudio),
+		Entry("USB-C controller", "0C0330", devicesource.KindUSB),
+		Entry("UCSI controller", "0c8000", devicesource.KindSerialBus),
+		Entry("PCIe switch port", "060400", devicesource.KindBridge),
+		Entry("NVSwitch", "068000", devicesource.KindSwitch),
+		Entry("network controller", "020000", devicesource.KindOther),
+		Entry("unknown class", "", devicesource.KindOther),
+	)
+
+	It("returns the slot of the function", func() {
+		Expect(devicesource.PCIDevice{PCIAddress: "0000:1b:00.1"}.Slot()).To(Equal("0000:1b:00"))
+	})
+})
+
+var _ = Describe("Device sources", func() {
+	var dir string
+	var descriptionPath string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		descriptionPath = filepath.Join(dir, "host.yaml")
+		Expect(os.WriteFile(descriptionPath, []byte(hostDescription), 0644)).To(Succeed())
+	})
+
+	Describe("Sysfs", func() {
+		var root string
+
+		BeforeEach(func() {
+			host, err := simulation.Load(descriptionPath)
+			Expect(err).NotTo(HaveOccurred())
+			root = filepath.Join(dir, "root")
+			Expect(host.Materialize(root)).To(Succeed())
+		})
+
+		It("lists the PCI functions sorted by address", func() {
+			source := devicesource.NewSysfs(filepath.Join(root, "sys/bus/pci/devices"), time.Minute)
+			devices, err := source.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(Equal(expectedDevices))
+		})
+
+		It("skips entries without vendor ID", func() {
+			Expect(os.Remove(filepath.Join(root, "sys/devices/pci0000:97/0000:9a:00.0/vendor"))).To(Succeed())
+			source := devicesource.NewSysfs(filepath.Join(root, "sys/bus/pci/devices"), time.Minute)
+			devices, err := source.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(Equal(expectedDevices[:1]))
+		})
+
+		It("fails if the directory does not exist", func() {
+			_, err := devicesource.NewSysfs(filepath.Join(dir, "missing"), time.Minute).List()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("sends the functions when a driver changes", func() {
+			source := devicesource.NewSysfs(filepath.Join(root, "sys/bus/pci/devices"), 10*time.Millisecond)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := source.Watch(ctx)
+
+			Expect(os.Symlink(filepath.Join(root, "sys/bus/pci/drivers/vfio-pci"), filepath.Join(root, "sys/devices/pci0000:00/0000:1b:00.0/driver"))).To(Succeed())
+			var devices []devicesource.PCIDevice
+			Eventually(ch).Should(Receive(&devices))
+			Expect(devices[0].Driver).To(Equal("vfio-pci"))
+
+			cancel()
+			Eventually(ch).Should(BeClosed())
+		})
+	})
+
+	Describe("Static", func() {
+		It("lists the devices of the host description", func() {
+			devices, err := devicesource.NewStatic(descriptionPath, time.Minute).List()
+			Expect(err).NotTo(HaveOccurred())
+			// the simulated sysfs defaults the subsystem IDs, the description does not
+			expected := []devicesource.PCIDevice{expectedDevices[0], expectedDevices[1]}
+			expected[0].SubsystemVendorID = ""
+			expected[1].SubsystemVendorID, expected[1].SubsystemDeviceID = "", ""
+			Expect(devices).To(Equal(expected))
+		})
+
+		It("fails on an invalid description", func() {
+			Expect(os.WriteFile(descriptionPath, []byte("devices:\n- deviceID: \"2330\"\n"), 0644)).To(Succeed())
+			_, err := devicesource.NewStatic(descriptionPath, time.Minute).List()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Memory", func() {
+		It("lists the devices sorted by address", func() {
+			source := devicesource.NewMemory(expectedDevices[1], expectedDevices[0])
+			devices, err := source.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(Equal(expectedDevices))
+		})
+
+		It("sends the latest devices to the watchers", func() {
+			source := devicesource.NewMemory(expectedDevices...)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := source.Watch(ctx)
+
+			source.Set(expectedDevices[0])
+			source.Set(expectedDevices[1])
+			Expect(<-ch).To(Equal(expectedDevices[1:]))
+			Consistently(ch).ShouldNot(Receive())
+
+			cancel()
+			Eventually(ch).Should(BeClosed())
+		})
+	})
+})
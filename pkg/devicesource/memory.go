@@ -0,0 +1,63 @@
+package devicesource
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Memory is a source holding the PCI functions in memory, e.g. to test the device plugin
+type Memory struct {
+	mu       sync.Mutex
+	devices  []PCIDevice
+	watchers map[chan []PCIDevice]struct{}
+}
+
+// NewMemory returns a source listing the given devices
+func NewMemory(devices ...PCIDevice) *Memory {
+	return &Memory{devices: sorted(devices), watchers: map[chan []PCIDevice]struct{}{}}
+}
+
+// List returns a copy of the devices
+func (m *Memory) List() ([]PCIDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.devices), nil
+}
+
+// Set replaces the devices and sends them to the watchers. A watcher which did not receive the
+// previous devices yet only receives the latest ones.
+func (m *Memory) Set(devices ...PCIDevice) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.devices = sorted(devices)
+	for ch := range m.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- slices.Clone(m.devices)
+	}
+}
+
+// Watch returns a channel receiving the devices of every Set call
+func (m *Memory) Watch(ctx context.Context) <-chan []PCIDevice {
+	ch := make(chan []PCIDevice, 1)
+	m.mu.Lock()
+	m.watchers[ch] = struct{}{}
+	m.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.watchers, ch)
+		m.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+func sorted(devices []PCIDevice) []PCIDevice {
+	devices = slices.Clone(devices)
+	sortByAddress(devices)
+	return devices
+}
@@ -0,0 +1,53 @@
+package devicesource
+
+import (
+	"context"
+	"time"
+
+	"kubevirt-nvidia-device-plugin/pkg/simulation"
+)
+
+// Static lists the PCI functions of a host description file, in the format of the simulated hosts
+type Static struct {
+	path     string
+	interval time.Duration
+}
+
+// NewStatic returns a source reading the host description at path and checking it for changes every interval
+func NewStatic(path string, interval time.Duration) *Static {
+	return &Static{path: path, interval: interval}
+}
+
+// List reads the host description
+func (s *Static) List() ([]PCIDevice, error) {
+	host, err := simulation.Load(s.path)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]PCIDevice, 0, len(host.Devices))
+	for _, d := range host.Devices {
+		driver := d.Driver
+		if driver == "none" {
+			driver = ""
+		}
+		devices = append(devices, PCIDevice{
+			PCIAddress:        d.PCIAddress,
+			VendorID:          d.VendorID,
+			DeviceID:          d.DeviceID,
+			Class:             d.Class,
+			SubsystemVendorID: d.SubsystemVendorID,
+			SubsystemDeviceID: d.SubsystemDeviceID,
+			IOMMUGroup:        d.IOMMUGroup,
+			Driver:            driver,
+			NUMANode:          *d.NUMANode,
+			PCIeRoot:          d.PCIeRoot,
+		})
+	}
+	sortByAddress(devices)
+	return devices, nil
+}
+
+// Watch polls the host description for changes
+func (s *Static) Watch(ctx context.Context) <-chan []PCIDevice {
+	return poll(ctx, s.interval, s.List)
+}
@@ -0,0 +1,127 @@
+package devicesource
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// DefaultSysfsPath is the sysfs directory of the PCI devices of the host
+const DefaultSysfsPath = "/sys/bus/pci/devices"
+
+// Sysfs lists the PCI functions of a sysfs devices directory
+type Sysfs struct {
+	path     string
+	interval time.Duration
+}
+
+// NewSysfs returns a source reading the sysfs devices directory path, e.g. DefaultSysfsPath,
+// and checking it for changes every interval
+func NewSysfs(path string, interval time.Duration) *Sysfs {
+	return &Sysfs{path: path, interval: interval}
+}
+
+// List returns the PCI functions of the directory, functions without vendor or device ID are skipped
+func (s *Sysfs) List() ([]PCIDevice, error) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var devices []PCIDevice
+	for _, entry := range entries {
+		if entry.IsDir() {
+			// Not a device
+			continue
+		}
+		address := entry.Name()
+		vendorID, err := s.readID(address, "vendor")
+		if err != nil {
+			klog.V(4).InfoS("Could not get vendor ID for device", "pciAddress", address)
+			continue
+		}
+		deviceID, err := s.readID(address, "device")
+		if err != nil {
+			klog.ErrorS(err, "Could not get device ID for device", "pciAddress", address)
+			continue
+		}
+		class, _ := s.readID(address, "class")
+		subsystemVendorID, _ := s.readID(address, "subsystem_vendor")
+		subsystemDeviceID, _ := s.readID(address, "subsystem_device")
+		driver, _ := s.readLink(address, "driver")
+		iommuGroup, _ := s.readLink(address, "iommu_group")
+		devices = append(devices, PCIDevice{
+			PCIAddress:        address,
+			VendorID:          vendorID,
+			DeviceID:          deviceID,
+			Class:             class,
+			SubsystemVendorID: subsystemVendorID,
+			SubsystemDeviceID: subsystemDeviceID,
+			IOMMUGroup:        iommuGroup,
+			Driver:            driver,
+			NUMANode:          s.readNUMANode(address),
+			PCIeRoot:          s.readPCIeRoot(address),
+		})
+	}
+	sortByAddress(devices)
+	return devices, nil
+}
+
+// Watch polls the directory for added and removed functions and driver changes
+func (s *Sysfs) Watch(ctx context.Context) <-chan []PCIDevice {
+	return poll(ctx, s.interval, s.List)
+}
+
+// readID reads a hexadecimal attribute of a device without its 0x prefix
+func (s *Sysfs) readID(address string, attribute string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(s.path, address, attribute))
+	if err != nil {
+		klog.V(4).InfoS("Could not read device property", "pciAddress", address, "property", attribute, "err", err)
+		return "", err
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"), nil
+}
+
+// readNUMANode returns the NUMA node of the device, or -1 if it is unknown
+func (s *Sysfs) readNUMANode(address string) int {
+	data, err := os.ReadFile(filepath.Join(s.path, address, "numa_node"))
+	if err != nil {
+		klog.V(4).InfoS("Could not read device property", "pciAddress", address, "property", "numa_node", "err", err)
+		return -1
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// readPCIeRoot returns the PCIe root complex the device is attached to, or "" if it is unknown.
+// The device entry links to its path in the device tree, e.g. ../../../devices/pci0000:00/0000:00:01.0/0000:01:00.0
+func (s *Sysfs) readPCIeRoot(address string) string {
+	path, err := os.Readlink(filepath.Join(s.path, address))
+	if err != nil {
+		klog.V(4).InfoS("Could not read device link", "pciAddress", address, "err", err)
+		return ""
+	}
+	for _, element := range strings.Split(filepath.ToSlash(path), "/") {
+		if strings.HasPrefix(element, "pci") {
+			return element
+		}
+	}
+	return ""
+}
+
+// readLink returns the name of the entry a link of the device points to, e.g. its driver
+func (s *Sysfs) readLink(address string, link string) (string, error) {
+	path, err := os.Readlink(filepath.Join(s.path, address, link))
+	if err != nil {
+		klog.V(4).InfoS("Could not read device link", "pciAddress", address, "link", link, "err", err)
+		return "", err
+	}
+	return filepath.Base(path), nil
+}
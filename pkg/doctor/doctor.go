@@ -0,0 +1,284 @@
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	// StatusOK means the prerequisite is met
+	StatusOK Status = "ok"
+	// StatusWarning means passthrough may work but the host setup is unusual or incomplete
+	StatusWarning Status = "warning"
+	// StatusFailed means devices cannot be passed through until the prerequisite is fixed
+	StatusFailed Status = "failed"
+)
+
+const (
+	pciDevicesDir   = "sys/bus/pci/devices"
+	iommuGroupsDir  = "sys/kernel/iommu_groups"
+	iommuClassDir   = "sys/class/iommu"
+	vfioModuleDir   = "sys/module/vfio_pci"
+	vfioDriverDir   = "sys/bus/pci/drivers/vfio-pci"
+	vfioContainer   = "dev/vfio/vfio"
+	kernelCmdline   = "proc/cmdline"
+	devicePluginDir = "var/lib/kubelet/device-plugins"
+	kubeletSocket   = "kubelet.sock"
+
+	// PCI-to-PCI bridges are part of the IOMMU group of the devices behind them and are not passed through
+	bridgeClass = "0604"
+)
+
+// Result is the outcome of one check
+type Result struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	// Remedy tells how to fix a failed check, empty if the check passed
+	Remedy string `json:"remedy,omitempty"`
+}
+
+// Doctor checks the host prerequisites of device passthrough
+type Doctor struct {
+	// Root is the directory the host filesystem is mounted at, / when running on the host
+	Root string
+	// Selectors select the devices whose IOMMU groups are checked
+	Selectors []selector.Selector
+}
+
+// New returns a doctor checking the host mounted at root for the selected devices.
+// selector.Default() is used if no selector is given.
+func New(root string, selectors []selector.Selector) *Doctor {
+	if len(selectors) == 0 {
+		selectors = selector.Default()
+	}
+	return &Doctor{Root: root, Selectors: selectors}
+}
+
+// Run runs every check
+func (d *Doctor) Run() []Result {
+	return []Result{
+		d.CheckIOMMU(),
+		d.CheckKernelCmdline(),
+		d.CheckVFIOModule(),
+		d.CheckVFIODevice(),
+		d.CheckIOMMUGroups(),
+		d.CheckKubeletDir(),
+	}
+}
+
+// Failed returns whether any of the results failed
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckIOMMU checks that the kernel created IOMMU groups
+func (d *Doctor) CheckIOMMU() Result {
+	r := Result{Name: "iommu"}
+	groups, err := os.ReadDir(d.path(iommuGroupsDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		r.Status, r.Message = StatusFailed, fmt.Sprintf("cannot read IOMMU groups: %v", err)
+		return r
+	}
+	if len(groups) == 0 {
+		r.Status, r.Message = StatusFailed, "the IOMMU is disabled, the kernel created no IOMMU groups"
+		r.Remedy = "enable VT-d or AMD-Vi in the firmware and boot with intel_iommu=on or amd_iommu=on"
+		return r
+	}
+	units, _ := os.ReadDir(d.path(iommuClassDir))
+	r.Status, r.Message = StatusOK, fmt.Sprintf("%d IOMMU groups, %d IOMMU units", len(groups), len(units))
+	return r
+}
+
+// CheckKernelCmdline checks the IOMMU options of the kernel command line
+func (d *Doctor) CheckKernelCmdline() Result {
+	r := Result{Name: "kernel-cmdline"}
+	data, err := os.ReadFile(d.path(kernelCmdline))
+	if err != nil {
+		r.Status, r.Message = StatusWarning, fmt.Sprintf("cannot read the kernel command line: %v", err)
+		r.Remedy = "mount the host /proc to check the boot options"
+		return r
+	}
+	options := map[string]string{}
+	for _, option := range strings.Fields(string(data)) {
+		key, value, _ := strings.Cut(option, "=")
+		options[key] = value
+	}
+	if options["intel_iommu"] == "off" || options["amd_iommu"] == "off" {
+		r.Status, r.Message = StatusFailed, "the IOMMU is disabled on the kernel command line"
+		r.Remedy = "remove intel_iommu=off and amd_iommu=off from the boot options"
+		return r
+	}
+
+	var missing []string
+	if options["intel_iommu"] != "on" && options["amd_iommu"] != "on" {
+		// AMD-Vi is enabled by default, VT-d depends on the kernel configuration
+		missing = append(missing, "intel_iommu=on or amd_iommu=on")
+	}
+	if options["iommu"] != "pt" {
+		missing = append(missing, "iommu=pt")
+	}
+	if len(missing) > 0 {
+		r.Status, r.Message = StatusWarning, fmt.Sprintf("the kernel command line lacks %s", strings.Join(missing, ", "))
+		r.Remedy = "add " + strings.Join(missing, " and ") + " to the boot options unless the IOMMU is enabled by default"
+		return r
+	}
+	r.Status, r.Message = StatusOK, "the IOMMU is enabled in passthrough mode"
+	return r
+}
+
+// CheckVFIOModule checks that the vfio-pci driver is available
+func (d *Doctor) CheckVFIOModule() Result {
+	r := Result{Name: "vfio-pci"}
+	if !d.exists(vfioModuleDir) && !d.exists(vfioDriverDir) {
+		r.Status, r.Message = StatusFailed, "the vfio-pci driver is not loaded"
+		r.Remedy = "run modprobe vfio-pci and add vfio-pci to /etc/modules-load.d"
+		return r
+	}
+	r.Status, r.Message = StatusOK, "the vfio-pci driver is loaded"
+	return r
+}
+
+// CheckVFIODevice checks that the VFIO container device is available
+func (d *Doctor) CheckVFIODevice() Result {
+	r := Result{Name: "dev-vfio"}
+	if !d.exists(vfioContainer) {
+		r.Status, r.Message = StatusFailed, fmt.Sprintf("%s does not exist", "/"+vfioContainer)
+		r.Remedy = "load vfio-pci and mount the host /dev/vfio into the device plugin pod"
+		return r
+	}
+	r.Status, r.Message = StatusOK, fmt.Sprintf("%s exists", "/"+vfioContainer)
+	return r
+}
+
+// CheckIOMMUGroups checks that the IOMMU group of every selected device holds no other devices,
+// which would have to be passed through to the same VM. Functions of the same slot and bridges
+// are allowed.
+func (d *Doctor) CheckIOMMUGroups() Result {
+	r := Result{Name: "iommu-groups"}
+	entries, err := os.ReadDir(d.path(pciDevicesDir))
+	if err != nil {
+		r.Status, r.Message = StatusFailed, fmt.Sprintf("cannot list the PCI devices: %v", err)
+		r.Remedy = "mount the host /sys into the device plugin pod"
+		return r
+	}
+
+	selected := 0
+	var shared []string
+	for _, entry := range entries {
+		address := entry.Name()
+		if !d.selected(address) {
+			continue
+		}
+		selected++
+		group, err := os.Readlink(d.path(pciDevicesDir, address, "iommu_group"))
+		if err != nil {
+			shared = append(shared, fmt.Sprintf("%s has no IOMMU group", address))
+			continue
+		}
+		members, err := os.ReadDir(d.path(iommuGroupsDir, filepath.Base(group), "devices"))
+		if err != nil {
+			continue
+		}
+		var others []string
+		for _, member := range members {
+			if member.Name() == address || sameSlot(member.Name(), address) || d.selected(member.Name()) {
+				continue
+			}
+			if strings.HasPrefix(d.readID(member.Name(), "class"), bridgeClass) {
+				continue
+			}
+			others = append(others, member.Name())
+		}
+		if len(others) > 0 {
+			sort.Strings(others)
+			shared = append(shared, fmt.Sprintf("%s shares IOMMU group %s with %s", address, filepath.Base(group), strings.Join(others, ", ")))
+		}
+	}
+
+	switch {
+	case selected == 0:
+		r.Status, r.Message = StatusWarning, "no selected device found"
+		r.Remedy = "check the selectors and that the devices are visible in /sys/bus/pci/devices"
+	case len(shared) > 0:
+		r.Status, r.Message = StatusWarning, strings.Join(shared, "; ")
+		r.Remedy = "enable ACS in the firmware or move the devices to slots below ACS capable ports, all devices of a group are passed through together"
+	default:
+		r.Status, r.Message = StatusOK, fmt.Sprintf("the IOMMU groups of the %d selected devices are isolated", selected)
+	}
+	return r
+}
+
+// CheckKubeletDir checks that the kubelet device plugin directory is available
+func (d *Doctor) CheckKubeletDir() Result {
+	r := Result{Name: "kubelet-device-plugins"}
+	if !d.exists(devicePluginDir) {
+		r.Status, r.Message = StatusFailed, fmt.Sprintf("%s does not exist", "/"+devicePluginDir)
+		r.Remedy = "mount the kubelet device plugin directory into the pod, or check the kubelet --root-dir"
+		return r
+	}
+	if !d.exists(devicePluginDir, kubeletSocket) {
+		r.Status, r.Message = StatusWarning, fmt.Sprintf("%s exists but kubelet is not serving %s", "/"+devicePluginDir, kubeletSocket)
+		r.Remedy = "check that kubelet is running"
+		return r
+	}
+	r.Status, r.Message = StatusOK, fmt.Sprintf("kubelet serves %s", filepath.Join("/"+devicePluginDir, kubeletSocket))
+	return r
+}
+
+func (d *Doctor) selected(address string) bool {
+	return selector.Match(d.Selectors, selector.Device{
+		VendorID: d.readID(address, "vendor"),
+		DeviceID: d.readID(address, "device"),
+		Class:    d.readID(address, "class"),
+		Driver:   d.readDriver(address),
+	}) >= 0
+}
+
+// readDriver returns the name of the driver bound to a PCI device, "" if it is not bound
+func (d *Doctor) readDriver(address string) string {
+	target, err := os.Readlink(d.path(pciDevicesDir, address, "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// readID reads a hexadecimal sysfs attribute of a PCI device without its 0x prefix, "" if it is unreadable
+func (d *Doctor) readID(address string, attribute string) string {
+	data, err := os.ReadFile(d.path(pciDevicesDir, address, attribute))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(data)), "0x")
+}
+
+func (d *Doctor) path(elem ...string) string {
+	return filepath.Join(append([]string{d.Root}, elem...)...)
+}
+
+func (d *Doctor) exists(elem ...string) bool {
+	_, err := os.Stat(d.path(elem...))
+	return err == nil
+}
+
+// sameSlot returns whether two PCI addresses are functions of the same device, e.g. 0000:1b:00.0 and 0000:1b:00.1
+func sameSlot(a string, b string) bool {
+	i, j := strings.LastIndex(a, "."), strings.LastIndex(b, ".")
+	return i > 0 && j > 0 && a[:i] == b[:j]
+}
@@ -0,0 +1,167 @@
+package doctor_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/doctor"
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+)
+
+var _ = Describe("Doctor", func() {
+	var root string
+	var d *doctor.Doctor
+
+	writeFile := func(path string, content string) {
+		path = filepath.Join(root, path)
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(os.WriteFile(path, []byte(content), 0644)).To(Succeed())
+	}
+	mkdir := func(path string) {
+		Expect(os.MkdirAll(filepath.Join(root, path), 0755)).To(Succeed())
+	}
+	// addDevice creates a PCI function in the given IOMMU group, linked from the group as in sysfs
+	addDevice := func(address string, vendor string, class string, group string) {
+		dir := filepath.Join("sys/bus/pci/devices", address)
+		writeFile(filepath.Join(dir, "vendor"), "0x"+vendor+"\n")
+		writeFile(filepath.Join(dir, "device"), "0x2330\n")
+		writeFile(filepath.Join(dir, "class"), "0x"+class+"\n")
+		groupDir := filepath.Join("sys/kernel/iommu_groups", group)
+		mkdir(filepath.Join(groupDir, "devices"))
+		Expect(os.Symlink("../../../../kernel/iommu_groups/"+group, filepath.Join(root, dir, "iommu_group"))).To(Succeed())
+		Expect(os.Symlink("../../../../bus/pci/devices/"+address, filepath.Join(root, groupDir, "devices", address))).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+		d = doctor.New(root, nil)
+	})
+
+	Context("CheckIOMMU", func() {
+		It("fails without IOMMU groups", func() {
+			r := d.CheckIOMMU()
+			Expect(r.Status).To(Equal(doctor.StatusFailed))
+			Expect(r.Remedy).To(ContainSubstring("intel_iommu=on"))
+		})
+
+		It("counts the IOMMU groups", func() {
+			mkdir("sys/kernel/iommu_groups/0")
+			mkdir("sys/kernel/iommu_groups/1")
+			mkdir("sys/class/iommu/dmar0")
+			r := d.CheckIOMMU()
+			Expect(r.Status).To(Equal(doctor.StatusOK))
+			Expect(r.Message).To(Equal("2 IOMMU groups, 1 IOMMU units"))
+		})
+	})
+
+	DescribeTable("CheckKernelCmdline",
+		func(cmdline string, status doctor.Status) {
+			writeFile("proc/cmdline", cmdline)
+			Expect(d.CheckKernelCmdline().Status).To(Equal(status))
+		},
+		Entry("IOMMU in passthrough mode", "BOOT_IMAGE=/vmlinuz ro intel_iommu=on iommu=pt\n", doctor.StatusOK),
+		Entry("AMD IOMMU in passthrough mode", "ro amd_iommu=on iommu=pt", doctor.StatusOK),
+		Entry("no passthrough mode", "ro intel_iommu=on", doctor.StatusWarning),
+		Entry("no IOMMU options", "ro quiet", doctor.StatusWarning),
+		Entry("IOMMU disabled", "ro intel_iommu=off iommu=pt", doctor.StatusFailed),
+	)
+
+	It("warns if the kernel command line is unreadable", func() {
+		Expect(d.CheckKernelCmdline().Status).To(Equal(doctor.StatusWarning))
+	})
+
+	Context("CheckVFIOModule", func() {
+		It("fails if vfio-pci is not loaded", func() {
+			r := d.CheckVFIOModule()
+			Expect(r.Status).To(Equal(doctor.StatusFailed))
+			Expect(r.Remedy).To(ContainSubstring("modprobe vfio-pci"))
+		})
+
+		It("accepts the loaded module", func() {
+			mkdir("sys/module/vfio_pci")
+			Expect(d.CheckVFIOModule().Status).To(Equal(doctor.StatusOK))
+		})
+
+		It("accepts the built-in driver", func() {
+			mkdir("sys/bus/pci/drivers/vfio-pci")
+			Expect(d.CheckVFIOModule().Status).To(Equal(doctor.StatusOK))
+		})
+	})
+
+	Context("CheckVFIODevice", func() {
+		It("fails without /dev/vfio/vfio", func() {
+			mkdir("dev/vfio")
+			Expect(d.CheckVFIODevice().Status).To(Equal(doctor.StatusFailed))
+		})
+
+		It("accepts /dev/vfio/vfio", func() {
+			writeFile("dev/vfio/vfio", "")
+			Expect(d.CheckVFIODevice().Status).To(Equal(doctor.StatusOK))
+		})
+	})
+
+	Context("CheckIOMMUGroups", func() {
+		It("accepts isolated devices, their companion functions and bridges", func() {
+			addDevice("0000:1b:00.0", "10de", "030200", "42")
+			addDevice("0000:1b:00.1", "10de", "040300", "42")
+			addDevice("0000:1a:00.0", "8086", "060400", "42")
+			addDevice("0000:9a:00.0", "10de", "030200", "43")
+			r := d.CheckIOMMUGroups()
+			Expect(r.Status).To(Equal(doctor.StatusOK), r.Message)
+			Expect(r.Message).To(ContainSubstring("2 selected devices"))
+		})
+
+		It("warns about groups shared with other devices", func() {
+			addDevice("0000:1b:00.0", "10de", "030200", "42")
+			addDevice("0000:1c:00.0", "15b3", "020000", "42")
+			r := d.CheckIOMMUGroups()
+			Expect(r.Status).To(Equal(doctor.StatusWarning))
+			Expect(r.Message).To(Equal("0000:1b:00.0 shares IOMMU group 42 with 0000:1c:00.0"))
+			Expect(r.Remedy).To(ContainSubstring("ACS"))
+		})
+
+		It("selects the devices by driver", func() {
+			d = doctor.New(root, []selector.Selector{{VendorID: "10de", Drivers: []string{"vfio-pci"}}})
+			addDevice("0000:1b:00.0", "10de", "030200", "42")
+			addDevice("0000:9a:00.0", "10de", "030200", "43")
+			mkdir("sys/bus/pci/drivers/vfio-pci")
+			Expect(os.Symlink("../../drivers/vfio-pci", filepath.Join(root, "sys/bus/pci/devices/0000:1b:00.0/driver"))).To(Succeed())
+			r := d.CheckIOMMUGroups()
+			Expect(r.Status).To(Equal(doctor.StatusOK), r.Message)
+			Expect(r.Message).To(ContainSubstring("1 selected devices"))
+		})
+
+		It("warns if no device is selected", func() {
+			addDevice("0000:1c:00.0", "15b3", "020000", "42")
+			Expect(d.CheckIOMMUGroups().Status).To(Equal(doctor.StatusWarning))
+		})
+
+		It("fails without the PCI devices", func() {
+			Expect(d.CheckIOMMUGroups().Status).To(Equal(doctor.StatusFailed))
+		})
+	})
+
+	Context("CheckKubeletDir", func() {
+		It("fails without the device plugin directory", func() {
+			Expect(d.CheckKubeletDir().Status).To(Equal(doctor.StatusFailed))
+		})
+
+		It("warns if kubelet does not serve its socket", func() {
+			mkdir("var/lib/kubelet/device-plugins")
+			Expect(d.CheckKubeletDir().Status).To(Equal(doctor.StatusWarning))
+		})
+
+		It("accepts the kubelet socket", func() {
+			writeFile("var/lib/kubelet/device-plugins/kubelet.sock", "")
+			Expect(d.CheckKubeletDir().Status).To(Equal(doctor.StatusOK))
+		})
+	})
+
+	It("fails if any check fails", func() {
+		Expect(doctor.Failed(d.Run())).To(BeTrue())
+		Expect(doctor.Failed([]doctor.Result{{Status: doctor.StatusOK}, {Status: doctor.StatusWarning}})).To(BeFalse())
+	})
+})
@@ -0,0 +1,13 @@
+package dra_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDRA(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "DRA Driver Suite")
+}
@@ -0,0 +1,234 @@
+package dra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha4"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+const (
+	// DriverName is the name of the DRA driver, used for the resource slices, the device classes and the CDI kind
+	DriverName = "passthrough.nvidia.com"
+	// DefaultPluginDir is the directory of the socket kubelet calls the driver on
+	DefaultPluginDir = "/var/lib/kubelet/plugins/" + DriverName
+	// DefaultRegistrarDir is the directory watched by the kubelet plugin manager
+	DefaultRegistrarDir = "/var/lib/kubelet/plugins_registry"
+
+	pluginSocket = "dra.sock"
+	// kubelet validates the versions of a DRA plugin as semantic versions
+	supportedVersion = "1.0.0"
+	shutdownTimeout  = 10 * time.Second
+)
+
+// Device is a passthrough PCI function published by the driver
+type Device struct {
+	// Name identifies the device within the resource pool of the node, see DeviceName
+	Name string
+	// PCIAddress is the address of the PCI function, e.g. 0000:0a:00.0
+	PCIAddress string
+	// DeviceID is the PCI device ID
+	DeviceID string
+	// Model is the device name resolved from the PCI device ID
+	Model string
+	// IOMMUGroup is the IOMMU group, exposed as /dev/vfio/<group>
+	IOMMUGroup string
+	// NUMANode is the NUMA node the device is attached to, -1 if unknown
+	NUMANode int
+	// PCIeRoot is the PCIe root complex the device is attached to, e.g. pci0000:00
+	PCIeRoot string
+	// EnvVar is the name of the environment variable KubeVirt reads the PCI addresses from
+	EnvVar string
+	// Companions are the other functions of the slot passed through with the device, e.g. its HDMI audio
+	Companions []Companion
+	// CompanionsEnvVar is the name of the environment variable listing the PCI addresses of the companions
+	CompanionsEnvVar string
+}
+
+// Companion is a function passed through with the device it is attached to
+type Companion struct {
+	PCIAddress string
+	IOMMUGroup string
+}
+
+// DeviceName returns the name of the device with the given PCI address in the resource slice.
+// Device names have to be DNS labels, e.g. 0000:0a:00.0 becomes pci-0000-0a-00-0.
+func DeviceName(pciAddress string) string {
+	return "pci-" + strings.ToLower(strings.NewReplacer(":", "-", ".", "-").Replace(pciAddress))
+}
+
+// Config holds the locations used by the driver
+type Config struct {
+	// NodeName is the name of the node, the resource pool is named after it
+	NodeName string
+	// PluginDir is the directory of the socket kubelet calls the driver on
+	PluginDir string
+	// RegistrarDir is the directory watched by the kubelet plugin manager
+	RegistrarDir string
+	// CDIRoot is the directory the CDI specs of the prepared claims are written to
+	CDIRoot string
+}
+
+// Driver is a DRA kubelet plugin handing out the passthrough devices of a node
+type Driver struct {
+	client  kubernetes.Interface
+	config  Config
+	devices map[string]*Device // indexed by device name
+
+	mu      sync.Mutex // guards servers and prepared
+	servers []*grpc.Server
+	// prepared maps the UID of every prepared claim to the devices handed out for it
+	prepared map[string][]*drapb.Device
+
+	registered atomic.Bool
+	published  atomic.Bool
+}
+
+// NewDriver returns a driver publishing the given devices
+func NewDriver(client kubernetes.Interface, config Config, devices []Device) *Driver {
+	d := &Driver{
+		client:   client,
+		config:   config,
+		devices:  make(map[string]*Device, len(devices)),
+		prepared: map[string][]*drapb.Device{},
+	}
+	for _, device := range devices {
+		device := device
+		d.devices[device.Name] = &device
+	}
+	return d
+}
+
+// pluginSocketPath is the socket kubelet calls NodePrepareResources and NodeUnprepareResources on
+func (d *Driver) pluginSocketPath() string {
+	return filepath.Join(d.config.PluginDir, pluginSocket)
+}
+
+// registrarSocketPath is the socket the kubelet plugin manager discovers the driver by
+func (d *Driver) registrarSocketPath() string {
+	return filepath.Join(d.config.RegistrarDir, DriverName+"-reg.sock")
+}
+
+// Start serves the DRA node service and then the registration service,
+// which makes the kubelet plugin manager register the driver
+func (d *Driver) Start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.servers != nil {
+		return errors.New("the DRA driver is already started")
+	}
+
+	plugin := grpc.NewServer()
+	drapb.RegisterNodeServer(plugin, d)
+	if err := serve(plugin, d.pluginSocketPath()); err != nil {
+		return err
+	}
+	registrar := grpc.NewServer()
+	registerapi.RegisterRegistrationServer(registrar, d)
+	if err := serve(registrar, d.registrarSocketPath()); err != nil {
+		plugin.Stop()
+		return err
+	}
+	d.servers = []*grpc.Server{plugin, registrar}
+	klog.InfoS("Started DRA driver", "driver", DriverName, "socket", d.pluginSocketPath(), "registrar", d.registrarSocketPath())
+	return nil
+}
+
+func serve(server *grpc.Server, socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0750); err != nil {
+		return fmt.Errorf("creating socket directory: %w", err)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing stale socket: %w", err)
+	}
+	sock, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := server.Serve(sock); err != nil {
+			klog.ErrorS(err, "DRA driver gRPC server exited", "socket", socketPath)
+		}
+	}()
+	return nil
+}
+
+// Stop stops the gRPC servers and removes the sockets. Removing the registration
+// socket makes kubelet unregister the driver.
+func (d *Driver) Stop() error {
+	d.mu.Lock()
+	servers := d.servers
+	d.servers = nil
+	d.mu.Unlock()
+	if servers == nil {
+		return nil
+	}
+	d.registered.Store(false)
+
+	// Stop the registrar first, so kubelet does not call into a stopped plugin
+	for i := len(servers) - 1; i >= 0; i-- {
+		stopped := make(chan struct{})
+		go func() {
+			servers[i].GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(shutdownTimeout):
+			klog.InfoS("Timed out waiting for in-flight RPCs, forcing the DRA driver to stop")
+			servers[i].Stop()
+		}
+	}
+
+	var errs []error
+	for _, socketPath := range []string{d.registrarSocketPath(), d.pluginSocketPath()} {
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Ready returns an error unless the driver is registered with kubelet and its devices are published
+func (d *Driver) Ready() error {
+	if !d.registered.Load() {
+		return fmt.Errorf("%s: DRA driver is not registered with kubelet", DriverName)
+	}
+	if !d.published.Load() {
+		return fmt.Errorf("%s: resource slice is not published", DriverName)
+	}
+	return nil
+}
+
+// GetInfo is called by the kubelet plugin manager to discover the driver
+func (d *Driver) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DRAPlugin,
+		Name:              DriverName,
+		Endpoint:          d.pluginSocketPath(),
+		SupportedVersions: []string{supportedVersion},
+	}, nil
+}
+
+// NotifyRegistrationStatus is called by kubelet with the outcome of the registration
+func (d *Driver) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	d.registered.Store(status.PluginRegistered)
+	if !status.PluginRegistered {
+		klog.ErrorS(errors.New(status.Error), "Kubelet failed to register the DRA driver", "driver", DriverName)
+	} else {
+		klog.InfoS("Registered DRA driver with kubelet", "driver", DriverName)
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
@@ -0,0 +1,261 @@
+package dra_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha4"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+	"k8s.io/utils/ptr"
+
+	"kubevirt-nvidia-device-plugin/pkg/cdi"
+	"kubevirt-nvidia-device-plugin/pkg/dra"
+)
+
+const (
+	nodeName = "worker-0"
+	envVar   = "PCI_RESOURCE_NVIDIA_COM_GH100_H100_SXM5_80GB"
+)
+
+var devices = []dra.Device{
+	{
+		Name:       dra.DeviceName("0000:1b:00.0"),
+		PCIAddress: "0000:1b:00.0",
+		DeviceID:   "2330",
+		Model:      "GH100_H100_SXM5_80GB",
+		IOMMUGroup: "42",
+		NUMANode:   0,
+		PCIeRoot:   "pci0000:16",
+		EnvVar:     envVar,
+	},
+	{
+		Name:       dra.DeviceName("0000:9a:00.0"),
+		PCIAddress: "0000:9a:00.0",
+		DeviceID:   "2330",
+		Model:      "GH100_H100_SXM5_80GB",
+		IOMMUGroup: "97",
+		NUMANode:   -1,
+		EnvVar:     envVar,
+		// the HDMI audio shares the group of the GPU, the USB-C controller is in its own group
+		Companions: []dra.Companion{
+			{PCIAddress: "0000:9a:00.1", IOMMUGroup: "97"},
+			{PCIAddress: "0000:9a:00.2", IOMMUGroup: "98"},
+		},
+		CompanionsEnvVar: envVar + "_COMPANIONS",
+	},
+}
+
+// fakeKubelet performs the calls of the kubelet plugin manager and DRA manager
+type fakeKubelet struct {
+	conns []*grpc.ClientConn
+}
+
+func (k *fakeKubelet) dial(socketPath string) *grpc.ClientConn {
+	conn, err := grpc.NewClient("unix://"+socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	Expect(err).ToNot(HaveOccurred())
+	k.conns = append(k.conns, conn)
+	return conn
+}
+
+// register discovers the driver through its registration socket and returns a client for its endpoint
+func (k *fakeKubelet) register(registrarSocket string) drapb.NodeClient {
+	registration := registerapi.NewRegistrationClient(k.dial(registrarSocket))
+	info, err := registration.GetInfo(context.Background(), &registerapi.InfoRequest{})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(info.Type).To(Equal(registerapi.DRAPlugin))
+	Expect(info.Name).To(Equal(dra.DriverName))
+	Expect(info.SupportedVersions).ToNot(BeEmpty())
+
+	_, err = registration.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{PluginRegistered: true})
+	Expect(err).ToNot(HaveOccurred())
+	return drapb.NewNodeClient(k.dial(info.Endpoint))
+}
+
+func (k *fakeKubelet) close() {
+	for _, conn := range k.conns {
+		conn.Close()
+	}
+}
+
+var _ = Describe("DeviceName", func() {
+	It("turns the PCI address into a DNS label", func() {
+		Expect(dra.DeviceName("0000:0A:00.1")).To(Equal("pci-0000-0a-00-1"))
+	})
+})
+
+var _ = Describe("Driver", func() {
+	var (
+		client *fake.Clientset
+		driver *dra.Driver
+		config dra.Config
+	)
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "dra")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		config = dra.Config{
+			NodeName:     nodeName,
+			PluginDir:    filepath.Join(dir, "plugins", dra.DriverName),
+			RegistrarDir: filepath.Join(dir, "plugins_registry"),
+			CDIRoot:      filepath.Join(dir, "cdi"),
+		}
+		client = fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName, UID: "node-uid"}})
+		driver = dra.NewDriver(client, config, devices)
+	})
+
+	Describe("PublishResources", func() {
+		getSlice := func() *resourceapi.ResourceSlice {
+			slice, err := client.ResourceV1alpha3().ResourceSlices().Get(context.Background(), dra.ResourceSliceName(nodeName), metav1.GetOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			return slice
+		}
+
+		It("publishes the devices with their attributes", func() {
+			Expect(driver.PublishResources(context.Background())).To(Succeed())
+
+			slice := getSlice()
+			Expect(slice.OwnerReferences).To(ConsistOf(HaveField("UID", BeEquivalentTo("node-uid"))))
+			Expect(slice.Spec.Driver).To(Equal(dra.DriverName))
+			Expect(slice.Spec.NodeName).To(Equal(nodeName))
+			Expect(slice.Spec.Pool).To(Equal(resourceapi.ResourcePool{Name: nodeName, ResourceSliceCount: 1}))
+			Expect(slice.Spec.Devices).To(HaveLen(2))
+
+			first := slice.Spec.Devices[0]
+			Expect(first.Name).To(Equal("pci-0000-1b-00-0"))
+			Expect(first.Basic.Attributes).To(Equal(map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+				dra.AttributeModel:      {StringValue: ptr.To("GH100_H100_SXM5_80GB")},
+				dra.AttributeDeviceID:   {StringValue: ptr.To("2330")},
+				dra.AttributePCIAddress: {StringValue: ptr.To("0000:1b:00.0")},
+				dra.AttributeIOMMUGroup: {StringValue: ptr.To("42")},
+				dra.AttributeNUMANode:   {IntValue: ptr.To(int64(0))},
+				dra.AttributePCIeRoot:   {StringValue: ptr.To("pci0000:16")},
+			}))
+			// Unknown NUMA node and PCIe root are left out
+			Expect(slice.Spec.Devices[1].Basic.Attributes).ToNot(HaveKey(resourceapi.QualifiedName(dra.AttributeNUMANode)))
+			Expect(slice.Spec.Devices[1].Basic.Attributes).ToNot(HaveKey(resourceapi.QualifiedName(dra.AttributePCIeRoot)))
+			Expect(driver.Ready()).To(MatchError(ContainSubstring("not registered")))
+		})
+
+		It("bumps the pool generation only when the devices change", func() {
+			Expect(driver.PublishResources(context.Background())).To(Succeed())
+			Expect(driver.PublishResources(context.Background())).To(Succeed())
+			Expect(getSlice().Spec.Pool.Generation).To(BeZero())
+
+			driver = dra.NewDriver(client, config, devices[:1])
+			Expect(driver.PublishResources(context.Background())).To(Succeed())
+			slice := getSlice()
+			Expect(slice.Spec.Pool.Generation).To(BeEquivalentTo(1))
+			Expect(slice.Spec.Devices).To(HaveLen(1))
+		})
+	})
+
+	Context("registered with kubelet", func() {
+		var (
+			kubelet *fakeKubelet
+			node    drapb.NodeClient
+		)
+
+		claim := &drapb.Claim{Namespace: "default", Name: "vm-gpus", UID: "claim-uid"}
+
+		createClaim := func(results ...resourceapi.DeviceRequestAllocationResult) {
+			_, err := client.ResourceV1alpha3().ResourceClaims(claim.Namespace).Create(context.Background(), &resourceapi.ResourceClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: claim.Name, Namespace: claim.Namespace, UID: "claim-uid"},
+				Status: resourceapi.ResourceClaimStatus{
+					Allocation: &resourceapi.AllocationResult{
+						Devices: resourceapi.DeviceAllocationResult{Results: results},
+					},
+				},
+			}, metav1.CreateOptions{})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		readSpec := func() *cdi.Spec {
+			data, err := os.ReadFile(filepath.Join(config.CDIRoot, dra.DriverName+"-claim-uid.json"))
+			Expect(err).ToNot(HaveOccurred())
+			spec := &cdi.Spec{}
+			Expect(json.Unmarshal(data, spec)).To(Succeed())
+			return spec
+		}
+
+		BeforeEach(func() {
+			Expect(driver.Start()).To(Succeed())
+			DeferCleanup(driver.Stop)
+			kubelet = &fakeKubelet{}
+			DeferCleanup(kubelet.close)
+			node = kubelet.register(filepath.Join(config.RegistrarDir, dra.DriverName+"-reg.sock"))
+			Expect(driver.PublishResources(context.Background())).To(Succeed())
+		})
+
+		It("is ready", func() {
+			Expect(driver.Ready()).To(Succeed())
+		})
+
+		It("hands out the vfio device nodes and the KubeVirt env var", func() {
+			createClaim(
+				resourceapi.DeviceRequestAllocationResult{Request: "gpu", Driver: dra.DriverName, Pool: nodeName, Device: "pci-0000-1b-00-0"},
+				resourceapi.DeviceRequestAllocationResult{Request: "gpu", Driver: dra.DriverName, Pool: nodeName, Device: "pci-0000-9a-00-0"},
+				resourceapi.DeviceRequestAllocationResult{Request: "nic", Driver: "other.example.com", Pool: nodeName, Device: "nic-0"},
+			)
+
+			resp, err := node.NodePrepareResources(context.Background(), &drapb.NodePrepareResourcesRequest{Claims: []*drapb.Claim{claim}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Claims).To(HaveKey("claim-uid"))
+			result := resp.Claims["claim-uid"]
+			Expect(result.Error).To(BeEmpty())
+			Expect(result.Devices).To(HaveLen(2))
+			Expect(result.Devices[0].RequestNames).To(Equal([]string{"gpu"}))
+			Expect(result.Devices[0].PoolName).To(Equal(nodeName))
+			Expect(result.Devices[0].DeviceName).To(Equal("pci-0000-1b-00-0"))
+			Expect(result.Devices[0].CDIDeviceIDs).To(Equal([]string{dra.DriverName + "/vfio=claim-uid-pci-0000-1b-00-0"}))
+
+			spec := readSpec()
+			Expect(spec.Kind).To(Equal(dra.DriverName + "/vfio"))
+			Expect(spec.ContainerEdits.Env).To(ConsistOf(envVar+"=0000:1b:00.0,0000:9a:00.0", envVar+"_COMPANIONS=0000:9a:00.1,0000:9a:00.2"))
+			Expect(spec.Devices).To(HaveLen(2))
+			Expect(spec.Devices[0].Name).To(Equal("claim-uid-pci-0000-1b-00-0"))
+			Expect(spec.Devices[0].ContainerEdits.DeviceNodes).To(Equal([]*cdi.DeviceNode{
+				{Path: "/dev/vfio/vfio", Permissions: "rw"},
+				{Path: "/dev/vfio/42", Permissions: "rw"},
+			}))
+			Expect(spec.Devices[1].ContainerEdits.DeviceNodes).To(Equal([]*cdi.DeviceNode{
+				{Path: "/dev/vfio/vfio", Permissions: "rw"},
+				{Path: "/dev/vfio/97", Permissions: "rw"},
+				{Path: "/dev/vfio/98", Permissions: "rw"},
+			}))
+
+			unprepared, err := node.NodeUnprepareResources(context.Background(), &drapb.NodeUnprepareResourcesRequest{Claims: []*drapb.Claim{claim}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unprepared.Claims).To(HaveKeyWithValue("claim-uid", HaveField("Error", BeEmpty())))
+			Expect(filepath.Join(config.CDIRoot, dra.DriverName+"-claim-uid.json")).ToNot(BeAnExistingFile())
+		})
+
+		It("reports claims which cannot be prepared", func() {
+			createClaim(resourceapi.DeviceRequestAllocationResult{Request: "gpu", Driver: dra.DriverName, Pool: nodeName, Device: "pci-0000-ff-00-0"})
+			missing := &drapb.Claim{Namespace: "default", Name: "missing", UID: "missing-uid"}
+
+			resp, err := node.NodePrepareResources(context.Background(), &drapb.NodePrepareResourcesRequest{Claims: []*drapb.Claim{claim, missing}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Claims["claim-uid"].Error).To(ContainSubstring("unknown device pci-0000-ff-00-0"))
+			Expect(resp.Claims["missing-uid"].Error).To(ContainSubstring("not found"))
+		})
+
+		It("removes the sockets when stopped", func() {
+			Expect(driver.Stop()).To(Succeed())
+			Expect(filepath.Join(config.RegistrarDir, dra.DriverName+"-reg.sock")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(config.PluginDir, "dra.sock")).ToNot(BeAnExistingFile())
+			Expect(driver.Ready()).ToNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,156 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha4"
+
+	"kubevirt-nvidia-device-plugin/pkg/cdi"
+)
+
+// cdiKind is the CDI kind of the devices handed out for the prepared claims
+const cdiKind = DriverName + "/vfio"
+
+// NodePrepareResources hands out the devices allocated to the claims. The CDI spec written for
+// each claim makes the runtime create the /dev/vfio nodes and set the KubeVirt environment variables.
+func (d *Driver) NodePrepareResources(ctx context.Context, req *drapb.NodePrepareResourcesRequest) (*drapb.NodePrepareResourcesResponse, error) {
+	resp := &drapb.NodePrepareResourcesResponse{Claims: map[string]*drapb.NodePrepareResourceResponse{}}
+	for _, claim := range req.Claims {
+		devices, err := d.prepareClaim(ctx, claim)
+		if err != nil {
+			klog.ErrorS(err, "Failed to prepare claim", "claim", klog.KRef(claim.Namespace, claim.Name), "uid", claim.UID)
+			resp.Claims[claim.UID] = &drapb.NodePrepareResourceResponse{Error: err.Error()}
+			continue
+		}
+		resp.Claims[claim.UID] = &drapb.NodePrepareResourceResponse{Devices: devices}
+	}
+	return resp, nil
+}
+
+func (d *Driver) prepareClaim(ctx context.Context, claim *drapb.Claim) ([]*drapb.Device, error) {
+	d.mu.Lock()
+	devices, ok := d.prepared[claim.UID]
+	d.mu.Unlock()
+	if ok {
+		// kubelet prepares a claim again after restarting
+		return devices, nil
+	}
+
+	resourceClaim, err := d.client.ResourceV1alpha3().ResourceClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting resource claim: %w", err)
+	}
+	if string(resourceClaim.UID) != claim.UID {
+		return nil, fmt.Errorf("resource claim %s/%s was recreated, expected UID %s but got %s", claim.Namespace, claim.Name, claim.UID, resourceClaim.UID)
+	}
+	if resourceClaim.Status.Allocation == nil {
+		return nil, fmt.Errorf("resource claim %s/%s is not allocated", claim.Namespace, claim.Name)
+	}
+
+	spec := &cdi.Spec{
+		Version: cdi.Version,
+		Kind:    cdiKind,
+	}
+	// KubeVirt expects every PCI address of a resource in a single environment variable
+	envVars := map[string][]string{}
+	requests := map[string][]string{}
+	var allocated []*Device
+	for _, result := range resourceClaim.Status.Allocation.Devices.Results {
+		if result.Driver != DriverName || result.Pool != d.config.NodeName {
+			continue
+		}
+		device, ok := d.devices[result.Device]
+		if !ok {
+			return nil, fmt.Errorf("resource claim %s/%s is allocated unknown device %s", claim.Namespace, claim.Name, result.Device)
+		}
+		if _, seen := requests[device.Name]; !seen {
+			allocated = append(allocated, device)
+			envVars[device.EnvVar] = append(envVars[device.EnvVar], device.PCIAddress)
+			for _, companion := range device.Companions {
+				envVars[device.CompanionsEnvVar] = append(envVars[device.CompanionsEnvVar], companion.PCIAddress)
+			}
+		}
+		requests[device.Name] = append(requests[device.Name], result.Request)
+	}
+
+	devices = make([]*drapb.Device, 0, len(allocated))
+	for _, device := range allocated {
+		name := cdiDeviceName(claim.UID, device)
+		spec.Devices = append(spec.Devices, cdi.Device{
+			Name:           name,
+			ContainerEdits: cdi.ContainerEdits{DeviceNodes: deviceNodes(device)},
+		})
+		devices = append(devices, &drapb.Device{
+			RequestNames: requests[device.Name],
+			PoolName:     d.config.NodeName,
+			DeviceName:   device.Name,
+			CDIDeviceIDs: []string{cdi.QualifiedName(cdiKind, name)},
+		})
+		klog.V(2).InfoS("Preparing device", "claim", klog.KObj(resourceClaim), "device", device.Name, "pciAddress", device.PCIAddress, "iommuGroup", device.IOMMUGroup)
+	}
+	spec.ContainerEdits.Env = formatEnv(envVars)
+
+	if err := cdi.WriteSpec(d.config.CDIRoot, cdiSpecName(claim.UID), spec); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.prepared[claim.UID] = devices
+	d.mu.Unlock()
+	klog.InfoS("Prepared claim", "claim", klog.KObj(resourceClaim), "uid", claim.UID, "devices", len(devices), "env", spec.ContainerEdits.Env)
+	return devices, nil
+}
+
+// NodeUnprepareResources releases the devices of the claims by removing their CDI specs
+func (d *Driver) NodeUnprepareResources(ctx context.Context, req *drapb.NodeUnprepareResourcesRequest) (*drapb.NodeUnprepareResourcesResponse, error) {
+	resp := &drapb.NodeUnprepareResourcesResponse{Claims: map[string]*drapb.NodeUnprepareResourceResponse{}}
+	for _, claim := range req.Claims {
+		// The spec is named after the claim UID, so it is found even if the claim was prepared before a restart
+		if err := cdi.RemoveSpec(d.config.CDIRoot, cdiSpecName(claim.UID)); err != nil {
+			klog.ErrorS(err, "Failed to unprepare claim", "claim", klog.KRef(claim.Namespace, claim.Name), "uid", claim.UID)
+			resp.Claims[claim.UID] = &drapb.NodeUnprepareResourceResponse{Error: err.Error()}
+			continue
+		}
+		d.mu.Lock()
+		delete(d.prepared, claim.UID)
+		d.mu.Unlock()
+		klog.InfoS("Unprepared claim", "claim", klog.KRef(claim.Namespace, claim.Name), "uid", claim.UID)
+		resp.Claims[claim.UID] = &drapb.NodeUnprepareResourceResponse{}
+	}
+	return resp, nil
+}
+
+// deviceNodes returns the VFIO device nodes of the device and of the IOMMU groups of its companions
+func deviceNodes(device *Device) []*cdi.DeviceNode {
+	nodes := cdi.VFIODeviceNodes(device.IOMMUGroup)
+	groups := map[string]bool{device.IOMMUGroup: true}
+	for _, companion := range device.Companions {
+		if groups[companion.IOMMUGroup] {
+			continue
+		}
+		groups[companion.IOMMUGroup] = true
+		nodes = append(nodes, cdi.VFIOGroupDeviceNode(companion.IOMMUGroup))
+	}
+	return nodes
+}
+
+func formatEnv(envVars map[string][]string) []string {
+	env := make([]string, 0, len(envVars))
+	for name, pciAddresses := range envVars {
+		env = append(env, fmt.Sprintf("%s=%s", name, strings.Join(pciAddresses, ",")))
+	}
+	sort.Strings(env)
+	return env
+}
+
+func cdiSpecName(claimUID string) string {
+	return fmt.Sprintf("%s-%s", DriverName, claimUID)
+}
+
+func cdiDeviceName(claimUID string, device *Device) string {
+	return fmt.Sprintf("%s-%s", claimUID, device.Name)
+}
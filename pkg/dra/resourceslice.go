@@ -0,0 +1,118 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+)
+
+// Device attributes published in the resource slice, usable in CEL selectors
+// as device.attributes["passthrough.nvidia.com"].<name>
+const (
+	AttributeModel      = "model"
+	AttributeDeviceID   = "deviceID"
+	AttributePCIAddress = "pciAddress"
+	AttributeNUMANode   = "numaNode"
+	AttributeIOMMUGroup = "iommuGroup"
+	AttributePCIeRoot   = "pcieRoot"
+)
+
+// ResourceSliceName returns the name of the resource slice publishing the devices of a node
+func ResourceSliceName(nodeName string) string {
+	return fmt.Sprintf("%s-%s", nodeName, DriverName)
+}
+
+// PublishResources creates or updates the resource slice describing the devices of the node.
+// The slice is owned by the node, so it is deleted along with the node.
+func (d *Driver) PublishResources(ctx context.Context) error {
+	node, err := d.client.CoreV1().Nodes().Get(ctx, d.config.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting node %s: %w", d.config.NodeName, err)
+	}
+
+	slices := d.client.ResourceV1alpha3().ResourceSlices()
+	spec := d.resourceSliceSpec()
+	slice, err := slices.Get(ctx, ResourceSliceName(d.config.NodeName), metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		slice = &resourceapi.ResourceSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: ResourceSliceName(d.config.NodeName),
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Node",
+					Name:       node.Name,
+					UID:        node.UID,
+				}},
+			},
+			Spec: spec,
+		}
+		if _, err := slices.Create(ctx, slice, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("creating resource slice: %w", err)
+		}
+		klog.InfoS("Created resource slice", "resourceSlice", slice.Name, "devices", len(spec.Devices))
+	case err != nil:
+		return fmt.Errorf("getting resource slice: %w", err)
+	default:
+		// The scheduler only considers the slices of the latest pool generation
+		spec.Pool.Generation = slice.Spec.Pool.Generation
+		if apiequality.Semantic.DeepEqual(slice.Spec, spec) {
+			klog.V(2).InfoS("Resource slice is up to date", "resourceSlice", slice.Name)
+			break
+		}
+		spec.Pool.Generation++
+		slice.Spec = spec
+		if _, err := slices.Update(ctx, slice, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("updating resource slice: %w", err)
+		}
+		klog.InfoS("Updated resource slice", "resourceSlice", slice.Name, "devices", len(spec.Devices), "generation", spec.Pool.Generation)
+	}
+	d.published.Store(true)
+	return nil
+}
+
+func (d *Driver) resourceSliceSpec() resourceapi.ResourceSliceSpec {
+	names := make([]string, 0, len(d.devices))
+	for name := range d.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	devices := make([]resourceapi.Device, 0, len(names))
+	for _, name := range names {
+		device := d.devices[name]
+		attributes := map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+			AttributeModel:      {StringValue: ptr.To(device.Model)},
+			AttributeDeviceID:   {StringValue: ptr.To(device.DeviceID)},
+			AttributePCIAddress: {StringValue: ptr.To(device.PCIAddress)},
+			AttributeIOMMUGroup: {StringValue: ptr.To(device.IOMMUGroup)},
+		}
+		if device.NUMANode >= 0 {
+			attributes[AttributeNUMANode] = resourceapi.DeviceAttribute{IntValue: ptr.To(int64(device.NUMANode))}
+		}
+		if device.PCIeRoot != "" {
+			attributes[AttributePCIeRoot] = resourceapi.DeviceAttribute{StringValue: ptr.To(device.PCIeRoot)}
+		}
+		devices = append(devices, resourceapi.Device{
+			Name:  name,
+			Basic: &resourceapi.BasicDevice{Attributes: attributes},
+		})
+	}
+
+	return resourceapi.ResourceSliceSpec{
+		Driver:   DriverName,
+		NodeName: d.config.NodeName,
+		Pool: resourceapi.ResourcePool{
+			Name:               d.config.NodeName,
+			ResourceSliceCount: 1,
+		},
+		Devices: devices,
+	}
+}
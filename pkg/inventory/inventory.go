@@ -0,0 +1,222 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	klog "k8s.io/klog/v2"
+
+	"kubevirt-nvidia-device-plugin/pkg/backoff"
+)
+
+// Inventory keeps the NvidiaPassthroughNode of a node up to date.
+// The methods of a nil Inventory do nothing, so callers do not have to check whether it is enabled.
+type Inventory struct {
+	client   dynamic.Interface
+	nodeName string
+	owner    []metav1.OwnerReference
+
+	mu      sync.Mutex
+	devices map[string]*Device // indexed by PCI address
+	changed chan struct{}
+}
+
+// New returns the inventory of the given node
+func New(client dynamic.Interface, nodeName string) *Inventory {
+	return &Inventory{
+		client:   client,
+		nodeName: nodeName,
+		devices:  map[string]*Device{},
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// SetNodeOwner makes the node own its inventory, so the inventory is deleted along with the node
+func (i *Inventory) SetNodeOwner(uid types.UID) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.owner = []metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       i.nodeName,
+		UID:        uid,
+	}}
+}
+
+// SetDevices replaces the inventory with the given devices
+func (i *Inventory) SetDevices(devices []Device) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.devices = make(map[string]*Device, len(devices))
+	for _, d := range devices {
+		d := d
+		i.devices[d.PCIAddress] = &d
+	}
+	i.mu.Unlock()
+	i.notify()
+}
+
+// SetHealth records the health of a device and the error which made it unhealthy, empty once
+// the device recovered
+func (i *Inventory) SetHealth(pciAddress string, health string, lastError string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	d, ok := i.devices[pciAddress]
+	if !ok || (d.Health == health && d.LastError == lastError) {
+		i.mu.Unlock()
+		return
+	}
+	d.Health = health
+	d.LastError = lastError
+	i.mu.Unlock()
+	i.notify()
+}
+
+// SetAllocation records the container a device is allocated to, nil if the device was released
+func (i *Inventory) SetAllocation(pciAddress string, allocation *Allocation) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	d, ok := i.devices[pciAddress]
+	if !ok || reflect.DeepEqual(d.Allocation, allocation) {
+		i.mu.Unlock()
+		return
+	}
+	d.Allocation = allocation
+	i.mu.Unlock()
+	i.notify()
+}
+
+// Devices returns a copy of the inventory sorted by PCI address
+func (i *Inventory) Devices() []Device {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	devices := make([]Device, 0, len(i.devices))
+	for _, d := range i.devices {
+		devices = append(devices, *d)
+	}
+	sort.Slice(devices, func(a, b int) bool {
+		return devices[a].PCIAddress < devices[b].PCIAddress
+	})
+	return devices
+}
+
+func (i *Inventory) notify() {
+	select {
+	case i.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes the inventory whenever it changes until ctx is cancelled.
+// Failed writes are retried with exponential backoff.
+func (i *Inventory) Run(ctx context.Context) {
+	if i == nil {
+		return
+	}
+	b := backoff.New()
+	retry := time.NewTimer(0)
+	retry.Stop()
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-i.changed:
+		case <-retry.C:
+		}
+
+		if err := i.Sync(ctx); err != nil {
+			delay := b.Step()
+			klog.ErrorS(err, "Failed to update device inventory, retrying", "node", i.nodeName, "retryIn", delay.Round(time.Millisecond))
+			retry.Reset(delay)
+			continue
+		}
+		b = backoff.New()
+	}
+}
+
+// Sync writes the current inventory to the NvidiaPassthroughNode of the node, creating it if needed
+func (i *Inventory) Sync(ctx context.Context) error {
+	i.mu.Lock()
+	owner := i.owner
+	i.mu.Unlock()
+
+	desired := &NvidiaPassthroughNode{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: Group + "/" + Version,
+			Kind:       Kind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            i.nodeName,
+			OwnerReferences: owner,
+		},
+		Status: NvidiaPassthroughNodeStatus{
+			Devices:        i.Devices(),
+			LastUpdateTime: metav1.Now(),
+		},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return err
+	}
+
+	resource := i.client.Resource(GroupVersionResource)
+	current, err := resource.Get(ctx, i.nodeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// The status subresource is ignored on creation
+		current, err = resource.Create(ctx, &unstructured.Unstructured{Object: content}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("creating %s %s: %w", Kind, i.nodeName, err)
+		}
+		klog.InfoS("Created device inventory", "node", i.nodeName)
+	} else if err != nil {
+		return fmt.Errorf("getting %s %s: %w", Kind, i.nodeName, err)
+	}
+
+	current.Object["status"] = content["status"]
+	if _, err := resource.UpdateStatus(ctx, current, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating status of %s %s: %w", Kind, i.nodeName, err)
+	}
+	klog.V(2).InfoS("Updated device inventory", "node", i.nodeName, "devices", len(desired.Status.Devices))
+	return nil
+}
+
+// List returns the device inventories of all the nodes
+func List(ctx context.Context, client dynamic.Interface) ([]NvidiaPassthroughNode, error) {
+	list, err := client.Resource(GroupVersionResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", Kind, err)
+	}
+	nodes := make([]NvidiaPassthroughNode, 0, len(list.Items))
+	for _, item := range list.Items {
+		var node NvidiaPassthroughNode
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &node); err != nil {
+			return nil, fmt.Errorf("decoding %s %s: %w", Kind, item.GetName(), err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,144 @@
+package inventory_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+)
+
+const nodeName = "worker-0"
+
+var _ = Describe("Inventory", func() {
+	var (
+		client *dynamicfake.FakeDynamicClient
+		inv    *inventory.Inventory
+	)
+
+	devices := []inventory.Device{
+		{
+			PCIAddress:   "0000:1b:00.0",
+			DeviceID:     "2330",
+			Name:         "GH100_H100_SXM5_80GB",
+			ResourceName: "nvidia.com/GH100_H100_SXM5_80GB",
+			IOMMUGroup:   "42",
+			NUMANode:     0,
+			Driver:       "vfio-pci",
+			Health:       "Healthy",
+		},
+		{
+			PCIAddress:   "0000:0a:00.0",
+			DeviceID:     "22a3",
+			Name:         "GH100_H100_NVSwitch",
+			ResourceName: "nvidia.com/GH100_H100_NVSwitch",
+			IOMMUGroup:   "17",
+			NUMANode:     -1,
+			Driver:       "nvidia",
+			Health:       "Unhealthy",
+			LastError:    `device is bound to "nvidia" instead of vfio-pci`,
+		},
+	}
+
+	getInventory := func() *inventory.NvidiaPassthroughNode {
+		u, err := client.Resource(inventory.GroupVersionResource).Get(context.Background(), nodeName, metav1.GetOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		node := &inventory.NvidiaPassthroughNode{}
+		Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, node)).To(Succeed())
+		return node
+	}
+
+	BeforeEach(func() {
+		client = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{inventory.GroupVersionResource: inventory.Kind + "List"})
+		inv = inventory.New(client, nodeName)
+	})
+
+	It("creates the inventory of the node", func() {
+		inv.SetNodeOwner("node-uid")
+		inv.SetDevices(devices)
+		Expect(inv.Sync(context.Background())).To(Succeed())
+
+		node := getInventory()
+		Expect(node.Name).To(Equal(nodeName))
+		Expect(node.OwnerReferences).To(ConsistOf(HaveField("UID", BeEquivalentTo("node-uid"))))
+		Expect(node.Status.Devices).To(Equal([]inventory.Device{devices[1], devices[0]}))
+	})
+
+	It("updates the inventory of the node", func() {
+		existing := &unstructured.Unstructured{}
+		existing.SetAPIVersion(inventory.Group + "/" + inventory.Version)
+		existing.SetKind(inventory.Kind)
+		existing.SetName(nodeName)
+		_, err := client.Resource(inventory.GroupVersionResource).Create(context.Background(), existing, metav1.CreateOptions{})
+		Expect(err).ToNot(HaveOccurred())
+
+		inv.SetDevices(devices[:1])
+		Expect(inv.Sync(context.Background())).To(Succeed())
+		Expect(getInventory().Status.Devices).To(Equal(devices[:1]))
+	})
+
+	It("records health changes and their cause", func() {
+		inv.SetDevices(devices)
+		inv.SetHealth("0000:1b:00.0", "Unhealthy", "/dev/vfio/42 was removed")
+		Expect(inv.Sync(context.Background())).To(Succeed())
+
+		device := getInventory().Status.Devices[1]
+		Expect(device.Health).To(Equal("Unhealthy"))
+		Expect(device.LastError).To(Equal("/dev/vfio/42 was removed"))
+
+		// The error is cleared once the device recovers
+		inv.SetHealth("0000:1b:00.0", "Healthy", "")
+		Expect(inv.Sync(context.Background())).To(Succeed())
+		device = getInventory().Status.Devices[1]
+		Expect(device.Health).To(Equal("Healthy"))
+		Expect(device.LastError).To(BeEmpty())
+	})
+
+	It("ignores health changes of unknown devices", func() {
+		inv.SetDevices(devices)
+		inv.SetHealth("0000:ff:00.0", "Unhealthy", "unknown")
+		Expect(inv.Devices()).To(ConsistOf(devices))
+	})
+
+	It("does nothing when disabled", func() {
+		var disabled *inventory.Inventory
+		disabled.SetDevices(devices)
+		disabled.SetHealth("0000:1b:00.0", "Unhealthy", "")
+		Expect(disabled.Devices()).To(BeEmpty())
+	})
+
+	It("lists the inventories of all nodes", func() {
+		inv.SetDevices(devices)
+		Expect(inv.Sync(context.Background())).To(Succeed())
+		other := inventory.New(client, "worker-1")
+		other.SetDevices(devices[:1])
+		Expect(other.Sync(context.Background())).To(Succeed())
+
+		nodes, err := inventory.List(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nodes).To(HaveLen(2))
+		Expect(nodes).To(ContainElement(And(
+			HaveField("Name", "worker-1"),
+			HaveField("Status.Devices", ConsistOf(devices[0])),
+		)))
+	})
+
+	It("records the allocation of devices", func() {
+		inv.SetDevices(devices)
+		allocation := &inventory.Allocation{Namespace: "vms", Pod: "virt-launcher-gpu-vm-x7k2p", Container: "compute", VMI: "gpu-vm"}
+		inv.SetAllocation("0000:1b:00.0", allocation)
+		Expect(inv.Sync(context.Background())).To(Succeed())
+		Expect(getInventory().Status.Devices[1].Allocation).To(Equal(allocation))
+
+		inv.SetAllocation("0000:1b:00.0", nil)
+		Expect(inv.Sync(context.Background())).To(Succeed())
+		Expect(getInventory().Status.Devices[1].Allocation).To(BeNil())
+	})
+})
@@ -0,0 +1,67 @@
+package inventory
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group   = "passthrough.nvidia.com"
+	Version = "v1alpha1"
+	Kind    = "NvidiaPassthroughNode"
+)
+
+// GroupVersionResource identifies the cluster-scoped NvidiaPassthroughNode resource
+var GroupVersionResource = schema.GroupVersionResource{
+	Group:    Group,
+	Version:  Version,
+	Resource: "nvidiapassthroughnodes",
+}
+
+// NvidiaPassthroughNode is the device inventory of a node. It is named after the node.
+type NvidiaPassthroughNode struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status NvidiaPassthroughNodeStatus `json:"status,omitempty"`
+}
+
+// NvidiaPassthroughNodeStatus lists the passthrough devices discovered on the node
+type NvidiaPassthroughNodeStatus struct {
+	Devices        []Device    `json:"devices,omitempty"`
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// Device describes a discovered PCI function
+type Device struct {
+	PCIAddress string `json:"pciAddress"`
+	VendorID   string `json:"vendorID"`
+	DeviceID   string `json:"deviceID"`
+	// Class is the PCI class code, e.g. 030200, and Kind its role on the board, e.g. gpu
+	Class string `json:"class,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	Name  string `json:"name"`
+	// Vendor and Subsystem are the pci.ids names of the vendor and of the board, empty if unknown
+	Vendor       string `json:"vendor,omitempty"`
+	Subsystem    string `json:"subsystem,omitempty"`
+	ResourceName string `json:"resourceName"`
+	IOMMUGroup   string `json:"iommuGroup"`
+	// NUMANode is -1 if the device is not attached to a NUMA node
+	NUMANode  int    `json:"numaNode"`
+	Driver    string `json:"driver"`
+	Health    string `json:"health"`
+	LastError string `json:"lastError,omitempty"`
+	// Companions are the PCI addresses of the functions passed through with the device, e.g. its HDMI audio
+	Companions []string `json:"companions,omitempty"`
+	// Allocation is the container the device is allocated to, nil if the device is free
+	Allocation *Allocation `json:"allocation,omitempty"`
+}
+
+// Allocation describes the container a device is allocated to
+type Allocation struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	// VMI is the VirtualMachineInstance run by the pod, empty for other pods
+	VMI string `json:"vmi,omitempty"`
+}
@@ -0,0 +1,13 @@
+package kubevirtconfig_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestKubevirtConfig(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "KubeVirt Config Suite")
+}
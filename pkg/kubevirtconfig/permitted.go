@@ -0,0 +1,128 @@
+package kubevirtconfig
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	klog "k8s.io/klog/v2"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/client-go/kubevirt"
+
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+)
+
+// PCIHostDevices returns the permitted PCI host devices advertised by the device plugin for the
+// given devices, one per resource name and vendor selector, sorted by resource name and selector.
+func PCIHostDevices(devices []inventory.Device) []kubevirtv1.PciHostDevice {
+	seen := map[kubevirtv1.PciHostDevice]bool{}
+	var hostDevices []kubevirtv1.PciHostDevice
+	for _, device := range devices {
+		hostDevice := kubevirtv1.PciHostDevice{
+			PCIVendorSelector:        strings.ToUpper(fmt.Sprintf("%s:%s", device.VendorID, device.DeviceID)),
+			ResourceName:             device.ResourceName,
+			ExternalResourceProvider: true,
+		}
+		if seen[hostDevice] {
+			continue
+		}
+		seen[hostDevice] = true
+		hostDevices = append(hostDevices, hostDevice)
+	}
+
+	sort.Slice(hostDevices, func(i, j int) bool {
+		if hostDevices[i].ResourceName != hostDevices[j].ResourceName {
+			return hostDevices[i].ResourceName < hostDevices[j].ResourceName
+		}
+		return hostDevices[i].PCIVendorSelector < hostDevices[j].PCIVendorSelector
+	})
+	return hostDevices
+}
+
+// Merge returns the permitted PCI host devices with the given devices added. Existing entries with
+// the same resource name and vendor selector are replaced, other entries are kept in place: a
+// resource named by a selector may be advertised for other device IDs by other nodes.
+func Merge(existing []kubevirtv1.PciHostDevice, hostDevices []kubevirtv1.PciHostDevice) []kubevirtv1.PciHostDevice {
+	replaced := map[string]bool{}
+	for _, hostDevice := range hostDevices {
+		replaced[mergeKey(hostDevice)] = true
+	}
+
+	merged := make([]kubevirtv1.PciHostDevice, 0, len(existing)+len(hostDevices))
+	for _, hostDevice := range existing {
+		if replaced[mergeKey(hostDevice)] {
+			continue
+		}
+		merged = append(merged, hostDevice)
+	}
+	return append(merged, hostDevices...)
+}
+
+// mergeKey identifies the entries replaced by Merge
+func mergeKey(hostDevice kubevirtv1.PciHostDevice) string {
+	return hostDevice.ResourceName + " " + strings.ToUpper(hostDevice.PCIVendorSelector)
+}
+
+// Reconcile adds the given devices to the permitted host devices of the KubeVirt CR in namespace.
+// If name is empty, the namespace must hold a single KubeVirt CR. It returns whether the CR changed.
+func Reconcile(ctx context.Context, client kubevirt.Interface, namespace string, name string, hostDevices []kubevirtv1.PciHostDevice) (bool, error) {
+	changed := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		kv, err := get(ctx, client, namespace, name)
+		if err != nil {
+			return err
+		}
+
+		config := &kv.Spec.Configuration
+		if config.PermittedHostDevices == nil {
+			config.PermittedHostDevices = &kubevirtv1.PermittedHostDevices{}
+		}
+		merged := Merge(config.PermittedHostDevices.PciHostDevices, hostDevices)
+		if equal(config.PermittedHostDevices.PciHostDevices, merged) {
+			klog.InfoS("Permitted host devices are up to date", "kubevirt", klog.KObj(kv))
+			return nil
+		}
+		config.PermittedHostDevices.PciHostDevices = merged
+		if _, err := client.KubevirtV1().KubeVirts(kv.Namespace).Update(ctx, kv, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		changed = true
+		klog.InfoS("Updated permitted host devices", "kubevirt", klog.KObj(kv), "pciHostDevices", len(merged))
+		return nil
+	})
+	return changed, err
+}
+
+func get(ctx context.Context, client kubevirt.Interface, namespace string, name string) (*kubevirtv1.KubeVirt, error) {
+	if name != "" {
+		kv, err := client.KubevirtV1().KubeVirts(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("getting KubeVirt %s/%s: %w", namespace, name, err)
+		}
+		return kv, nil
+	}
+
+	list, err := client.KubevirtV1().KubeVirts(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing KubeVirt in %s: %w", namespace, err)
+	}
+	if len(list.Items) != 1 {
+		return nil, fmt.Errorf("expected a single KubeVirt in %s, found %d", namespace, len(list.Items))
+	}
+	return &list.Items[0], nil
+}
+
+func equal(a []kubevirtv1.PciHostDevice, b []kubevirtv1.PciHostDevice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
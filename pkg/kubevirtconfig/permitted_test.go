@@ -0,0 +1,114 @@
+package kubevirtconfig_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/client-go/kubevirt/fake"
+
+	"kubevirt-nvidia-device-plugin/pkg/inventory"
+	"kubevirt-nvidia-device-plugin/pkg/kubevirtconfig"
+)
+
+var h100 = kubevirtv1.PciHostDevice{
+	PCIVendorSelector:        "10DE:2330",
+	ResourceName:             "nvidia.com/GH100_H100_SXM5_80GB",
+	ExternalResourceProvider: true,
+}
+
+var nvswitch = kubevirtv1.PciHostDevice{
+	PCIVendorSelector:        "10DE:22A3",
+	ResourceName:             "nvidia.com/GH100_H100_NVSwitch",
+	ExternalResourceProvider: true,
+}
+
+var nic = kubevirtv1.PciHostDevice{
+	PCIVendorSelector: "15B3:101D",
+	ResourceName:      "mellanox.com/ConnectX-6",
+}
+
+var _ = Describe("PCIHostDevices", func() {
+	It("returns one entry per resource", func() {
+		devices := []inventory.Device{
+			{PCIAddress: "0000:1b:00.0", VendorID: "10de", DeviceID: "2330", ResourceName: h100.ResourceName},
+			{PCIAddress: "0000:0a:00.0", VendorID: "10de", DeviceID: "22a3", ResourceName: nvswitch.ResourceName},
+			{PCIAddress: "0000:9a:00.0", VendorID: "10de", DeviceID: "2330", ResourceName: h100.ResourceName},
+		}
+		Expect(kubevirtconfig.PCIHostDevices(devices)).To(Equal([]kubevirtv1.PciHostDevice{nvswitch, h100}))
+	})
+
+	It("uses the vendor of the devices", func() {
+		devices := []inventory.Device{
+			{PCIAddress: "0000:3b:00.0", VendorID: "15b3", DeviceID: "a2dc", ResourceName: "nvidia.com/BlueField3"},
+			{PCIAddress: "0000:3b:00.1", VendorID: "15b3", DeviceID: "a2d6", ResourceName: "nvidia.com/BlueField3"},
+		}
+		Expect(kubevirtconfig.PCIHostDevices(devices)).To(Equal([]kubevirtv1.PciHostDevice{
+			{PCIVendorSelector: "15B3:A2D6", ResourceName: "nvidia.com/BlueField3", ExternalResourceProvider: true},
+			{PCIVendorSelector: "15B3:A2DC", ResourceName: "nvidia.com/BlueField3", ExternalResourceProvider: true},
+		}))
+	})
+})
+
+var _ = Describe("Merge", func() {
+	It("keeps other devices and replaces the entries of the same resource and device", func() {
+		outdated := kubevirtv1.PciHostDevice{PCIVendorSelector: "10de:22a3", ResourceName: "nvidia.com/GH100_H100_NVSwitch"}
+		Expect(kubevirtconfig.Merge([]kubevirtv1.PciHostDevice{outdated, nic}, []kubevirtv1.PciHostDevice{nvswitch, h100})).
+			To(Equal([]kubevirtv1.PciHostDevice{nic, nvswitch, h100}))
+	})
+
+	It("keeps the other device IDs of a resource", func() {
+		// another node advertises nvidia.com/BlueField3 for a different device ID
+		otherNode := kubevirtv1.PciHostDevice{PCIVendorSelector: "15B3:A2DC", ResourceName: "nvidia.com/BlueField3", ExternalResourceProvider: true}
+		bluefield := kubevirtv1.PciHostDevice{PCIVendorSelector: "15B3:A2D6", ResourceName: "nvidia.com/BlueField3", ExternalResourceProvider: true}
+		Expect(kubevirtconfig.Merge([]kubevirtv1.PciHostDevice{otherNode}, []kubevirtv1.PciHostDevice{bluefield})).
+			To(Equal([]kubevirtv1.PciHostDevice{otherNode, bluefield}))
+	})
+
+	It("keeps the entries of a device under another resource name", func() {
+		renamed := kubevirtv1.PciHostDevice{PCIVendorSelector: "10DE:2330", ResourceName: "example.com/H100", ExternalResourceProvider: true}
+		Expect(kubevirtconfig.Merge([]kubevirtv1.PciHostDevice{renamed}, []kubevirtv1.PciHostDevice{h100})).
+			To(Equal([]kubevirtv1.PciHostDevice{renamed, h100}))
+	})
+})
+
+var _ = Describe("Reconcile", func() {
+	kubeVirt := func(name string, hostDevices ...kubevirtv1.PciHostDevice) *kubevirtv1.KubeVirt {
+		kv := &kubevirtv1.KubeVirt{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kubevirt"}}
+		if len(hostDevices) > 0 {
+			kv.Spec.Configuration.PermittedHostDevices = &kubevirtv1.PermittedHostDevices{PciHostDevices: hostDevices}
+		}
+		return kv
+	}
+
+	getHostDevices := func(client *fake.Clientset) []kubevirtv1.PciHostDevice {
+		kv, err := client.KubevirtV1().KubeVirts("kubevirt").Get(context.Background(), "kubevirt", metav1.GetOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kv.Spec.Configuration.PermittedHostDevices).ToNot(BeNil())
+		return kv.Spec.Configuration.PermittedHostDevices.PciHostDevices
+	}
+
+	It("adds the devices to the only KubeVirt CR", func() {
+		client := fake.NewSimpleClientset(kubeVirt("kubevirt"))
+		changed, err := kubevirtconfig.Reconcile(context.Background(), client, "kubevirt", "", []kubevirtv1.PciHostDevice{h100})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(getHostDevices(client)).To(Equal([]kubevirtv1.PciHostDevice{h100}))
+	})
+
+	It("does not update an up to date KubeVirt CR", func() {
+		client := fake.NewSimpleClientset(kubeVirt("kubevirt", nic, h100))
+		changed, err := kubevirtconfig.Reconcile(context.Background(), client, "kubevirt", "kubevirt", []kubevirtv1.PciHostDevice{h100})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(getHostDevices(client)).To(Equal([]kubevirtv1.PciHostDevice{nic, h100}))
+	})
+
+	It("requires the name when there are several KubeVirt CRs", func() {
+		client := fake.NewSimpleClientset(kubeVirt("kubevirt"), kubeVirt("other"))
+		_, err := kubevirtconfig.Reconcile(context.Background(), client, "kubevirt", "", []kubevirtv1.PciHostDevice{h100})
+		Expect(err).To(MatchError(ContainSubstring("found 2")))
+	})
+})
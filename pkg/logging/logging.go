@@ -0,0 +1,66 @@
+package logging
+
+import (
+	goflag "flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/go-logr/logr/funcr"
+	flag "github.com/spf13/pflag"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Options holds the logging configuration
+type Options struct {
+	// Format is either FormatText for the klog header format or FormatJSON for one JSON object per line
+	Format string
+
+	klogFlags *goflag.FlagSet
+}
+
+// AddFlags registers the klog flags, such as -v and --vmodule, and the log format flag
+func (o *Options) AddFlags(fs *flag.FlagSet) {
+	o.klogFlags = goflag.NewFlagSet("klog", goflag.ExitOnError)
+	klog.InitFlags(o.klogFlags)
+	fs.AddGoFlagSet(o.klogFlags)
+	fs.StringVar(&o.Format, "log-format", FormatText, fmt.Sprintf("Log output format, either %q or %q", FormatText, FormatJSON))
+}
+
+// Setup applies the logging configuration. It has to be called after the flags are parsed.
+func (o *Options) Setup() error {
+	switch o.Format {
+	case FormatText, "":
+		return nil
+	case FormatJSON:
+		logger := funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(os.Stderr, obj)
+		}, funcr.Options{
+			LogCaller:    funcr.Error,
+			LogTimestamp: true,
+			Verbosity:    o.verbosity(),
+		})
+		klog.SetLogger(logger)
+		return nil
+	default:
+		return fmt.Errorf("unsupported log format %q", o.Format)
+	}
+}
+
+// verbosity returns the level set by the -v flag. klog filters V() calls with it
+// before they reach the logger, so the JSON logger has to accept the same levels.
+func (o *Options) verbosity() int {
+	if o.klogFlags == nil {
+		return 0
+	}
+	v, err := strconv.Atoi(o.klogFlags.Lookup("v").Value.String())
+	if err != nil {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "kubevirt_nvidia_device_plugin"
+
+var (
+	// PluginState is 1 for the current supervisor state of each device plugin and 0 for the other states
+	PluginState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "plugin_state",
+		Help:      "Current supervisor state of the device plugin serving a resource.",
+	}, []string{"resource", "state"})
+
+	// PluginRestarts counts the restarts of a device plugin component after an unexpected exit
+	PluginRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "plugin_restarts_total",
+		Help:      "Number of times a device plugin component was restarted after exiting unexpectedly.",
+	}, []string{"resource", "component"})
+
+	// PluginRegistered is 1 while the device plugin is registered with kubelet
+	PluginRegistered = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "plugin_registered",
+		Help:      "Whether the device plugin serving a resource is registered with kubelet.",
+	}, []string{"resource"})
+
+	// DeviceAllocation is 1 for every device kubelet allocated to a pod, vmi is empty for pods not running a VMI
+	DeviceAllocation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_allocation",
+		Help:      "Devices allocated to a pod and the VMI it runs, as reported by the kubelet PodResources API.",
+	}, []string{"resource", "pci_address", "namespace", "pod", "vmi"})
+)
+
+func init() {
+	prometheus.MustRegister(PluginState, PluginRestarts, PluginRegistered, DeviceAllocation)
+}
+
+// Handler returns the HTTP handler exposing the registered metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
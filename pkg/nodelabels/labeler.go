@@ -0,0 +1,168 @@
+package nodelabels
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+)
+
+// Prefix is the prefix of every node label owned by the device plugin
+const Prefix = "passthrough.nvidia.com/"
+
+const (
+	labelPresent   = Prefix + "present"
+	labelVFIOReady = Prefix + "vfio-ready"
+)
+
+// Resource describes the passthrough devices advertised under one resource name
+type Resource struct {
+	// Namespace is the namespace of the resource name, selector.DefaultResourceNamespace if empty
+	Namespace string
+	// Name is the device name part of the resource name, e.g. GH100_H100_SXM5_80GB
+	Name string
+	// DeviceID is the PCI device ID shared by the devices
+	DeviceID string
+	// Count is the number of discovered devices
+	Count int
+	// VFIOCount is the number of devices bound to the vfio-pci driver
+	VFIOCount int
+	// NUMANodes lists the NUMA nodes the devices are attached to
+	NUMANodes []int
+}
+
+// Labels returns the node labels describing the resources
+func Labels(resources []Resource) map[string]string {
+	labels := map[string]string{}
+	if len(resources) == 0 {
+		return labels
+	}
+
+	labels[labelPresent] = "true"
+	allReady := true
+	for _, r := range resources {
+		ready := r.Count > 0 && r.VFIOCount == r.Count
+		allReady = allReady && ready
+		labels[resourceLabel(r, "count")] = strconv.Itoa(r.Count)
+		labels[resourceLabel(r, "device-id")] = r.DeviceID
+		labels[resourceLabel(r, "vfio-ready")] = strconv.FormatBool(ready)
+		if len(r.NUMANodes) > 0 {
+			nodes := make([]string, 0, len(r.NUMANodes))
+			for _, n := range r.NUMANodes {
+				nodes = append(nodes, strconv.Itoa(n))
+			}
+			// label values may not contain commas
+			labels[resourceLabel(r, "numa-nodes")] = strings.Join(nodes, "_")
+		}
+	}
+	labels[labelVFIOReady] = strconv.FormatBool(allReady)
+	return labels
+}
+
+// resourceLabel returns the label of a property of the resource, e.g.
+// passthrough.nvidia.com/GH100_H100_SXM5_80GB.count. Device names are only unique within a
+// namespace, the labels of the other namespaces are prefixed with theirs.
+func resourceLabel(r Resource, property string) string {
+	if r.Namespace != "" && r.Namespace != selector.DefaultResourceNamespace {
+		return fmt.Sprintf("%s%s-%s.%s", Prefix, r.Namespace, r.Name, property)
+	}
+	return fmt.Sprintf("%s%s.%s", Prefix, r.Name, property)
+}
+
+// Labeler keeps the device plugin labels of a node up to date
+type Labeler struct {
+	client   kubernetes.Interface
+	nodeName string
+	dryRun   bool
+}
+
+// NewLabeler returns a labeler for the given node. In dry-run mode the label
+// changes are only logged.
+func NewLabeler(client kubernetes.Interface, nodeName string, dryRun bool) *Labeler {
+	return &Labeler{
+		client:   client,
+		nodeName: nodeName,
+		dryRun:   dryRun,
+	}
+}
+
+// Update sets the labels describing the resources on the node and removes
+// the labels it owns which no longer apply
+func (l *Labeler) Update(ctx context.Context, resources []Resource) error {
+	node, err := l.client.CoreV1().Nodes().Get(ctx, l.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting node %s: %w", l.nodeName, err)
+	}
+
+	desired := Labels(resources)
+	for key := range desired {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			klog.ErrorS(nil, "Skipping invalid node label", "node", l.nodeName, "label", key, "reasons", errs)
+			delete(desired, key)
+		}
+	}
+
+	// A nil value removes the label in a merge patch
+	changes := map[string]*string{}
+	for key, value := range node.Labels {
+		if !strings.HasPrefix(key, Prefix) {
+			continue
+		}
+		if _, ok := desired[key]; !ok {
+			changes[key] = nil
+		} else if desired[key] == value {
+			delete(desired, key)
+		}
+	}
+	for key, value := range desired {
+		changes[key] = &value
+	}
+
+	if len(changes) == 0 {
+		klog.V(2).InfoS("Node labels are up to date", "node", l.nodeName)
+		return nil
+	}
+	logChanges(l.nodeName, changes, l.dryRun)
+	if l.dryRun {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"labels": changes,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = l.client.CoreV1().Nodes().Patch(ctx, l.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("patching labels of node %s: %w", l.nodeName, err)
+	}
+	return nil
+}
+
+func logChanges(nodeName string, changes map[string]*string, dryRun bool) {
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if changes[key] == nil {
+			klog.InfoS("Removing node label", "node", nodeName, "label", key, "dryRun", dryRun)
+		} else {
+			klog.InfoS("Setting node label", "node", nodeName, "label", key, "value", *changes[key], "dryRun", dryRun)
+		}
+	}
+}
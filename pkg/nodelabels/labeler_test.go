@@ -0,0 +1,134 @@
+package nodelabels_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"kubevirt-nvidia-device-plugin/pkg/nodelabels"
+)
+
+const nodeName = "worker-0"
+
+var h100 = nodelabels.Resource{
+	Name:      "GH100_H100_SXM5_80GB",
+	DeviceID:  "2330",
+	Count:     8,
+	VFIOCount: 8,
+	NUMANodes: []int{0, 1},
+}
+
+var nvswitch = nodelabels.Resource{
+	Name:      "GH100_H100_NVSwitch",
+	DeviceID:  "22a3",
+	Count:     4,
+	VFIOCount: 3,
+}
+
+var _ = Describe("Labels", func() {
+	It("describes every resource", func() {
+		Expect(nodelabels.Labels([]nodelabels.Resource{h100, nvswitch})).To(Equal(map[string]string{
+			nodelabels.Prefix + "present":                         "true",
+			nodelabels.Prefix + "vfio-ready":                      "false",
+			nodelabels.Prefix + "GH100_H100_SXM5_80GB.count":      "8",
+			nodelabels.Prefix + "GH100_H100_SXM5_80GB.device-id":  "2330",
+			nodelabels.Prefix + "GH100_H100_SXM5_80GB.vfio-ready": "true",
+			nodelabels.Prefix + "GH100_H100_SXM5_80GB.numa-nodes": "0_1",
+			nodelabels.Prefix + "GH100_H100_NVSwitch.count":       "4",
+			nodelabels.Prefix + "GH100_H100_NVSwitch.device-id":   "22a3",
+			nodelabels.Prefix + "GH100_H100_NVSwitch.vfio-ready":  "false",
+		}))
+	})
+
+	It("keeps apart the resources of the same device name in different namespaces", func() {
+		nvidia := h100
+		nvidia.Namespace = "nvidia.com"
+		custom := h100
+		custom.Namespace = "example.com"
+		custom.Count = 2
+		custom.VFIOCount = 1
+
+		labels := nodelabels.Labels([]nodelabels.Resource{nvidia, custom})
+		Expect(labels).To(HaveKeyWithValue(nodelabels.Prefix+"GH100_H100_SXM5_80GB.count", "8"))
+		Expect(labels).To(HaveKeyWithValue(nodelabels.Prefix+"GH100_H100_SXM5_80GB.vfio-ready", "true"))
+		Expect(labels).To(HaveKeyWithValue(nodelabels.Prefix+"example.com-GH100_H100_SXM5_80GB.count", "2"))
+		Expect(labels).To(HaveKeyWithValue(nodelabels.Prefix+"example.com-GH100_H100_SXM5_80GB.vfio-ready", "false"))
+	})
+
+	It("is empty without resources", func() {
+		Expect(nodelabels.Labels(nil)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Labeler", func() {
+	var client *fake.Clientset
+
+	newNode := func(labels map[string]string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName, Labels: labels}}
+	}
+
+	getLabels := func() map[string]string {
+		node, err := client.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		return node.Labels
+	}
+
+	patches := func() int {
+		count := 0
+		for _, action := range client.Actions() {
+			if _, ok := action.(k8stesting.PatchAction); ok {
+				count++
+			}
+		}
+		return count
+	}
+
+	It("adds the labels and keeps labels it does not own", func() {
+		client = fake.NewSimpleClientset(newNode(map[string]string{"kubernetes.io/hostname": nodeName}))
+		Expect(nodelabels.NewLabeler(client, nodeName, false).Update(context.Background(), []nodelabels.Resource{h100})).To(Succeed())
+
+		labels := getLabels()
+		Expect(labels).To(HaveKeyWithValue("kubernetes.io/hostname", nodeName))
+		Expect(labels).To(HaveKeyWithValue(nodelabels.Prefix+"GH100_H100_SXM5_80GB.count", "8"))
+		Expect(labels).To(HaveKeyWithValue(nodelabels.Prefix+"vfio-ready", "true"))
+	})
+
+	It("removes the labels of devices which disappeared", func() {
+		client = fake.NewSimpleClientset(newNode(nodelabels.Labels([]nodelabels.Resource{h100, nvswitch})))
+		Expect(nodelabels.NewLabeler(client, nodeName, false).Update(context.Background(), []nodelabels.Resource{h100})).To(Succeed())
+
+		labels := getLabels()
+		Expect(labels).To(HaveKey(nodelabels.Prefix + "GH100_H100_SXM5_80GB.count"))
+		Expect(labels).ToNot(HaveKey(nodelabels.Prefix + "GH100_H100_NVSwitch.count"))
+		Expect(labels).To(HaveKeyWithValue(nodelabels.Prefix+"vfio-ready", "true"))
+	})
+
+	It("removes all owned labels once no device is left", func() {
+		client = fake.NewSimpleClientset(newNode(nodelabels.Labels([]nodelabels.Resource{h100})))
+		Expect(nodelabels.NewLabeler(client, nodeName, false).Update(context.Background(), nil)).To(Succeed())
+		Expect(getLabels()).To(BeEmpty())
+	})
+
+	It("does not patch a node which is up to date", func() {
+		client = fake.NewSimpleClientset(newNode(nodelabels.Labels([]nodelabels.Resource{h100})))
+		Expect(nodelabels.NewLabeler(client, nodeName, false).Update(context.Background(), []nodelabels.Resource{h100})).To(Succeed())
+		Expect(patches()).To(BeZero())
+	})
+
+	It("does not patch the node in dry-run mode", func() {
+		client = fake.NewSimpleClientset(newNode(nil))
+		Expect(nodelabels.NewLabeler(client, nodeName, true).Update(context.Background(), []nodelabels.Resource{h100})).To(Succeed())
+		Expect(patches()).To(BeZero())
+		Expect(getLabels()).To(BeEmpty())
+	})
+
+	It("fails if the node does not exist", func() {
+		client = fake.NewSimpleClientset()
+		Expect(nodelabels.NewLabeler(client, nodeName, false).Update(context.Background(), []nodelabels.Resource{h100})).ToNot(Succeed())
+	})
+})
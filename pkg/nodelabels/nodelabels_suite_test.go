@@ -0,0 +1,13 @@
+package nodelabels_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestNodeLabels(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Node Labels Suite")
+}
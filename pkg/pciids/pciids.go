@@ -0,0 +1,248 @@
+package pciids
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+)
+
+// DefaultPaths are the locations searched for pci.ids: the file shipped in the image,
+// then the hwdata and pciutils locations of the common distributions
+var DefaultPaths = []string{
+	"/usr/pci.ids",
+	"/usr/share/hwdata/pci.ids",
+	"/usr/share/misc/pci.ids",
+	"/usr/share/misc/pci.ids.gz",
+}
+
+// EmbeddedSource is the source reported by Find when it falls back to the embedded database
+const EmbeddedSource = "embedded"
+
+// Database is a parsed pci.ids file, see https://pci-ids.ucw.cz/
+type Database struct {
+	// Version is the version from the file header, e.g. 2025.04.23, empty if the file has none
+	Version string
+
+	vendors map[string]*Vendor
+	classes map[string]*Class
+}
+
+// Vendor is a PCI vendor and its devices, indexed by device ID
+type Vendor struct {
+	ID      string
+	Name    string
+	Devices map[string]*Device
+}
+
+// Device is a PCI device and its subsystems, indexed by "subvendor subdevice"
+type Device struct {
+	ID         string
+	Name       string
+	Subsystems map[string]string
+}
+
+// Class is a PCI device class and its subclasses, indexed by subclass
+type Class struct {
+	ID         string
+	Name       string
+	Subclasses map[string]*Subclass
+}
+
+// Subclass is a PCI device subclass and its programming interfaces, indexed by interface
+type Subclass struct {
+	ID                    string
+	Name                  string
+	ProgrammingInterfaces map[string]string
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Load parses the pci.ids file at path, which may be gzipped
+func Load(path string) (*Database, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Find loads the first of the given files which exists and parses, falling back to the
+// embedded database. It returns the database and the path it was read from, or EmbeddedSource.
+func Find(paths []string, embedded []byte) (*Database, string, error) {
+	var errs []error
+	for _, path := range paths {
+		db, err := Load(path)
+		if err == nil {
+			return db, path, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			klog.ErrorS(err, "Skipping unreadable pci ids file", "path", path)
+			errs = append(errs, err)
+		}
+	}
+	db, err := Parse(bytes.NewReader(embedded))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("parsing embedded database: %w", err))
+		return nil, "", errors.Join(errs...)
+	}
+	return db, EmbeddedSource, nil
+}
+
+// Parse parses a pci.ids database, which may be gzipped
+func Parse(r io.Reader) (*Database, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	db := &Database{
+		vendors: map[string]*Vendor{},
+		classes: map[string]*Class{},
+	}
+	var vendor *Vendor
+	var device *Device
+	var class *Class
+	var subclass *Subclass
+
+	scanner := bufio.NewScanner(br)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			if version, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(line, "#")), "Version:"); ok && db.Version == "" {
+				db.Version = strings.TrimSpace(version)
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		id, name, ok := splitEntry(line[depth:])
+		if !ok {
+			return nil, fmt.Errorf("line %d: malformed entry %q", lineNumber, line)
+		}
+		isClass := depth == 0 && strings.HasPrefix(id, "C ")
+		id = strings.ToLower(strings.TrimPrefix(id, "C "))
+		switch {
+		case isClass:
+			class = &Class{ID: id, Name: name, Subclasses: map[string]*Subclass{}}
+			db.classes[class.ID] = class
+			vendor, device, subclass = nil, nil, nil
+		case depth == 0:
+			vendor = &Vendor{ID: id, Name: name, Devices: map[string]*Device{}}
+			db.vendors[id] = vendor
+			device, class, subclass = nil, nil, nil
+		case depth == 1 && vendor != nil:
+			device = &Device{ID: id, Name: name, Subsystems: map[string]string{}}
+			vendor.Devices[id] = device
+		case depth == 1 && class != nil:
+			subclass = &Subclass{ID: id, Name: name, ProgrammingInterfaces: map[string]string{}}
+			class.Subclasses[id] = subclass
+		case depth == 2 && device != nil:
+			device.Subsystems[id] = name
+		case depth == 2 && subclass != nil:
+			subclass.ProgrammingInterfaces[id] = name
+		default:
+			return nil, fmt.Errorf("line %d: entry %q has no parent", lineNumber, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// splitEntry splits an entry into its ID and name, which are separated by two spaces.
+// Subsystem IDs are "subvendor subdevice" and class IDs "C class".
+func splitEntry(entry string) (string, string, bool) {
+	id, name, ok := strings.Cut(entry, "  ")
+	if !ok || id == "" {
+		return "", "", false
+	}
+	return id, strings.TrimSpace(name), true
+}
+
+// Vendor returns the vendor with the given ID, or nil if it is unknown
+func (db *Database) Vendor(vendorID string) *Vendor {
+	return db.vendors[strings.ToLower(vendorID)]
+}
+
+// VendorName returns the name of the vendor, or "" if it is unknown
+func (db *Database) VendorName(vendorID string) string {
+	if v := db.Vendor(vendorID); v != nil {
+		return v.Name
+	}
+	return ""
+}
+
+// Device returns the device with the given vendor and device ID, or nil if it is unknown
+func (db *Database) Device(vendorID string, deviceID string) *Device {
+	v := db.Vendor(vendorID)
+	if v == nil {
+		return nil
+	}
+	return v.Devices[strings.ToLower(deviceID)]
+}
+
+// DeviceName returns the name of the device, or "" if it is unknown
+func (db *Database) DeviceName(vendorID string, deviceID string) string {
+	if d := db.Device(vendorID, deviceID); d != nil {
+		return d.Name
+	}
+	return ""
+}
+
+// SubsystemName returns the name of the subsystem of a device, e.g. the OEM board, or "" if it is unknown
+func (db *Database) SubsystemName(vendorID string, deviceID string, subvendorID string, subdeviceID string) string {
+	d := db.Device(vendorID, deviceID)
+	if d == nil {
+		return ""
+	}
+	return d.Subsystems[strings.ToLower(subvendorID+" "+subdeviceID)]
+}
+
+// ClassName returns the most specific name of a class code given as class (03), class and
+// subclass (0302) or class, subclass and programming interface (030200), or "" if it is unknown
+func (db *Database) ClassName(code string) string {
+	code = strings.ToLower(strings.TrimPrefix(code, "0x"))
+	if len(code) < 2 {
+		return ""
+	}
+	class := db.classes[code[:2]]
+	if class == nil {
+		return ""
+	}
+	if len(code) < 4 {
+		return class.Name
+	}
+	subclass := class.Subclasses[code[2:4]]
+	if subclass == nil {
+		return class.Name
+	}
+	if len(code) < 6 {
+		return subclass.Name
+	}
+	if name, ok := subclass.ProgrammingInterfaces[code[4:6]]; ok {
+		return name
+	}
+	return subclass.Name
+}
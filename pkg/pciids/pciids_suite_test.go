@@ -0,0 +1,13 @@
+package pciids_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPCIIDs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PCI IDs Suite")
+}
@@ -0,0 +1,159 @@
+package pciids_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/pciids"
+)
+
+// bundledPath is the pci.ids file shipped in the image
+const bundledPath = "../../utils/pci.ids"
+
+const sample = `#
+#	List of PCI ID's
+#
+#	Version: 2025.04.23
+#
+
+# Syntax:
+# vendor  vendor_name
+10de  NVIDIA Corporation
+	2330  GH100 [H100 SXM5 80GB]
+		10de 16c1  H100 SXM5 80GB
+	22a3  GH100 [H100 NVSwitch]
+15b3  Mellanox Technologies
+# BlueField-3 integrated ConnectX-7 network controller
+	a2dc  MT43244 BlueField-3 integrated ConnectX-7 network controller
+
+C 03  Display controller
+	00  VGA compatible controller
+		00  VGA controller
+	02  3D controller
+C 0c  Serial bus controller
+	03  USB controller
+		30  XHCI
+`
+
+var _ = Describe("Database", func() {
+	var db *pciids.Database
+
+	BeforeEach(func() {
+		var err error
+		db, err = pciids.Parse(strings.NewReader(sample))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reads the version header", func() {
+		Expect(db.Version).To(Equal("2025.04.23"))
+	})
+
+	It("looks up vendors and devices regardless of case", func() {
+		Expect(db.VendorName("15B3")).To(Equal("Mellanox Technologies"))
+		Expect(db.DeviceName("10de", "2330")).To(Equal("GH100 [H100 SXM5 80GB]"))
+		Expect(db.DeviceName("15b3", "A2DC")).To(Equal("MT43244 BlueField-3 integrated ConnectX-7 network controller"))
+		Expect(db.DeviceName("10de", "ffff")).To(BeEmpty())
+		Expect(db.DeviceName("8086", "2330")).To(BeEmpty())
+	})
+
+	It("looks up subsystems", func() {
+		Expect(db.SubsystemName("10de", "2330", "10de", "16c1")).To(Equal("H100 SXM5 80GB"))
+		Expect(db.SubsystemName("10de", "2330", "1028", "16c1")).To(BeEmpty())
+	})
+
+	It("returns the most specific class name", func() {
+		Expect(db.ClassName("03")).To(Equal("Display controller"))
+		Expect(db.ClassName("0302")).To(Equal("3D controller"))
+		Expect(db.ClassName("030200")).To(Equal("3D controller"))
+		Expect(db.ClassName("0x030000")).To(Equal("VGA controller"))
+		Expect(db.ClassName("0c0330")).To(Equal("XHCI"))
+		Expect(db.ClassName("0c99")).To(Equal("Serial bus controller"))
+		Expect(db.ClassName("ff")).To(BeEmpty())
+	})
+
+	It("reads gzipped files", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "pci.ids.gz")
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(sample))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gz.Close()).To(Succeed())
+		Expect(os.WriteFile(path, buf.Bytes(), 0644)).To(Succeed())
+
+		db, err := pciids.Load(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(db.DeviceName("10de", "22a3")).To(Equal("GH100 [H100 NVSwitch]"))
+	})
+
+	It("rejects entries without a parent", func() {
+		_, err := pciids.Parse(strings.NewReader("\t2330  GH100\n"))
+		Expect(err).To(MatchError(ContainSubstring("line 1")))
+	})
+
+	It("parses the bundled database", func() {
+		db, err := pciids.Load(bundledPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(db.Version).NotTo(BeEmpty())
+		Expect(db.VendorName("10de")).To(Equal("NVIDIA Corporation"))
+	})
+})
+
+var _ = Describe("Find", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("falls back to the embedded database", func() {
+		db, source, err := pciids.Find([]string{filepath.Join(dir, "missing")}, []byte(sample))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source).To(Equal(pciids.EmbeddedSource))
+		Expect(db.Version).To(Equal("2025.04.23"))
+	})
+
+	It("uses the first readable file", func() {
+		broken := filepath.Join(dir, "broken.ids")
+		Expect(os.WriteFile(broken, []byte("\t2330  GH100\n"), 0644)).To(Succeed())
+		hwdata := filepath.Join(dir, "pci.ids")
+		Expect(os.WriteFile(hwdata, []byte("#\tVersion: 2024.01.01\n10de  NVIDIA Corporation\n"), 0644)).To(Succeed())
+
+		db, source, err := pciids.Find([]string{filepath.Join(dir, "missing"), broken, hwdata}, []byte(sample))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source).To(Equal(hwdata))
+		Expect(db.Version).To(Equal("2024.01.01"))
+	})
+
+	It("fails if no database parses", func() {
+		_, _, err := pciids.Find(nil, []byte("\t2330  GH100\n"))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func BenchmarkLoad(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := pciids.Load(bundledPath); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeviceName(b *testing.B) {
+	db, err := pciids.Load(bundledPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if db.DeviceName("10de", "2330") == "" {
+			b.Fatal("device not found")
+		}
+	}
+}
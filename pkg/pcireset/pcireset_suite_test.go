@@ -0,0 +1,13 @@
+package pcireset_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPCIReset(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PCI Reset Suite")
+}
@@ -0,0 +1,167 @@
+package pcireset
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+// Method selects how a PCI function is reset
+type Method string
+
+const (
+	// MethodAuto lets the kernel pick the first reset method supported by the device
+	MethodAuto Method = "auto"
+	// MethodFLR is a PCIe function level reset
+	MethodFLR Method = "flr"
+	// MethodPM is a reset through a D3hot to D0 power state transition
+	MethodPM Method = "pm"
+	// MethodBus is a secondary bus reset of the upstream bridge
+	MethodBus Method = "bus"
+)
+
+// Methods lists the supported reset methods
+var Methods = []Method{MethodAuto, MethodFLR, MethodPM, MethodBus}
+
+const (
+	// DefaultVerifyTimeout is how long a device has to come back after the reset
+	DefaultVerifyTimeout = 5 * time.Second
+	verifyInterval       = 100 * time.Millisecond
+	// a device which does not answer config space reads returns all ones
+	absentVendorID = 0xffff
+)
+
+// ParseMethod returns the reset method with the given name
+func ParseMethod(name string) (Method, error) {
+	for _, m := range Methods {
+		if string(m) == name {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown reset method %q, expected one of %v", name, Methods)
+}
+
+// Resetter resets PCI functions through sysfs
+type Resetter struct {
+	// SysfsRoot is the directory of the PCI functions, e.g. /sys/bus/pci/devices
+	SysfsRoot string
+	// Method is the reset method
+	Method Method
+	// VerifyTimeout is how long a device has to come back after the reset
+	VerifyTimeout time.Duration
+}
+
+// New returns a resetter using the given method for the functions under sysfsRoot
+func New(sysfsRoot string, method Method) *Resetter {
+	return &Resetter{
+		SysfsRoot:     sysfsRoot,
+		Method:        method,
+		VerifyTimeout: DefaultVerifyTimeout,
+	}
+}
+
+// Reset resets the function with the given PCI address and waits until it answers with
+// the vendor ID it had before the reset
+func (r *Resetter) Reset(ctx context.Context, pciAddress string) error {
+	devicePath := filepath.Join(r.SysfsRoot, pciAddress)
+	vendorID, err := readVendorID(devicePath)
+	if err != nil {
+		return fmt.Errorf("reading vendor ID of %s: %w", pciAddress, err)
+	}
+	if vendorID == absentVendorID {
+		return fmt.Errorf("device %s does not answer config space reads", pciAddress)
+	}
+
+	if r.Method != MethodAuto {
+		restore, err := selectMethod(devicePath, r.Method)
+		if err != nil {
+			return fmt.Errorf("selecting reset method %s for %s: %w", r.Method, pciAddress, err)
+		}
+		defer restore()
+	}
+
+	start := time.Now()
+	if err := writeAttribute(devicePath, "reset", "1"); err != nil {
+		return fmt.Errorf("resetting %s: %w", pciAddress, err)
+	}
+
+	// the device gets one interval to settle before its config space is read
+	err = wait.PollUntilContextTimeout(ctx, verifyInterval, r.VerifyTimeout, false, func(context.Context) (bool, error) {
+		current, err := readVendorID(devicePath)
+		if err != nil {
+			klog.V(4).InfoS("Device is not readable after reset", "pciAddress", pciAddress, "err", err)
+			return false, nil
+		}
+		return current == vendorID, nil
+	})
+	if err != nil {
+		return fmt.Errorf("device %s did not come back after the %s reset: %w", pciAddress, r.Method, err)
+	}
+	klog.V(2).InfoS("Reset device", "pciAddress", pciAddress, "method", r.Method, "duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// readVendorID reads the vendor ID from the first two bytes of the config space of a function.
+// The vendor attribute is cached by the kernel when the function is enumerated, the config
+// space is read from the device.
+func readVendorID(devicePath string) (uint16, error) {
+	f, err := os.Open(filepath.Join(devicePath, "config"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var vendorID [2]byte
+	if _, err := io.ReadFull(f, vendorID[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(vendorID[:]), nil
+}
+
+// selectMethod restricts the kernel to the given reset method and returns a function
+// restoring the previously allowed methods
+func selectMethod(devicePath string, method Method) (func(), error) {
+	previous, err := readAttribute(devicePath, "reset_method")
+	if err != nil {
+		return nil, fmt.Errorf("the kernel does not support selecting the reset method: %w", err)
+	}
+	if err := writeAttribute(devicePath, "reset_method", string(method)); err != nil {
+		return nil, err
+	}
+	return func() {
+		if previous == "" {
+			previous = "default"
+		}
+		if err := writeAttribute(devicePath, "reset_method", previous); err != nil {
+			klog.ErrorS(err, "Could not restore the reset methods", "device", devicePath, "methods", previous)
+		}
+	}, nil
+}
+
+func readAttribute(devicePath string, attribute string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(devicePath, attribute))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writeAttribute writes an existing sysfs attribute, attributes are never created
+func writeAttribute(devicePath string, attribute string, value string) error {
+	f, err := os.OpenFile(filepath.Join(devicePath, attribute), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(value); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
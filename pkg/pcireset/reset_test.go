@@ -0,0 +1,109 @@
+package pcireset_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/pcireset"
+)
+
+const pciAddress = "0000:1b:00.0"
+
+var _ = Describe("ParseMethod", func() {
+	It("accepts the supported methods", func() {
+		for _, m := range pcireset.Methods {
+			Expect(pcireset.ParseMethod(string(m))).To(Equal(m))
+		}
+	})
+
+	It("rejects unknown methods", func() {
+		_, err := pcireset.ParseMethod("acpi")
+		Expect(err).To(MatchError(ContainSubstring(`unknown reset method "acpi"`)))
+	})
+})
+
+var _ = Describe("Resetter", func() {
+	var (
+		sysfs      string
+		devicePath string
+	)
+
+	writeAttribute := func(attribute string, value string) {
+		Expect(os.WriteFile(filepath.Join(devicePath, attribute), []byte(value), 0644)).To(Succeed())
+	}
+
+	readAttribute := func(attribute string) string {
+		data, err := os.ReadFile(filepath.Join(devicePath, attribute))
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	newResetter := func(method pcireset.Method) *pcireset.Resetter {
+		r := pcireset.New(sysfs, method)
+		r.VerifyTimeout = 300 * time.Millisecond
+		return r
+	}
+
+	BeforeEach(func() {
+		sysfs = GinkgoT().TempDir()
+		devicePath = filepath.Join(sysfs, pciAddress)
+		Expect(os.Mkdir(devicePath, 0755)).To(Succeed())
+		// vendor 10de, device 2330
+		writeAttribute("config", "\xde\x10\x30\x23")
+		writeAttribute("reset", "")
+		writeAttribute("reset_method", "flr bus\n")
+	})
+
+	It("lets the kernel pick the method", func() {
+		Expect(newResetter(pcireset.MethodAuto).Reset(context.Background(), pciAddress)).To(Succeed())
+		Expect(readAttribute("reset")).To(Equal("1"))
+		Expect(readAttribute("reset_method")).To(Equal("flr bus\n"))
+	})
+
+	It("restores the allowed methods after a reset with the configured method", func() {
+		Expect(newResetter(pcireset.MethodBus).Reset(context.Background(), pciAddress)).To(Succeed())
+		Expect(readAttribute("reset")).To(Equal("1"))
+		Expect(readAttribute("reset_method")).To(Equal("flr bus"))
+	})
+
+	It("fails if the kernel cannot select the method", func() {
+		Expect(os.Remove(filepath.Join(devicePath, "reset_method"))).To(Succeed())
+		err := newResetter(pcireset.MethodFLR).Reset(context.Background(), pciAddress)
+		Expect(err).To(MatchError(ContainSubstring("does not support selecting the reset method")))
+		Expect(readAttribute("reset")).To(BeEmpty())
+	})
+
+	It("fails if the device cannot be reset", func() {
+		Expect(os.Remove(filepath.Join(devicePath, "reset"))).To(Succeed())
+		err := newResetter(pcireset.MethodAuto).Reset(context.Background(), pciAddress)
+		Expect(err).To(MatchError(ContainSubstring("resetting " + pciAddress)))
+		Expect(filepath.Join(devicePath, "reset")).ToNot(BeAnExistingFile())
+	})
+
+	It("fails if the device does not answer before the reset", func() {
+		writeAttribute("config", "\xff\xff\xff\xff")
+		err := newResetter(pcireset.MethodAuto).Reset(context.Background(), pciAddress)
+		Expect(err).To(MatchError(ContainSubstring("does not answer config space reads")))
+		Expect(readAttribute("reset")).To(BeEmpty())
+	})
+
+	It("fails if the device does not come back", func() {
+		// the device stops answering config space reads once it is reset
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			Eventually(func() string { return readAttribute("reset") }, time.Second, time.Millisecond).Should(Equal("1"))
+			writeAttribute("config", "\xff\xff\xff\xff")
+		}()
+
+		err := newResetter(pcireset.MethodAuto).Reset(context.Background(), pciAddress)
+		Expect(err).To(MatchError(ContainSubstring("did not come back")))
+		<-done
+	})
+})
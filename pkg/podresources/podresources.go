@@ -0,0 +1,105 @@
+package podresources
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	corev1 "k8s.io/api/core/v1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	// DefaultSocket is the socket kubelet serves the PodResources API on
+	DefaultSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+	// KubeVirt names the pod running a VMI virt-launcher-<vmi>-<random suffix>
+	virtLauncherPrefix = "virt-launcher-"
+	connectionTimeout  = 5 * time.Second
+
+	kubevirtGroup = "kubevirt.io"
+	vmiKind       = "VirtualMachineInstance"
+)
+
+// Allocation describes a device allocated by kubelet to a container
+type Allocation struct {
+	Resource   string `json:"resource"`
+	DeviceID   string `json:"deviceID"`
+	PCIAddress string `json:"pciAddress"`
+	Namespace  string `json:"namespace"`
+	Pod        string `json:"pod"`
+	Container  string `json:"container"`
+	// VMI is the name of the VirtualMachineInstance run by the pod, empty for other pods.
+	// It is guessed from the pod name unless the tracker can read the pod owner.
+	VMI string `json:"vmi,omitempty"`
+}
+
+// Connect returns a client of the PodResources API served on the given socket
+func Connect(socket string) (podresourcesapi.PodResourcesListerClient, *grpc.ClientConn, error) {
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to the PodResources API at %s: %w", socket, err)
+	}
+	return podresourcesapi.NewPodResourcesListerClient(conn), conn, nil
+}
+
+// InUse lists the allocations of the given devices, indexed by device ID.
+// devices maps the device IDs of interest to their PCI addresses.
+func InUse(ctx context.Context, client podresourcesapi.PodResourcesListerClient, devices map[string]string) (map[string]Allocation, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectionTimeout)
+	defer cancel()
+	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("listing pod resources: %w", err)
+	}
+
+	inUse := map[string]Allocation{}
+	for _, pod := range resp.PodResources {
+		for _, container := range pod.Containers {
+			for _, containerDevices := range container.Devices {
+				for _, deviceID := range containerDevices.DeviceIds {
+					pciAddress, ok := devices[deviceID]
+					if !ok {
+						continue
+					}
+					inUse[deviceID] = Allocation{
+						Resource:   containerDevices.ResourceName,
+						DeviceID:   deviceID,
+						PCIAddress: pciAddress,
+						Namespace:  pod.Namespace,
+						Pod:        pod.Name,
+						Container:  container.Name,
+						VMI:        VMIName(pod.Name),
+					}
+				}
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// VMIOwner returns the name of the VirtualMachineInstance owning a virt-launcher pod, or "" for other pods
+func VMIOwner(pod *corev1.Pod) string {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == vmiKind && strings.HasPrefix(owner.APIVersion, kubevirtGroup+"/") {
+			return owner.Name
+		}
+	}
+	return ""
+}
+
+// VMIName returns the name of the VMI run by a virt-launcher pod, or "" for other pods
+func VMIName(podName string) string {
+	if !strings.HasPrefix(podName, virtLauncherPrefix) {
+		return ""
+	}
+	name := strings.TrimPrefix(podName, virtLauncherPrefix)
+	i := strings.LastIndex(name, "-")
+	if i <= 0 {
+		return ""
+	}
+	return name[:i]
+}
@@ -0,0 +1,262 @@
+package podresources_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"kubevirt-nvidia-device-plugin/pkg/podresources"
+)
+
+const resourceName = "nvidia.com/GH100_H100_SXM5_80GB"
+
+// fakeLister serves the pod resources of a fake kubelet
+type fakeLister struct {
+	podresourcesapi.PodResourcesListerClient
+	pods []*podresourcesapi.PodResources
+}
+
+func (f *fakeLister) List(ctx context.Context, in *podresourcesapi.ListPodResourcesRequest, opts ...grpc.CallOption) (*podresourcesapi.ListPodResourcesResponse, error) {
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+// slowFirstLister answers the first List call after a delay with the first pods, the later calls at
+// once with no pod
+type slowFirstLister struct {
+	podresourcesapi.PodResourcesListerClient
+	first   []*podresourcesapi.PodResources
+	calls   atomic.Int32
+	started chan struct{} // closed once the first call started
+}
+
+func (f *slowFirstLister) List(ctx context.Context, in *podresourcesapi.ListPodResourcesRequest, opts ...grpc.CallOption) (*podresourcesapi.ListPodResourcesResponse, error) {
+	if f.calls.Add(1) > 1 {
+		return &podresourcesapi.ListPodResourcesResponse{}, nil
+	}
+	close(f.started)
+	time.Sleep(50 * time.Millisecond)
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.first}, nil
+}
+
+func pod(namespace string, name string, container string, resource string, deviceIDs ...string) *podresourcesapi.PodResources {
+	return &podresourcesapi.PodResources{
+		Namespace: namespace,
+		Name:      name,
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name:    container,
+			Devices: []*podresourcesapi.ContainerDevices{{ResourceName: resource, DeviceIds: deviceIDs}},
+		}},
+	}
+}
+
+var devices = map[string]string{
+	"42|0000:1b:00.0": "0000:1b:00.0",
+	"97|0000:9a:00.0": "0000:9a:00.0",
+}
+
+var _ = Describe("VMIName", func() {
+	It("returns the VMI of virt-launcher pods", func() {
+		Expect(podresources.VMIName("virt-launcher-gpu-vm-x7k2p")).To(Equal("gpu-vm"))
+		Expect(podresources.VMIName("virt-launcher-vm-x7k2p")).To(Equal("vm"))
+	})
+
+	It("ignores other pods", func() {
+		Expect(podresources.VMIName("cuda-job-x7k2p")).To(BeEmpty())
+		Expect(podresources.VMIName("virt-launcher-x7k2p")).To(BeEmpty())
+	})
+})
+
+var _ = Describe("VMIOwner", func() {
+	It("returns the owning VMI", func() {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "rs"},
+			{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachineInstance", Name: "gpu-vm"},
+		}}}
+		Expect(podresources.VMIOwner(pod)).To(Equal("gpu-vm"))
+		Expect(podresources.VMIOwner(&corev1.Pod{})).To(BeEmpty())
+	})
+})
+
+var _ = Describe("InUse", func() {
+	It("maps the allocated devices to their pods", func() {
+		lister := &fakeLister{pods: []*podresourcesapi.PodResources{
+			pod("vms", "virt-launcher-gpu-vm-x7k2p", "compute", resourceName, "42|0000:1b:00.0"),
+			pod("default", "nic-pod", "main", "mellanox.com/cx6", "0000:3b:00.1"),
+		}}
+		inUse, err := podresources.InUse(context.Background(), lister, devices)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inUse).To(Equal(map[string]podresources.Allocation{
+			"42|0000:1b:00.0": {
+				Resource:   resourceName,
+				DeviceID:   "42|0000:1b:00.0",
+				PCIAddress: "0000:1b:00.0",
+				Namespace:  "vms",
+				Pod:        "virt-launcher-gpu-vm-x7k2p",
+				Container:  "compute",
+				VMI:        "gpu-vm",
+			},
+		}))
+	})
+})
+
+var _ = Describe("Tracker", func() {
+	var (
+		lister  *fakeLister
+		tracker *podresources.Tracker
+		changes map[string]*podresources.Allocation
+	)
+
+	BeforeEach(func() {
+		lister = &fakeLister{}
+		tracker = podresources.NewTracker(lister, devices)
+		changes = map[string]*podresources.Allocation{}
+		tracker.OnChange(func(pciAddress string, allocation *podresources.Allocation) {
+			changes[pciAddress] = allocation
+		})
+	})
+
+	It("reports allocated and released devices", func() {
+		lister.pods = []*podresourcesapi.PodResources{
+			pod("vms", "virt-launcher-gpu-vm-x7k2p", "compute", resourceName, "42|0000:1b:00.0", "97|0000:9a:00.0"),
+		}
+		Expect(tracker.Refresh(context.Background())).To(Succeed())
+		Expect(changes).To(HaveLen(2))
+		Expect(changes["0000:1b:00.0"]).To(HaveField("VMI", "gpu-vm"))
+		Expect(tracker.Allocations()).To(HaveLen(2))
+		Expect(tracker.Allocations()[0].PCIAddress).To(Equal("0000:1b:00.0"))
+
+		allocation, ok := tracker.Lookup("97|0000:9a:00.0")
+		Expect(ok).To(BeTrue())
+		Expect(allocation.Pod).To(Equal("virt-launcher-gpu-vm-x7k2p"))
+
+		changes = map[string]*podresources.Allocation{}
+		lister.pods = []*podresourcesapi.PodResources{
+			pod("vms", "virt-launcher-gpu-vm-x7k2p", "compute", resourceName, "42|0000:1b:00.0"),
+		}
+		Expect(tracker.Refresh(context.Background())).To(Succeed())
+		Expect(changes).To(Equal(map[string]*podresources.Allocation{"0000:9a:00.0": nil}), "unchanged allocations are not reported")
+		_, ok = tracker.Lookup("97|0000:9a:00.0")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("finds the VMI from the owner of the virt-launcher pod", func() {
+		launcher := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "vms",
+			Name:      "virt-launcher-gpu-vm-x7k2p",
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachineInstance", Name: "gpu-vm-renamed"},
+			},
+		}}
+		other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "virt-launcher-lookalike-abcde"}}
+		client := fake.NewSimpleClientset(launcher, other)
+		tracker.SetPodClient(client)
+
+		lister.pods = []*podresourcesapi.PodResources{
+			pod("vms", launcher.Name, "compute", resourceName, "42|0000:1b:00.0"),
+			pod("default", other.Name, "main", resourceName, "97|0000:9a:00.0"),
+		}
+		Expect(tracker.Refresh(context.Background())).To(Succeed())
+		Expect(tracker.Allocations()).To(ConsistOf(
+			HaveField("VMI", "gpu-vm-renamed"),
+			HaveField("VMI", BeEmpty()),
+		))
+
+		// Owners are looked up once per pod
+		Expect(tracker.Refresh(context.Background())).To(Succeed())
+		gets := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "get" {
+				gets++
+			}
+		}
+		Expect(gets).To(Equal(2))
+	})
+
+	It("guesses the VMI from the pod name if the pod cannot be read", func() {
+		tracker.SetPodClient(fake.NewSimpleClientset())
+		lister.pods = []*podresourcesapi.PodResources{
+			pod("vms", "virt-launcher-gpu-vm-x7k2p", "compute", resourceName, "42|0000:1b:00.0"),
+		}
+		Expect(tracker.Refresh(context.Background())).To(Succeed())
+		Expect(tracker.Allocations()).To(ConsistOf(HaveField("VMI", "gpu-vm")))
+	})
+
+	It("ends with the latest allocations when refreshed concurrently", func() {
+		// the first List call is slow and still reports the device the pod released since
+		lister := &slowFirstLister{
+			first: []*podresourcesapi.PodResources{
+				pod("vms", "virt-launcher-gpu-vm-x7k2p", "compute", resourceName, "42|0000:1b:00.0"),
+			},
+			started: make(chan struct{}),
+		}
+		tracker := podresources.NewTracker(lister, devices)
+		var allocated, released atomic.Int32
+		tracker.OnChange(func(pciAddress string, allocation *podresources.Allocation) {
+			if allocation != nil {
+				allocated.Add(1)
+			} else {
+				released.Add(1)
+			}
+		})
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			Expect(tracker.Refresh(context.Background())).To(Succeed())
+		}()
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			<-lister.started
+			Expect(tracker.Refresh(context.Background())).To(Succeed())
+		}()
+		wg.Wait()
+
+		_, ok := tracker.Lookup("42|0000:1b:00.0")
+		Expect(ok).To(BeFalse())
+		Expect(allocated.Load()).To(BeEquivalentTo(1))
+		Expect(released.Load()).To(BeEquivalentTo(1))
+	})
+
+	It("tells whether the container holding a device is running", func() {
+		running := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "vms", Name: "virt-launcher-gpu-vm-x7k2p"},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "compute", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+			}},
+		}
+		starting := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "vms", Name: "virt-launcher-new-vm-abcde"},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "compute", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}},
+			}},
+		}
+
+		_, err := tracker.ContainerRunning(context.Background(), podresources.Allocation{Namespace: "vms", Pod: running.Name, Container: "compute"})
+		Expect(err).To(MatchError(podresources.ErrNoPodClient))
+
+		tracker.SetPodClient(fake.NewSimpleClientset(running, starting))
+		Expect(tracker.ContainerRunning(context.Background(), podresources.Allocation{Namespace: "vms", Pod: running.Name, Container: "compute"})).To(BeTrue())
+		Expect(tracker.ContainerRunning(context.Background(), podresources.Allocation{Namespace: "vms", Pod: starting.Name, Container: "compute"})).To(BeFalse())
+		Expect(tracker.ContainerRunning(context.Background(), podresources.Allocation{Namespace: "vms", Pod: "deleted", Container: "compute"})).To(BeFalse())
+	})
+
+	It("reports no allocations when disabled", func() {
+		var disabled *podresources.Tracker
+		Expect(disabled.Refresh(context.Background())).To(Succeed())
+		_, ok := disabled.Lookup("42|0000:1b:00.0")
+		Expect(ok).To(BeFalse())
+		Expect(disabled.Allocations()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,236 @@
+package podresources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	klog "k8s.io/klog/v2"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"kubevirt-nvidia-device-plugin/pkg/metrics"
+)
+
+// DefaultRefreshInterval is how often the tracker lists the pod resources
+const DefaultRefreshInterval = 10 * time.Second
+
+// ErrNoPodClient is returned when the state of a pod is needed but the tracker cannot read pods
+var ErrNoPodClient = errors.New("the tracker has no pod client")
+
+// Tracker keeps track of the devices kubelet allocated to containers.
+// The methods of a nil Tracker report no allocations, so callers do not have to check whether it is enabled.
+type Tracker struct {
+	client podresourcesapi.PodResourcesListerClient
+
+	refreshMu sync.Mutex // serializes the refreshes, so every change is reported once
+
+	mu       sync.RWMutex
+	devices  map[string]string // device ID to PCI address
+	pods     kubernetes.Interface
+	inUse    map[string]Allocation
+	owners   map[string]string // namespace/name of the pods to the VMI owning them
+	onChange []func(pciAddress string, allocation *Allocation)
+}
+
+// NewTracker returns a tracker of the given devices, mapping device IDs to PCI addresses
+func NewTracker(client podresourcesapi.PodResourcesListerClient, devices map[string]string) *Tracker {
+	return &Tracker{
+		client:  client,
+		devices: devices,
+		inUse:   map[string]Allocation{},
+		owners:  map[string]string{},
+	}
+}
+
+// SetDevices replaces the tracked devices, mapping device IDs to PCI addresses
+func (t *Tracker) SetDevices(devices map[string]string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.devices = devices
+}
+
+// SetPodClient makes the tracker find the VMI of a pod from the owner references of the
+// virt-launcher pod instead of guessing it from the pod name
+func (t *Tracker) SetPodClient(client kubernetes.Interface) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pods = client
+}
+
+// OnChange registers a function called with the new allocation of every device whose allocation
+// changed, nil if the device was released
+func (t *Tracker) OnChange(fn func(pciAddress string, allocation *Allocation)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onChange = append(t.onChange, fn)
+}
+
+// Run refreshes the allocations every interval until ctx is cancelled
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := t.Refresh(ctx); err != nil {
+			klog.ErrorS(err, "Could not refresh the device allocations")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh lists the allocations from kubelet and reports the devices which were allocated or released
+func (t *Tracker) Refresh(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.refreshMu.Lock()
+	defer t.refreshMu.Unlock()
+	t.mu.RLock()
+	devices := t.devices
+	t.mu.RUnlock()
+	inUse, err := InUse(ctx, t.client, devices)
+	if err != nil {
+		return err
+	}
+	owners := t.resolveOwners(ctx, inUse)
+
+	t.mu.Lock()
+	previous := t.inUse
+	t.inUse = inUse
+	t.owners = owners
+	onChange := t.onChange
+	t.mu.Unlock()
+
+	for deviceID, allocation := range inUse {
+		if old, ok := previous[deviceID]; ok && old == allocation {
+			continue
+		}
+		klog.InfoS("Device allocated", "resource", allocation.Resource, "pciAddress", allocation.PCIAddress, "pod", klog.KRef(allocation.Namespace, allocation.Pod), "container", allocation.Container, "vmi", allocation.VMI)
+		allocation := allocation
+		for _, fn := range onChange {
+			fn(allocation.PCIAddress, &allocation)
+		}
+	}
+	for deviceID, allocation := range previous {
+		if _, ok := inUse[deviceID]; ok {
+			continue
+		}
+		klog.InfoS("Device released", "resource", allocation.Resource, "pciAddress", allocation.PCIAddress, "pod", klog.KRef(allocation.Namespace, allocation.Pod))
+		for _, fn := range onChange {
+			fn(allocation.PCIAddress, nil)
+		}
+	}
+
+	metrics.DeviceAllocation.Reset()
+	for _, allocation := range inUse {
+		metrics.DeviceAllocation.WithLabelValues(allocation.Resource, allocation.PCIAddress, allocation.Namespace, allocation.Pod, allocation.VMI).Set(1)
+	}
+	return nil
+}
+
+// resolveOwners sets the VMI of the allocations from the owner references of their pods and
+// returns the owners of the pods still holding devices. Owners are looked up once per pod.
+func (t *Tracker) resolveOwners(ctx context.Context, inUse map[string]Allocation) map[string]string {
+	t.mu.RLock()
+	pods := t.pods
+	cached := t.owners
+	t.mu.RUnlock()
+
+	owners := map[string]string{}
+	if pods == nil {
+		return owners
+	}
+	for deviceID, allocation := range inUse {
+		key := allocation.Namespace + "/" + allocation.Pod
+		vmi, ok := owners[key]
+		if !ok {
+			vmi, ok = cached[key]
+		}
+		if !ok {
+			pod, err := pods.CoreV1().Pods(allocation.Namespace).Get(ctx, allocation.Pod, metav1.GetOptions{})
+			if err != nil {
+				// The VMI guessed from the pod name is kept until the pod can be read
+				klog.V(2).InfoS("Could not get pod holding a device", "pod", klog.KRef(allocation.Namespace, allocation.Pod), "err", err)
+				continue
+			}
+			vmi = VMIOwner(pod)
+		}
+		owners[key] = vmi
+		allocation.VMI = vmi
+		inUse[deviceID] = allocation
+	}
+	return owners
+}
+
+// ContainerRunning reads the pod of an allocation and returns whether the container holding the
+// device is running. A container of a pod which no longer exists is not running.
+func (t *Tracker) ContainerRunning(ctx context.Context, allocation Allocation) (bool, error) {
+	if t == nil {
+		return false, ErrNoPodClient
+	}
+	t.mu.RLock()
+	pods := t.pods
+	t.mu.RUnlock()
+	if pods == nil {
+		return false, ErrNoPodClient
+	}
+	pod, err := pods.CoreV1().Pods(allocation.Namespace).Get(ctx, allocation.Pod, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting pod %s/%s: %w", allocation.Namespace, allocation.Pod, err)
+	}
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if status.Name == allocation.Container {
+			return status.State.Running != nil, nil
+		}
+	}
+	return false, nil
+}
+
+// Lookup returns the allocation of the device with the given ID, as of the last refresh
+func (t *Tracker) Lookup(deviceID string) (Allocation, bool) {
+	if t == nil {
+		return Allocation{}, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	allocation, ok := t.inUse[deviceID]
+	return allocation, ok
+}
+
+// Allocations returns the current allocations sorted by PCI address
+func (t *Tracker) Allocations() []Allocation {
+	if t == nil {
+		return nil
+	}
+	t.mu.RLock()
+	allocations := make([]Allocation, 0, len(t.inUse))
+	for _, allocation := range t.inUse {
+		allocations = append(allocations, allocation)
+	}
+	t.mu.RUnlock()
+	sort.Slice(allocations, func(i, j int) bool {
+		return allocations[i].PCIAddress < allocations[j].PCIAddress
+	})
+	return allocations
+}
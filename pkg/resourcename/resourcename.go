@@ -0,0 +1,116 @@
+package resourcename
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	klog "k8s.io/klog/v2"
+)
+
+// MaxNameLength is the maximum length of the name part of an extended resource name
+const MaxNameLength = 63
+
+var (
+	whitespace      = regexp.MustCompile(`\s+`)
+	invalidNameChar = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+	// the name part has to start and end with an alphanumeric character
+	untrimmed = regexp.MustCompile(`^[^a-zA-Z0-9]+|[^a-zA-Z0-9]+$`)
+)
+
+// Sanitize turns a pci.ids device name into the name part of a resource name, e.g.
+// "GH100 [H100 SXM5 80GB]" into GH100_H100_SXM5_80GB. It returns "" if nothing is left.
+func Sanitize(deviceName string) string {
+	name := strings.TrimSpace(deviceName)
+	name = strings.NewReplacer("/", "_", ".", "_").Replace(name)
+	name = whitespace.ReplaceAllString(name, "_")
+	// Removes any char other than alphanumeric and underscore
+	name = invalidNameChar.ReplaceAllString(name, "")
+	return truncate(name, MaxNameLength)
+}
+
+// truncate shortens the name to at most max characters, keeping it alphanumeric at both ends
+func truncate(name string, max int) string {
+	if len(name) > max {
+		name = name[:max]
+	}
+	return untrimmed.ReplaceAllString(name, "")
+}
+
+// Validate checks that namespace/name is a valid extended resource name
+func Validate(namespace string, name string) error {
+	if errs := validation.IsDNS1123Subdomain(namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid resource namespace %q: %s", namespace, strings.Join(errs, ", "))
+	}
+	if namespace == "kubernetes.io" || strings.HasSuffix(namespace, ".kubernetes.io") {
+		return fmt.Errorf("resource namespace %q is reserved for native resources", namespace)
+	}
+	resourceName := namespace + "/" + name
+	// extended resources are also quota resources prefixed with requests.
+	if errs := validation.IsQualifiedName("requests." + resourceName); len(errs) > 0 {
+		return fmt.Errorf("invalid resource name %q: %s", resourceName, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Candidate is a name proposed for the devices with one vendor and device ID
+type Candidate struct {
+	Namespace string
+	Name      string
+	VendorID  string
+	DeviceID  string
+	// Fixed names are shared on purpose, e.g. set by a selector for several device IDs,
+	// and are never suffixed
+	Fixed bool
+}
+
+// Resolve returns the resource names of the candidates, in the order of the candidates, making
+// sure device IDs with different candidates do not share a name. Fixed names are kept, then the
+// candidate with the lowest vendor and device ID keeps a contested name and the others get their
+// device ID appended, and their vendor ID too if that is not enough.
+func Resolve(candidates []Candidate) []string {
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := candidates[order[i]], candidates[order[j]]
+		if a.Fixed != b.Fixed {
+			return a.Fixed
+		}
+		if a.VendorID != b.VendorID {
+			return a.VendorID < b.VendorID
+		}
+		return a.DeviceID < b.DeviceID
+	})
+
+	names := make([]string, len(candidates))
+	owners := map[string]string{} // resource name to the vendor:device ID owning it
+	for _, i := range order {
+		c := candidates[i]
+		id := c.VendorID + ":" + c.DeviceID
+		if c.Fixed {
+			names[i] = c.Name
+			owners[c.Namespace+"/"+c.Name] = ""
+			continue
+		}
+		name := c.Name
+		for _, suffix := range []string{"", c.DeviceID, c.VendorID + "_" + c.DeviceID} {
+			if suffix != "" {
+				name = truncate(c.Name, MaxNameLength-len(suffix)-1) + "_" + suffix
+			}
+			owner, taken := owners[c.Namespace+"/"+name]
+			if !taken || owner == id {
+				break
+			}
+		}
+		if name != c.Name {
+			klog.ErrorS(nil, "Resource name is used by another device ID, suffixing it", "resource", c.Namespace+"/"+c.Name, "vendorID", c.VendorID, "deviceID", c.DeviceID, "name", name)
+		}
+		owners[c.Namespace+"/"+name] = id
+		names[i] = name
+	}
+	return names
+}
@@ -0,0 +1,93 @@
+package resourcename_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/resourcename"
+)
+
+var _ = Describe("Sanitize", func() {
+	DescribeTable("derives valid names from pci.ids names",
+		func(deviceName string, expected string) {
+			name := resourcename.Sanitize(deviceName)
+			Expect(name).To(Equal(expected))
+			if name != "" {
+				Expect(resourcename.Validate("nvidia.com", name)).To(Succeed())
+			}
+		},
+		Entry("brackets and spaces", "GH100 [H100 SXM5 80GB]", "GH100_H100_SXM5_80GB"),
+		Entry("slashes and dots", "GA100GL [A30 PCIe / A30X.1]", "GA100GL_A30_PCIe___A30X_1"),
+		Entry("dashes", "MT43244 BlueField-3 integrated ConnectX-7 network controller", "MT43244_BlueField3_integrated_ConnectX7_network_controller"),
+		Entry("leading and trailing separators", "[GH100] ", "GH100"),
+		Entry("nothing left", "[/]", ""),
+		Entry("too long", strings.Repeat("A", 62)+" B", strings.Repeat("A", 62)),
+	)
+})
+
+var _ = Describe("Validate", func() {
+	It("accepts extended resource names", func() {
+		Expect(resourcename.Validate("nvidia.com", "GH100_H100_SXM5_80GB")).To(Succeed())
+	})
+
+	DescribeTable("rejects invalid names",
+		func(namespace string, name string) {
+			Expect(resourcename.Validate(namespace, name)).NotTo(Succeed())
+		},
+		Entry("invalid namespace", "NVIDIA_COM", "GH100"),
+		Entry("native namespace", "kubernetes.io", "GH100"),
+		Entry("native subdomain", "node.kubernetes.io", "GH100"),
+		Entry("trailing separator", "nvidia.com", "GH100_"),
+		Entry("too long", "nvidia.com", strings.Repeat("A", 64)),
+		Entry("empty", "nvidia.com", ""),
+	)
+})
+
+var _ = Describe("Resolve", func() {
+	It("keeps unique names", func() {
+		Expect(resourcename.Resolve([]resourcename.Candidate{
+			{Namespace: "nvidia.com", Name: "GH100_H100_SXM5_80GB", VendorID: "10de", DeviceID: "2330"},
+			{Namespace: "nvidia.com", Name: "GH100_H100_NVSwitch", VendorID: "10de", DeviceID: "22a3"},
+		})).To(Equal([]string{"GH100_H100_SXM5_80GB", "GH100_H100_NVSwitch"}))
+	})
+
+	It("suffixes colliding names with the device ID regardless of order", func() {
+		candidates := []resourcename.Candidate{
+			{Namespace: "nvidia.com", Name: "GH100", VendorID: "10de", DeviceID: "2336"},
+			{Namespace: "nvidia.com", Name: "GH100", VendorID: "10de", DeviceID: "2330"},
+			{Namespace: "example.com", Name: "GH100", VendorID: "10de", DeviceID: "2331"},
+		}
+		Expect(resourcename.Resolve(candidates)).To(Equal([]string{"GH100_2336", "GH100", "GH100"}))
+
+		candidates[0], candidates[1] = candidates[1], candidates[0]
+		Expect(resourcename.Resolve(candidates)).To(Equal([]string{"GH100", "GH100_2336", "GH100"}))
+	})
+
+	It("suffixes the vendor ID if the device ID is not enough", func() {
+		Expect(resourcename.Resolve([]resourcename.Candidate{
+			{Namespace: "nvidia.com", Name: "NIC", VendorID: "8086", DeviceID: "1234"},
+			{Namespace: "nvidia.com", Name: "NIC", VendorID: "15b3", DeviceID: "1234"},
+			{Namespace: "nvidia.com", Name: "NIC_1234", VendorID: "15b3", DeviceID: "5678"},
+		})).To(Equal([]string{"NIC_8086_1234", "NIC", "NIC_1234"}))
+	})
+
+	It("keeps fixed names and suffixes the names colliding with them", func() {
+		Expect(resourcename.Resolve([]resourcename.Candidate{
+			{Namespace: "nvidia.com", Name: "BlueField3", VendorID: "15b3", DeviceID: "a2d6"},
+			{Namespace: "nvidia.com", Name: "BlueField3", VendorID: "15b3", DeviceID: "a2dc", Fixed: true},
+		})).To(Equal([]string{"BlueField3_a2d6", "BlueField3"}))
+	})
+
+	It("keeps the names within the length limit", func() {
+		long := strings.Repeat("A", resourcename.MaxNameLength)
+		names := resourcename.Resolve([]resourcename.Candidate{
+			{Namespace: "nvidia.com", Name: long, VendorID: "10de", DeviceID: "2330"},
+			{Namespace: "nvidia.com", Name: long, VendorID: "10de", DeviceID: "2331"},
+		})
+		Expect(names[1]).To(HaveLen(resourcename.MaxNameLength))
+		Expect(names[1]).To(HaveSuffix("_2331"))
+		Expect(resourcename.Validate("nvidia.com", names[1])).To(Succeed())
+	})
+})
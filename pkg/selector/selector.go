@@ -0,0 +1,181 @@
+package selector
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"kubevirt-nvidia-device-plugin/pkg/resourcename"
+)
+
+const (
+	// DefaultVendorID is the vendor selected when no selector is configured
+	DefaultVendorID = "10de"
+	// DefaultResourceNamespace is the resource namespace of selectors which do not set one
+	DefaultResourceNamespace = "nvidia.com"
+)
+
+// DefaultClasses are the classes selected when no selector is configured: display and 3D
+// controllers, the GPUs, and other bridges, the NVSwitches. The audio, USB and UCSI functions
+// of consumer and workstation boards are not selected.
+var DefaultClasses = []string{"0300", "0302", "0680"}
+
+// Selector selects the PCI functions advertised under one resource namespace. Every set field
+// has to match, a field matches if the function has any of the listed values.
+type Selector struct {
+	// VendorID is the PCI vendor ID, e.g. 10de
+	VendorID string `json:"vendorID"`
+	// DeviceIDs restricts the selected PCI device IDs, e.g. 2330
+	DeviceIDs []string `json:"deviceIDs,omitempty"`
+	// Classes restricts the selected PCI classes, given as class (03), class and subclass (0302)
+	// or class, subclass and programming interface (030200)
+	Classes []string `json:"classes,omitempty"`
+	// Drivers restricts the selected functions to the ones bound to one of the kernel drivers
+	Drivers []string `json:"drivers,omitempty"`
+	// ResourceNamespace is the namespace of the advertised resource names, nvidia.com if empty
+	ResourceNamespace string `json:"resourceNamespace,omitempty"`
+	// ResourceName advertises every selected function under this name. If empty, each device ID
+	// is advertised under the device name found in pci.ids.
+	ResourceName string `json:"resourceName,omitempty"`
+	// AttachCompanions passes the other functions of the slot of a selected function through with
+	// it, e.g. the HDMI audio and USB-C functions of a GPU, unless they are selected themselves
+	AttachCompanions bool `json:"attachCompanions,omitempty"`
+}
+
+// Config is the content of the selector configuration file
+type Config struct {
+	Selectors []Selector `json:"selectors"`
+}
+
+// Device holds the PCI function properties matched by the selectors
+type Device struct {
+	VendorID string
+	DeviceID string
+	// Class is the class code with subclass and programming interface, e.g. 030200
+	Class  string
+	Driver string
+}
+
+// Default returns the selectors used when none are configured: the NVIDIA GPUs and NVSwitches,
+// advertised in the nvidia.com namespace
+func Default() []Selector {
+	return []Selector{{
+		VendorID:          DefaultVendorID,
+		Classes:           slices.Clone(DefaultClasses),
+		ResourceNamespace: DefaultResourceNamespace,
+	}}
+}
+
+// Load reads and validates the selectors of a configuration file
+func Load(path string) ([]Selector, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading selector configuration: %w", err)
+	}
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing selector configuration %s: %w", path, err)
+	}
+	if len(config.Selectors) == 0 {
+		return nil, fmt.Errorf("selector configuration %s has no selectors", path)
+	}
+	for i := range config.Selectors {
+		if err := config.Selectors[i].normalize(); err != nil {
+			return nil, fmt.Errorf("selector %d of %s: %w", i, path, err)
+		}
+	}
+	return config.Selectors, nil
+}
+
+// normalize validates the selector, lowercases the IDs and sets the default resource namespace
+func (s *Selector) normalize() error {
+	s.VendorID = strings.ToLower(strings.TrimPrefix(s.VendorID, "0x"))
+	if !isHex(s.VendorID, 4) {
+		return fmt.Errorf("vendorID %q is not a 4 digit hexadecimal ID", s.VendorID)
+	}
+	for i, id := range s.DeviceIDs {
+		s.DeviceIDs[i] = strings.ToLower(strings.TrimPrefix(id, "0x"))
+		if !isHex(s.DeviceIDs[i], 4) {
+			return fmt.Errorf("device ID %q is not a 4 digit hexadecimal ID", id)
+		}
+	}
+	for i, class := range s.Classes {
+		s.Classes[i] = strings.ToLower(strings.TrimPrefix(class, "0x"))
+		if n := len(s.Classes[i]); (n != 2 && n != 4 && n != 6) || !isHex(s.Classes[i], n) {
+			return fmt.Errorf("class %q is not a 2, 4 or 6 digit hexadecimal class code", class)
+		}
+	}
+	if s.ResourceNamespace == "" {
+		s.ResourceNamespace = DefaultResourceNamespace
+	}
+	if errs := validation.IsDNS1123Subdomain(s.ResourceNamespace); len(errs) > 0 {
+		return fmt.Errorf("resourceNamespace %q: %s", s.ResourceNamespace, strings.Join(errs, ", "))
+	}
+	if s.ResourceName != "" {
+		if err := resourcename.Validate(s.ResourceNamespace, s.ResourceName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches returns whether the selector selects the device
+func (s *Selector) Matches(d Device) bool {
+	if !strings.EqualFold(s.VendorID, d.VendorID) {
+		return false
+	}
+	if len(s.DeviceIDs) > 0 && !containsFold(s.DeviceIDs, d.DeviceID) {
+		return false
+	}
+	if len(s.Classes) > 0 {
+		matched := false
+		for _, class := range s.Classes {
+			if strings.HasPrefix(strings.ToLower(d.Class), class) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(s.Drivers) > 0 && !containsFold(s.Drivers, d.Driver) {
+		return false
+	}
+	return true
+}
+
+// Match returns the index of the first selector selecting the device, or -1 if none does
+func Match(selectors []Selector, d Device) int {
+	for i := range selectors {
+		if selectors[i].Matches(d) {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
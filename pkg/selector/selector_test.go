@@ -0,0 +1,85 @@
+package selector_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/selector"
+)
+
+var _ = Describe("Selector", func() {
+	gpu := selector.Device{VendorID: "10de", DeviceID: "2330", Class: "030200", Driver: "vfio-pci"}
+	dpu := selector.Device{VendorID: "15b3", DeviceID: "a2dc", Class: "020000", Driver: "vfio-pci"}
+
+	It("selects the NVIDIA GPUs and NVSwitches by default", func() {
+		Expect(selector.Match(selector.Default(), gpu)).To(Equal(0))
+		Expect(selector.Match(selector.Default(), selector.Device{VendorID: "10de", DeviceID: "22a3", Class: "068000"})).To(Equal(0))
+		Expect(selector.Match(selector.Default(), dpu)).To(Equal(-1))
+	})
+
+	It("does not select the companion functions of a GPU by default", func() {
+		for _, class := range []string{"040300", "0c0330", "0c8000"} {
+			Expect(selector.Match(selector.Default(), selector.Device{VendorID: "10de", DeviceID: "1aef", Class: class})).To(Equal(-1), class)
+		}
+	})
+
+	DescribeTable("matches every set field",
+		func(s selector.Selector, matches bool) {
+			Expect(s.Matches(gpu)).To(Equal(matches))
+		},
+		Entry("vendor", selector.Selector{VendorID: "10DE"}, true),
+		Entry("other vendor", selector.Selector{VendorID: "15b3"}, false),
+		Entry("device ID", selector.Selector{VendorID: "10de", DeviceIDs: []string{"22a3", "2330"}}, true),
+		Entry("other device ID", selector.Selector{VendorID: "10de", DeviceIDs: []string{"22a3"}}, false),
+		Entry("class", selector.Selector{VendorID: "10de", Classes: []string{"03"}}, true),
+		Entry("class and subclass", selector.Selector{VendorID: "10de", Classes: []string{"0302"}}, true),
+		Entry("other subclass", selector.Selector{VendorID: "10de", Classes: []string{"0300"}}, false),
+		Entry("driver", selector.Selector{VendorID: "10de", Drivers: []string{"vfio-pci"}}, true),
+		Entry("other driver", selector.Selector{VendorID: "10de", Drivers: []string{"nvidia"}}, false),
+	)
+
+	Context("Load", func() {
+		var path string
+
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "selectors.yaml")
+		})
+
+		It("normalizes the selectors", func() {
+			Expect(os.WriteFile(path, []byte(`selectors:
+- vendorID: "10DE"
+  classes: ["0x0302"]
+  attachCompanions: true
+- vendorID: "15b3"
+  deviceIDs: ["A2DC", "a2d6"]
+  resourceNamespace: mellanox.com
+  resourceName: BlueField3
+`), 0644)).To(Succeed())
+			selectors, err := selector.Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(selectors).To(Equal([]selector.Selector{
+				{VendorID: "10de", Classes: []string{"0302"}, ResourceNamespace: "nvidia.com", AttachCompanions: true},
+				{VendorID: "15b3", DeviceIDs: []string{"a2dc", "a2d6"}, ResourceNamespace: "mellanox.com", ResourceName: "BlueField3"},
+			}))
+			Expect(selector.Match(selectors, dpu)).To(Equal(1))
+		})
+
+		DescribeTable("rejects invalid selectors",
+			func(content string) {
+				Expect(os.WriteFile(path, []byte(content), 0644)).To(Succeed())
+				_, err := selector.Load(path)
+				Expect(err).To(HaveOccurred())
+			},
+			Entry("no selectors", "selectors: []"),
+			Entry("unknown field", "selectors:\n- vendorID: \"10de\"\n  vendor: nvidia"),
+			Entry("invalid vendor", "selectors:\n- vendorID: nvidia"),
+			Entry("invalid device ID", "selectors:\n- vendorID: \"10de\"\n  deviceIDs: [\"233\"]"),
+			Entry("invalid class", "selectors:\n- vendorID: \"10de\"\n  classes: [\"030\"]"),
+			Entry("invalid namespace", "selectors:\n- vendorID: \"10de\"\n  resourceNamespace: NVIDIA_COM"),
+			Entry("invalid resource name", "selectors:\n- vendorID: \"15b3\"\n  resourceName: BlueField-3_"),
+		)
+	})
+})
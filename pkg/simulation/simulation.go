@@ -0,0 +1,200 @@
+package simulation
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultVendorID = "10de"
+	// 3D controller, the class of the datacenter GPUs
+	defaultClass    = "030200"
+	defaultDriver   = "vfio-pci"
+	defaultPCIeRoot = "pci0000:00"
+)
+
+// Host describes the PCI functions of a simulated host
+type Host struct {
+	Devices []Device `json:"devices"`
+}
+
+// Device describes a simulated PCI function
+type Device struct {
+	// PCIAddress is the address of the function, e.g. 0000:1b:00.0
+	PCIAddress string `json:"pciAddress"`
+	// VendorID defaults to 10de
+	VendorID string `json:"vendorID,omitempty"`
+	DeviceID string `json:"deviceID"`
+	// Class defaults to 030200, a 3D controller
+	Class             string `json:"class,omitempty"`
+	SubsystemVendorID string `json:"subsystemVendorID,omitempty"`
+	SubsystemDeviceID string `json:"subsystemDeviceID,omitempty"`
+	IOMMUGroup        string `json:"iommuGroup"`
+	// Driver defaults to vfio-pci, "none" simulates a function without driver
+	Driver string `json:"driver,omitempty"`
+	// NUMANode defaults to -1, no NUMA node
+	NUMANode *int `json:"numaNode,omitempty"`
+	// PCIeRoot defaults to pci0000:00
+	PCIeRoot string `json:"pcieRoot,omitempty"`
+}
+
+// Load reads and validates a host description, setting the defaults of the devices
+func Load(path string) (*Host, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading host description: %w", err)
+	}
+	var host Host
+	if err := yaml.UnmarshalStrict(data, &host); err != nil {
+		return nil, fmt.Errorf("parsing host description %s: %w", path, err)
+	}
+	addresses := map[string]bool{}
+	for i := range host.Devices {
+		d := &host.Devices[i]
+		if d.PCIAddress == "" || d.DeviceID == "" || d.IOMMUGroup == "" {
+			return nil, fmt.Errorf("device %d of %s: pciAddress, deviceID and iommuGroup are required", i, path)
+		}
+		if strings.ContainsAny(d.PCIAddress+d.IOMMUGroup, "/") {
+			return nil, fmt.Errorf("device %d of %s: invalid PCI address or IOMMU group", i, path)
+		}
+		if addresses[d.PCIAddress] {
+			return nil, fmt.Errorf("device %d of %s: duplicate PCI address %s", i, path, d.PCIAddress)
+		}
+		addresses[d.PCIAddress] = true
+		d.setDefaults()
+	}
+	return &host, nil
+}
+
+func (d *Device) setDefaults() {
+	if d.VendorID == "" {
+		d.VendorID = defaultVendorID
+	}
+	if d.Class == "" {
+		d.Class = defaultClass
+	}
+	if d.Driver == "" {
+		d.Driver = defaultDriver
+	}
+	if d.NUMANode == nil {
+		none := -1
+		d.NUMANode = &none
+	}
+	if d.PCIeRoot == "" {
+		d.PCIeRoot = defaultPCIeRoot
+	}
+}
+
+// Materialize creates the sysfs and /dev/vfio entries of the devices under root, laid out as
+// on a real host: root/sys/bus/pci/devices links to the functions in root/sys/devices, which
+// link to their driver and IOMMU group, and root/dev/vfio holds a file per IOMMU group.
+func (h *Host) Materialize(root string) error {
+	for _, dir := range []string{"sys/bus/pci/devices", "sys/kernel/iommu_groups", "dev/vfio"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := touch(filepath.Join(root, "dev/vfio/vfio")); err != nil {
+		return err
+	}
+	for _, d := range h.Devices {
+		if err := d.materialize(root); err != nil {
+			return fmt.Errorf("materializing %s: %w", d.PCIAddress, err)
+		}
+	}
+	return nil
+}
+
+// configHeader returns the start of the config space of a function: its vendor and device ID, little-endian
+func configHeader(vendorID string, deviceID string) ([]byte, error) {
+	header := make([]byte, 4)
+	for i, id := range []string{vendorID, deviceID} {
+		value, err := strconv.ParseUint(id, 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ID %q: %w", id, err)
+		}
+		binary.LittleEndian.PutUint16(header[2*i:], uint16(value))
+	}
+	return header, nil
+}
+
+func (d *Device) materialize(root string) error {
+	devicePath := filepath.Join("devices", d.PCIeRoot, d.PCIAddress)
+	dir := filepath.Join(root, "sys", devicePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	attributes := map[string]string{
+		"vendor":           "0x" + d.VendorID,
+		"device":           "0x" + d.DeviceID,
+		"class":            "0x" + d.Class,
+		"subsystem_vendor": "0x" + orDefault(d.SubsystemVendorID, d.VendorID),
+		"subsystem_device": "0x" + orDefault(d.SubsystemDeviceID, "0000"),
+		"numa_node":        strconv.Itoa(*d.NUMANode),
+		"reset":            "",
+	}
+	for name, value := range attributes {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	// resets are verified by reading the vendor ID from the config space
+	config, err := configHeader(d.VendorID, d.DeviceID)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config"), config, 0644); err != nil {
+		return err
+	}
+
+	// root/sys/bus/pci/devices/<address> -> ../../../devices/<pcie root>/<address>
+	if err := os.Symlink(filepath.Join("../../..", devicePath), filepath.Join(root, "sys/bus/pci/devices", d.PCIAddress)); err != nil {
+		return err
+	}
+
+	groupDir := filepath.Join(root, "sys/kernel/iommu_groups", d.IOMMUGroup, "devices")
+	if err := os.MkdirAll(groupDir, 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(filepath.Join(root, "sys/kernel/iommu_groups", d.IOMMUGroup), filepath.Join(dir, "iommu_group")); err != nil {
+		return err
+	}
+	if err := os.Symlink(dir, filepath.Join(groupDir, d.PCIAddress)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := touch(filepath.Join(root, "dev/vfio", d.IOMMUGroup)); err != nil {
+		return err
+	}
+
+	if d.Driver != "none" {
+		driverDir := filepath.Join(root, "sys/bus/pci/drivers", d.Driver)
+		if err := os.MkdirAll(driverDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(driverDir, filepath.Join(dir, "driver")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func touch(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
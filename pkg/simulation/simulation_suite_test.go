@@ -0,0 +1,13 @@
+package simulation_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSimulation(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Simulation Suite")
+}
@@ -0,0 +1,86 @@
+package simulation_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"kubevirt-nvidia-device-plugin/pkg/simulation"
+)
+
+var _ = Describe("Host", func() {
+	var dir string
+
+	load := func(content string) (*simulation.Host, error) {
+		path := filepath.Join(dir, "host.yaml")
+		Expect(os.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		return simulation.Load(path)
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("sets the defaults of the devices", func() {
+		host, err := load(`devices:
+- pciAddress: "0000:1b:00.0"
+  deviceID: "2330"
+  iommuGroup: "42"
+`)
+		Expect(err).NotTo(HaveOccurred())
+		none := -1
+		Expect(host.Devices).To(Equal([]simulation.Device{{
+			PCIAddress: "0000:1b:00.0",
+			VendorID:   "10de",
+			DeviceID:   "2330",
+			Class:      "030200",
+			IOMMUGroup: "42",
+			Driver:     "vfio-pci",
+			NUMANode:   &none,
+			PCIeRoot:   "pci0000:00",
+		}}))
+	})
+
+	DescribeTable("rejects invalid descriptions",
+		func(content string) {
+			_, err := load(content)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("missing IOMMU group", "devices:\n- pciAddress: \"0000:1b:00.0\"\n  deviceID: \"2330\""),
+		Entry("unknown field", "devices:\n- pciAddress: \"0000:1b:00.0\"\n  deviceID: \"2330\"\n  iommuGroup: \"42\"\n  numa: 0"),
+		Entry("path in the address", "devices:\n- pciAddress: \"../0000:1b:00.0\"\n  deviceID: \"2330\"\n  iommuGroup: \"42\""),
+		Entry("duplicate address", "devices:\n- pciAddress: \"0000:1b:00.0\"\n  deviceID: \"2330\"\n  iommuGroup: \"42\"\n- pciAddress: \"0000:1b:00.0\"\n  deviceID: \"2330\"\n  iommuGroup: \"43\""),
+	)
+
+	It("materializes the devices as sysfs and /dev/vfio entries", func() {
+		host, err := load(`devices:
+- pciAddress: "0000:1b:00.0"
+  deviceID: "2330"
+  iommuGroup: "42"
+  numaNode: 1
+  pcieRoot: pci0000:15
+- pciAddress: "0000:1b:00.1"
+  deviceID: "22a3"
+  class: "040300"
+  iommuGroup: "42"
+  driver: none
+`)
+		Expect(err).NotTo(HaveOccurred())
+		root := filepath.Join(dir, "root")
+		Expect(host.Materialize(root)).To(Succeed())
+
+		device := filepath.Join(root, "sys/bus/pci/devices/0000:1b:00.0")
+		Expect(os.Readlink(device)).To(Equal("../../../devices/pci0000:15/0000:1b:00.0"))
+		Expect(os.ReadFile(filepath.Join(device, "vendor"))).To(Equal([]byte("0x10de\n")))
+		Expect(os.ReadFile(filepath.Join(device, "config"))).To(Equal([]byte{0xde, 0x10, 0x30, 0x23}))
+		Expect(os.ReadFile(filepath.Join(device, "numa_node"))).To(Equal([]byte("1\n")))
+		Expect(os.Readlink(filepath.Join(device, "driver"))).To(HaveSuffix("/sys/bus/pci/drivers/vfio-pci"))
+		Expect(os.Readlink(filepath.Join(device, "iommu_group"))).To(HaveSuffix("/sys/kernel/iommu_groups/42"))
+		Expect(filepath.Join(root, "sys/kernel/iommu_groups/42/devices/0000:1b:00.1")).To(BeADirectory())
+		Expect(filepath.Join(root, "sys/bus/pci/devices/0000:1b:00.1/driver")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(root, "dev/vfio/vfio")).To(BeARegularFile())
+		Expect(filepath.Join(root, "dev/vfio/42")).To(BeARegularFile())
+	})
+})
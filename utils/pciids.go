@@ -0,0 +1,10 @@
+// Package utils holds the files bundled with the device plugin
+package utils
+
+import _ "embed"
+
+// PCIIDs is the snapshot of the pci.ids database the device plugin falls back to
+// when the host and the image have none. It is refreshed with make update-pcidb.
+//
+//go:embed pci.ids
+var PCIIDs []byte